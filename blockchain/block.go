@@ -2,7 +2,9 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"errors"
 	"log"
 	"time"
 )
@@ -15,36 +17,79 @@ type Block struct {
 	PrevHash     []byte         // Hash of the previous block in the chain
 	Nonce        int            // Nonce used for the proof of work algorithm
 	Height       int            // Height of the block in the blockchain
+	MerkleRoot   []byte         // Merkle root of the transaction IDs
+}
+
+// Represents the fields of a block covered by the proof of work, without its transactions
+// A light client can validate a chain of headers and check Merkle proofs against them
+type BlockHeader struct {
+	Timestamp  int64  // Timestamp of when the block was created
+	Hash       []byte // Hash of the block
+	PrevHash   []byte // Hash of the previous block in the chain
+	MerkleRoot []byte // Merkle root of the transaction IDs
+	Nonce      int    // Nonce used for the proof of work algorithm
+	Height     int    // Height of the block in the blockchain
+}
+
+// Returns the header of the block
+func (b *Block) Header() BlockHeader {
+	return BlockHeader{b.Timestamp, b.Hash, b.PrevHash, b.MerkleRoot, b.Nonce, b.Height}
+}
+
+// Builds the Merkle tree of the block's transaction IDs
+func (b *Block) MerkleTree() *MerkleTree {
+	var txHashes [][]byte
+
+	for _, tx := range b.Transactions {
+		txHashes = append(txHashes, tx.ID)
+	}
+	return NewMerkleTree(txHashes)
 }
 
 // Creates a Merkle root of all the block's transactions
 // Returns a byte slice containing the hash of all transactions
 func (b *Block) HashTransactions() []byte {
-	var txHashes [][]byte
+	return b.MerkleTree().RootNode.Data
+}
 
-	for _, tx := range b.Transactions {
-		txHashes = append(txHashes, tx.Serialize())
+// Builds the Merkle inclusion proof of a transaction of the block
+func (b *Block) TxProof(txID []byte) (MerkleProof, error) {
+	for i, tx := range b.Transactions {
+		if bytes.Equal(tx.ID, txID) {
+			return b.MerkleTree().Proof(i, tx.ID)
+		}
 	}
-	tree := NewMerkleTree(txHashes)
-	return tree.RootNode.Data
+
+	return MerkleProof{}, errors.New("Transaction is not in block")
 }
 
 // Creates a new block with the given transactions and previous block hash
-// It performs proof of work and returns the newly created block
-func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height}
-	pow := NewProofOfWork(block)
-	nonce, hash := pow.Run()
+// It performs proof of work at the given difficulty and returns the newly created block
+func CreateBlock(txs []*Transaction, prevHash []byte, height int, minTime int64, difficulty int) *Block {
+	block := NewBlockTemplate(txs, prevHash, height, minTime)
+	err := NewMiner().Mine(context.Background(), block, difficulty)
+	Handle(err)
 
-	block.Hash = hash[:]
-	block.Nonce = nonce
+	return block
+}
+
+// Builds a block that still has to be mined
+// The timestamp is raised to minTime when the clock is behind the median time past
+func NewBlockTemplate(txs []*Transaction, prevHash []byte, height int, minTime int64) *Block {
+	timestamp := time.Now().Unix()
+	if timestamp < minTime {
+		timestamp = minTime
+	}
+
+	block := &Block{timestamp, []byte{}, txs, prevHash, 0, height, nil}
+	block.MerkleRoot = block.HashTransactions()
 
 	return block
 }
 
-// Creates the first block of the blockchain with a given coinbase transaction
-func Genesis(coinbase *Transaction) *Block {
-	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0)
+// Creates the first block of a blockchain using params with a given coinbase transaction
+func Genesis(coinbase *Transaction, params Params) *Block {
+	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0, 0, params.Difficulty)
 }
 
 // Converts the block into a byte slice using gob encoding
@@ -80,3 +125,28 @@ func Handle(err error) {
 		log.Panic(err)
 	}
 }
+
+// Converts the header into a byte slice using gob encoding
+func (h *BlockHeader) Serialize() []byte {
+	var res bytes.Buffer
+	encoder := gob.NewEncoder(&res)
+
+	err := encoder.Encode(h)
+
+	Handle(err)
+
+	return res.Bytes()
+}
+
+// Converts a byte slice back into a BlockHeader structure
+func DeserializeHeader(data []byte) *BlockHeader {
+	var header BlockHeader
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+
+	err := decoder.Decode(&header)
+
+	Handle(err)
+
+	return &header
+}
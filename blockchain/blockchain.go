@@ -2,6 +2,7 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
@@ -11,6 +12,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/dgraph-io/badger"
 )
@@ -20,9 +22,57 @@ const (
 	genesisData = "First Transaction from Genesis"
 )
 
+// ErrTipChanged signale qu'un bloc miné ne prolonge plus le sommet de la chaîne
+var ErrTipChanged = errors.New("chain tip changed while mining")
+
+// ErrOrphanBlock signale un bloc dont le parent est inconnu : il faut d'abord synchroniser la chaîne
+var ErrOrphanBlock = errors.New("parent block not found")
+
+// ErrMissingOutput signale une entrée dont la sortie est inconnue ou déjà dépensée : la transaction
+// peut être valide sur une autre branche ou avoir été dépassée par un bloc
+var ErrMissingOutput = errors.New("missing or already spent")
+
 type BlockChain struct {
-	LastHash []byte
 	Database *badger.DB
+	Params   Params // Consensus parameters saved when the chain was created
+
+	lastHash   []byte       // Tip of the main chain, read with LastHash
+	base       []byte       // Oldest block body needed, set when the chain was pruned or loaded from a UTXO snapshot
+	tipMutex   sync.RWMutex // Guards lastHash and base, read by the network goroutines while blocks are connected
+	blockMutex sync.Mutex   // Connects one block at a time
+}
+
+// LastHash retourne le hash du sommet de la chaîne principale
+func (chain *BlockChain) LastHash() []byte {
+	chain.tipMutex.RLock()
+	defer chain.tipMutex.RUnlock()
+
+	return chain.lastHash
+}
+
+// setLastHash remplace le sommet de la chaîne principale, une fois le bloc enregistré
+func (chain *BlockChain) setLastHash(hash []byte) {
+	chain.tipMutex.Lock()
+	defer chain.tipMutex.Unlock()
+
+	chain.lastHash = hash
+}
+
+// Base retourne le hash du plus ancien bloc dont le corps est conservé, ou nil si la chaîne est
+// complète jusqu'au genesis
+func (chain *BlockChain) Base() []byte {
+	chain.tipMutex.RLock()
+	defer chain.tipMutex.RUnlock()
+
+	return chain.base
+}
+
+// setBase remplace la base de la chaîne, une fois la base enregistrée
+func (chain *BlockChain) setBase(hash []byte) {
+	chain.tipMutex.Lock()
+	defer chain.tipMutex.Unlock()
+
+	chain.base = hash
 }
 
 // FindUTXOs trouve les UTXOs pour une adresse donnée (méthode non implémentée)
@@ -57,7 +107,10 @@ func ContinueBlockChain(nodeId string) *BlockChain {
 
 	db, err := openDB(path, opts)
 	Handle(err)
+	params, err := loadParams(db)
+	Handle(err)
 
+	var base []byte
 	err = db.Update(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("lh"))
 		Handle(err)
@@ -65,25 +118,38 @@ func ContinueBlockChain(nodeId string) *BlockChain {
 			lastHash = append([]byte{}, val...)
 			return nil
 		})
+		if err != nil {
+			return err
+		}
 
+		base, err = loadBase(txn)
 		return err
 	})
 	Handle(err)
 
-	chain := BlockChain{lastHash, db}
+	chain := BlockChain{Database: db, Params: params, lastHash: lastHash, base: base}
 
 	return &chain
 }
 
-// CreateBlockChain crée une nouvelle blockchain avec un bloc genesis
+// CreateBlockChain crée une nouvelle blockchain avec un bloc genesis miné selon params
 // L'adresse fournie recevra la récompense du bloc genesis
-func CreateBlockChain(address, nodeId string) *BlockChain {
-	path := fmt.Sprintf(dbPath, nodeId)
-	if DBExists(path) {
+func CreateBlockChain(address, nodeId string, params Params) *BlockChain {
+	if DBExists(fmt.Sprintf(dbPath, nodeId)) {
 		fmt.Println("Blockchain already exists")
 		runtime.Goexit()
 	}
-	var lastHash []byte
+
+	cbtx := CoinbaseTx(address, genesisData, 0)
+	genesis := Genesis(cbtx, params)
+	fmt.Println("Genesis created")
+
+	return newBlockChain(nodeId, genesis, params)
+}
+
+// newBlockChain crée la base d'un nœud avec le bloc genesis donné et enregistre ses paramètres
+func newBlockChain(nodeId string, genesis *Block, params Params) *BlockChain {
+	path := fmt.Sprintf(dbPath, nodeId)
 	opts := badger.DefaultOptions(path)
 	opts.Dir = path
 	opts.ValueDir = path
@@ -92,36 +158,43 @@ func CreateBlockChain(address, nodeId string) *BlockChain {
 	Handle(err)
 
 	err = db.Update(func(txn *badger.Txn) error {
-		cbtx := CoinbaseTx(address, genesisData)
-		genesis := Genesis(cbtx)
-		fmt.Println("Genesis created")
-		err = txn.Set(genesis.Hash, genesis.Serialize())
+		err := txn.Set(genesis.Hash, genesis.Serialize())
+		Handle(err)
+		err = saveCFilter(txn, genesis)
+		Handle(err)
+		err = txn.Set(paramsKey, []byte(params.Name))
 		Handle(err)
-		err = txn.Set([]byte("lh"), genesis.Hash)
-
-		lastHash = genesis.Hash
-
-		return err
 
+		return txn.Set([]byte("lh"), genesis.Hash)
 	})
-
 	Handle(err)
 
-	blockchain := BlockChain{lastHash, db}
+	blockchain := BlockChain{Database: db, Params: params, lastHash: genesis.Hash}
 	return &blockchain
 }
 
-// AddBlock ajoute un nouveau bloc à la blockchain
-// Met à jour le dernier hash et sauvegarde le bloc dans la base de données
-func (chain *BlockChain) AddBlock(block *Block) {
-	err := chain.Database.Update(func(txn *badger.Txn) error {
-		if _, err := txn.Get(block.Hash); err == nil {
-			return nil
-		}
+// AddBlock valide puis ajoute un nouveau bloc à la blockchain
+// Un bloc qui prolonge le sommet met à jour le set UTXO dans la même transaction de la base ; un
+// bloc qui fait passer une autre branche en tête le fait reconstruire
+func (chain *BlockChain) AddBlock(block *Block) error {
+	chain.blockMutex.Lock()
+	defer chain.blockMutex.Unlock()
 
+	if _, err := chain.GetBlock(block.Hash); err == nil {
+		return nil
+	}
+
+	if err := chain.ValidateBlock(block); err != nil {
+		return fmt.Errorf("block %x rejected: %w", block.Hash, err)
+	}
+
+	newTip, reindex := false, false
+	err := chain.Database.Update(func(txn *badger.Txn) error {
 		blockData := block.Serialize()
 		err := txn.Set(block.Hash, blockData)
 		Handle(err)
+		err = saveCFilter(txn, block)
+		Handle(err)
 
 		item, err := txn.Get([]byte("lh"))
 		Handle(err)
@@ -142,15 +215,42 @@ func (chain *BlockChain) AddBlock(block *Block) {
 		})
 		Handle(err)
 
-		if block.Height > lastBlock.Height {
-			err = txn.Set([]byte("lh"), block.Hash)
-			Handle(err)
-			chain.LastHash = block.Hash
+		if block.Height <= lastBlock.Height {
+			return nil
 		}
+		err = txn.Set([]byte("lh"), block.Hash)
+		Handle(err)
+		newTip = true
 
-		return nil
+		reindex, err = connectUTXO(txn, block, lastHash)
+		return err
 	})
 	Handle(err)
+
+	// Le set UTXO est reconstruit avant que le nouveau sommet soit visible
+	if reindex {
+		UTXOSet{Blockchain: chain}.reindexAt(block.Hash)
+	}
+	if newTip {
+		chain.setLastHash(block.Hash)
+	}
+
+	return nil
+}
+
+// connectUTXO applique au set UTXO le nouveau sommet block dans la transaction Badger en cours,
+// quand le set correspond à son parent et que ce parent était le sommet lastHash
+// Retourne true si le set doit être reconstruit, après une réorganisation
+func connectUTXO(txn *badger.Txn, block *Block, lastHash []byte) (bool, error) {
+	utxoTip, err := readUTXOTip(txn)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(block.PrevHash, lastHash) || !bytes.Equal(utxoTip, lastHash) {
+		return true, nil
+	}
+
+	return false, updateUTXO(txn, block)
 }
 
 // GetBestHeight retourne la hauteur du dernier bloc de la blockchain
@@ -217,7 +317,7 @@ func (chain *BlockChain) GetBlockHashes() [][]byte {
 
 		blocks = append(blocks, block.Hash)
 
-		if len(block.PrevHash) == 0 {
+		if iter.Done() {
 			break
 		}
 	}
@@ -226,17 +326,12 @@ func (chain *BlockChain) GetBlockHashes() [][]byte {
 }
 
 // MineBlock mine un nouveau bloc avec les transactions données
-// Vérifie les transactions, crée le bloc et l'ajoute à la blockchain
-func (chain *BlockChain) MineBlock(transactions []*Transaction) *Block {
+// Vérifie les transactions contre le set UTXO du sommet, crée le bloc et l'ajoute à la blockchain
+// Le minage s'arrête si ctx est annulé ou si un autre bloc est devenu le sommet entre-temps
+func (chain *BlockChain) MineBlock(ctx context.Context, transactions []*Transaction) (*Block, error) {
 	var lastHash []byte
 	var lastHeight int
 
-	for _, tx := range transactions {
-		if chain.VerifyTransaction(tx) != true {
-			log.Panic("Invalid Transaction")
-		}
-	}
-
 	err := chain.Database.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("lh"))
 		Handle(err)
@@ -261,37 +356,88 @@ func (chain *BlockChain) MineBlock(transactions []*Transaction) *Block {
 	})
 	Handle(err)
 
-	newBlock := CreateBlock(transactions, lastHash, lastHeight+1)
+	view, err := chain.utxoViewAt(lastHash)
+	if err != nil {
+		return nil, err
+	}
+	for _, tx := range transactions {
+		if tx.IsCoinbase() {
+			view.add(tx, lastHeight+1)
+			continue
+		}
+		if _, err := chain.connectTransaction(view, tx, lastHeight+1, lastHash); err != nil {
+			return nil, err
+		}
+	}
+
+	newBlock := NewBlockTemplate(transactions, lastHash, lastHeight+1, chain.MedianTimePast(lastHash)+1)
+	if err := NewMiner().Mine(ctx, newBlock, chain.Params.Difficulty); err != nil {
+		return nil, err
+	}
+
+	chain.blockMutex.Lock()
+	defer chain.blockMutex.Unlock()
 
+	reindex := false
 	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
+		item, err := txn.Get([]byte("lh"))
 		Handle(err)
-		err = txn.Set([]byte("lh"), newBlock.Hash)
+		tipHash, err := item.ValueCopy(nil)
+		Handle(err)
+		if !bytes.Equal(tipHash, lastHash) {
+			return ErrTipChanged
+		}
 
-		chain.LastHash = newBlock.Hash
+		err = txn.Set(newBlock.Hash, newBlock.Serialize())
+		Handle(err)
+		err = saveCFilter(txn, newBlock)
+		Handle(err)
+		err = txn.Set([]byte("lh"), newBlock.Hash)
+		Handle(err)
 
+		reindex, err = connectUTXO(txn, newBlock, lastHash)
 		return err
 	})
+	if err == ErrTipChanged {
+		return nil, err
+	}
 	Handle(err)
 
-	return newBlock
+	if reindex {
+		UTXOSet{Blockchain: chain}.reindexAt(newBlock.Hash)
+	}
+	chain.setLastHash(newBlock.Hash)
+
+	return newBlock, nil
 }
 
 // FindUTXO trouve tous les outputs non dépensés dans la blockchain
 // Retourne une map avec les transaction IDs et leurs outputs disponibles
 func (chain *BlockChain) FindUTXO() map[string]TXOutputs {
+	return chain.findUTXOAt(chain.LastHash())
+}
+
+// findUTXOAt calcule le set UTXO tel qu'il était après le bloc hash de la chaîne principale
+func (chain *BlockChain) findUTXOAt(hash []byte) map[string]TXOutputs {
 	UTXO := make(map[string]TXOutputs)
 	spentTXOs := make(map[string][]int)
 
-	iter := chain.Iterator()
+	iter := &BlockChainIterator{hash, chain.Database, chain.Base()}
 	for {
 		block := iter.Next()
+		// Le set UTXO de la base tient déjà compte de ce bloc
+		if bytes.Equal(block.Hash, chain.Base()) {
+			break
+		}
 
 		for _, tx := range block.Transactions {
 			txID := hex.EncodeToString(tx.ID)
 
 		Outputs:
 			for outIdx, out := range tx.Outputs {
+				if out.IsUnspendable() {
+					continue
+				}
 				if spentTXOs[txID] != nil {
 					for _, spentOut := range spentTXOs[txID] {
 						if spentOut == outIdx {
@@ -299,8 +445,11 @@ func (chain *BlockChain) FindUTXO() map[string]TXOutputs {
 						}
 					}
 				}
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, &out)
+				outs, ok := UTXO[txID]
+				if !ok {
+					outs = TXOutputs{make(map[int]TXOutput), block.Height, tx.IsCoinbase()}
+				}
+				outs.Outputs[outIdx] = out
 				UTXO[txID] = outs
 			}
 			if !tx.IsCoinbase() {
@@ -311,15 +460,95 @@ func (chain *BlockChain) FindUTXO() map[string]TXOutputs {
 			}
 		}
 
-		if len(block.PrevHash) == 0 {
+		if iter.Done() {
 			break
 		}
 	}
+
+	if len(chain.Base()) > 0 {
+		chain.addBaseUTXO(UTXO, spentTXOs)
+	}
 	return UTXO
 }
 
+// addBaseUTXO ajoute à UTXO les sorties du set UTXO de la base que spentTXOs ne dépense pas
+func (chain *BlockChain) addBaseUTXO(UTXO map[string]TXOutputs, spentTXOs map[string][]int) {
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(baseUTXOPrefix); it.ValidForPrefix(baseUTXOPrefix); it.Next() {
+			item := it.Item()
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			txID := hex.EncodeToString(bytes.TrimPrefix(item.KeyCopy(nil), baseUTXOPrefix))
+			outs := DeserializeOutputs(v)
+			for _, spentOut := range spentTXOs[txID] {
+				delete(outs.Outputs, spentOut)
+			}
+			if len(outs.Outputs) > 0 {
+				UTXO[txID] = outs
+			}
+		}
+		return nil
+	})
+	Handle(err)
+}
+
+// GetHeader récupère l'en-tête d'un bloc, y compris sous la base d'une chaîne élaguée ou chargée
+// depuis un snapshot UTXO, où seuls les en-têtes sont stockés
+func (chain *BlockChain) GetHeader(hash []byte) (BlockHeader, error) {
+	if block, err := chain.GetBlock(hash); err == nil {
+		return block.Header(), nil
+	}
+
+	var header BlockHeader
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(headerPrefix, hash...))
+		if err != nil {
+			return errors.New("Header is not found")
+		}
+		return item.Value(func(val []byte) error {
+			header = *DeserializeHeader(val)
+			return nil
+		})
+	})
+
+	return header, err
+}
+
+// headerAtHeight retourne l'en-tête de la chaîne principale à la hauteur donnée
+func (chain *BlockChain) headerAtHeight(height int) (BlockHeader, error) {
+	return chain.ancestorAtHeight(chain.LastHash(), height)
+}
+
+// ancestorAtHeight retourne l'en-tête à la hauteur donnée de la branche qui mène au bloc hash
+func (chain *BlockChain) ancestorAtHeight(hash []byte, height int) (BlockHeader, error) {
+	for len(hash) > 0 {
+		header, err := chain.GetHeader(hash)
+		if err != nil {
+			return header, err
+		}
+		if header.Height == height {
+			return header, nil
+		}
+		hash = header.PrevHash
+	}
+
+	return BlockHeader{}, fmt.Errorf("no block at height %d", height)
+}
+
 // FindTransaction trouve une transaction par son ID dans toute la blockchain
 func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
+	tx, _, err := bc.findTransactionBlock(ID)
+
+	return tx, err
+}
+
+// findTransactionBlock trouve une transaction et le bloc qui la contient
+func (bc *BlockChain) findTransactionBlock(ID []byte) (Transaction, *Block, error) {
 	iter := bc.Iterator()
 
 	for {
@@ -327,16 +556,49 @@ func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
 
 		for _, tx := range block.Transactions {
 			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
+				return *tx, block, nil
 			}
 		}
 
-		if len(block.PrevHash) == 0 {
+		if iter.Done() {
 			break
 		}
 	}
 
-	return Transaction{}, errors.New("Transaction does not exist")
+	return Transaction{}, nil, errors.New("Transaction does not exist")
+}
+
+// findSpentTransaction retourne la transaction dont in dépense une sortie, avec la hauteur de
+// son bloc et son type dans un TXOutputs
+// Sous la base d'une chaîne élaguée ou chargée depuis un snapshot, les blocs manquent : la transaction est
+// reconstituée à partir de ses sorties non dépensées du set UTXO
+func (chain *BlockChain) findSpentTransaction(in TXInput) (Transaction, TXOutputs, error) {
+	tx, block, err := chain.findTransactionBlock(in.ID)
+	if err == nil {
+		return tx, TXOutputs{Height: block.Height, Coinbase: tx.IsCoinbase()}, nil
+	}
+	if len(chain.Base()) == 0 {
+		return tx, TXOutputs{}, err
+	}
+
+	outs, err := UTXOSet{Blockchain: chain}.GetOutputs(in.ID)
+	if err != nil {
+		return tx, outs, errors.New("Transaction does not exist")
+	}
+	if _, ok := outs.Outputs[in.Out]; !ok {
+		return tx, outs, fmt.Errorf("output %d of %x is spent", in.Out, in.ID)
+	}
+
+	size := 0
+	for idx := range outs.Outputs {
+		size = max(size, idx+1)
+	}
+	tx = Transaction{ID: in.ID, Outputs: make([]TXOutput, size)}
+	for idx, out := range outs.Outputs {
+		tx.Outputs[idx] = out
+	}
+
+	return tx, outs, nil
 }
 
 // SignTransaction signe une transaction avec la clé privée donnée
@@ -344,7 +606,7 @@ func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey)
 	prevTXs := make(map[string]Transaction)
 
 	for _, in := range tx.Inputs {
-		prevTX, err := bc.FindTransaction(in.ID)
+		prevTX, _, err := bc.findSpentTransaction(in)
 		Handle(err)
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
@@ -362,7 +624,7 @@ func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
 	prevTXs := make(map[string]Transaction)
 
 	for _, in := range tx.Inputs {
-		prevTX, err := bc.FindTransaction(in.ID)
+		prevTX, _, err := bc.findSpentTransaction(in)
 		Handle(err)
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
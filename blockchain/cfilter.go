@@ -0,0 +1,151 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+// MaxCFiltersPerMessage limite le nombre de filtres envoyés en une réponse
+const MaxCFiltersPerMessage = 1000
+
+var cfilterPrefix = []byte("cf-") // Prefix for compact block filters in the database
+
+// CFilter associe un filtre compact sérialisé au bloc qu'il décrit
+type CFilter struct {
+	BlockHash []byte
+	Filter    []byte
+}
+
+// OutpointFilterItem encode une sortie dépensée comme élément de filtre : txid suivi de l'index
+func OutpointFilterItem(txID []byte, outIdx int) []byte {
+	item := make([]byte, len(txID)+4)
+	copy(item, txID)
+	binary.BigEndian.PutUint32(item[len(txID):], uint32(outIdx))
+
+	return item
+}
+
+// BlockFilterItems retourne les éléments du filtre d'un bloc : les hashes de clé publique
+// de ses sorties et les sorties que ses transactions dépensent
+func BlockFilterItems(block *Block) [][]byte {
+	var items [][]byte
+
+	for _, tx := range block.Transactions {
+		for _, out := range tx.Outputs {
+			if pubKeyHash := out.PubKeyHash(); pubKeyHash != nil {
+				items = append(items, pubKeyHash)
+			}
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			items = append(items, OutpointFilterItem(in.ID, in.Out))
+		}
+	}
+
+	return items
+}
+
+// blockFilterKey dérive la clé de hachage du filtre à partir du hash du bloc
+func blockFilterKey(blockHash []byte) []byte {
+	return blockHash[:16]
+}
+
+// NewBlockFilter construit le filtre compact d'un bloc
+func NewBlockFilter(block *Block) *GCSFilter {
+	return NewGCSFilter(blockFilterKey(block.Hash), BlockFilterItems(block))
+}
+
+// DeserializeBlockFilter décode le filtre compact du bloc blockHash
+func DeserializeBlockFilter(blockHash, data []byte) (*GCSFilter, error) {
+	if len(blockHash) < 16 {
+		return nil, errors.New("block hash is too short")
+	}
+
+	return DeserializeGCSFilter(blockFilterKey(blockHash), data)
+}
+
+// saveCFilter enregistre le filtre d'un bloc dans la transaction Badger en cours
+func saveCFilter(txn *badger.Txn, block *Block) error {
+	return txn.Set(append(cfilterPrefix, block.Hash...), NewBlockFilter(block).Serialize())
+}
+
+// ErrNoCFilter signale le filtre d'un bloc dont le nœud n'a pas le corps
+var ErrNoCFilter = errors.New("compact filter not available")
+
+// GetCFilter retourne le filtre sérialisé d'un bloc
+// Le filtre des blocs ajoutés avant l'indexation des filtres est construit à la demande
+func (chain *BlockChain) GetCFilter(blockHash []byte) ([]byte, error) {
+	var filter []byte
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(cfilterPrefix, blockHash...))
+		if err != nil {
+			return err
+		}
+		filter, err = item.ValueCopy(nil)
+		return err
+	})
+	if err == nil {
+		return filter, nil
+	}
+
+	block, err := chain.GetBlock(blockHash)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %x", ErrNoCFilter, blockHash)
+	}
+
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		return saveCFilter(txn, &block)
+	})
+	Handle(err)
+
+	return NewBlockFilter(&block).Serialize(), nil
+}
+
+// GetCFiltersAfter retourne, du plus ancien au plus récent, les filtres des blocs
+// de la chaîne principale qui suivent le bloc fromHash
+// Retourne ErrNoCFilter si l'un de ces blocs est sous la base d'une chaîne chargée depuis un
+// snapshot, qui n'a ni son corps ni son filtre
+func (chain *BlockChain) GetCFiltersAfter(fromHash []byte) ([]CFilter, error) {
+	var filters []CFilter
+
+	for _, header := range chain.GetHeadersAfter(fromHash) {
+		if len(filters) == MaxCFiltersPerMessage {
+			break
+		}
+
+		filter, err := chain.GetCFilter(header.Hash)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, CFilter{header.Hash, filter})
+	}
+
+	return filters, nil
+}
+
+// HasCFilterHistory indique si la chaîne peut servir les filtres de tous ses blocs depuis le genesis
+// Une chaîne élaguée garde les filtres des blocs passés sous sa base, une chaîne chargée depuis un
+// snapshot n'en a aucun sous sa base
+func (chain *BlockChain) HasCFilterHistory() bool {
+	if len(chain.Base()) == 0 {
+		return true
+	}
+	genesis, err := chain.headerAtHeight(0)
+	if err != nil {
+		return false
+	}
+
+	err = chain.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(append(cfilterPrefix, genesis.Hash...))
+		return err
+	})
+
+	return err == nil
+}
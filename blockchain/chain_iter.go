@@ -1,16 +1,21 @@
 package blockchain
 
-import "github.com/dgraph-io/badger"
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger"
+)
 
 // BlockChainIterator permet de parcourir la blockchain depuis le dernier bloc vers le premier
 type BlockChainIterator struct {
 	CurrentHash []byte
 	Database    *badger.DB
+	Base        []byte // Last block of the walk when the chain was pruned or loaded from a UTXO snapshot
 }
 
 // Iterator crée un nouvel itérateur pour parcourir la blockchain
 func (chain *BlockChain) Iterator() *BlockChainIterator {
-	iter := &BlockChainIterator{chain.LastHash, chain.Database}
+	iter := &BlockChainIterator{chain.LastHash(), chain.Database, chain.Base()}
 
 	return iter
 }
@@ -30,6 +35,15 @@ func (iter *BlockChainIterator) Next() *Block {
 	Handle(err)
 
 	iter.CurrentHash = block.PrevHash
+	if bytes.Equal(block.Hash, iter.Base) {
+		iter.CurrentHash = nil
+	}
 
 	return block
 }
+
+// Done indique que le dernier bloc retourné est le premier bloc stocké : le genesis, ou la base
+// d'une chaîne élaguée ou chargée depuis un snapshot UTXO
+func (iter *BlockChainIterator) Done() bool {
+	return len(iter.CurrentHash) == 0
+}
@@ -0,0 +1,348 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Un fichier d'export contient, dans l'ordre, l'en-tête (magic, version, paramètres, nombre de
+// blocs et hash du genesis), chaque bloc du genesis au sommet précédé de sa taille sur 4 octets,
+// puis le SHA-256 de tout ce qui précède
+const (
+	chainFileMagic   = "BCGOCHN1"
+	chainFileVersion = 1
+	maxChainFileItem = 32 << 20 // Largest block accepted in a chain file
+)
+
+// ChainFileHeader décrit le contenu d'un fichier d'export de la chaîne
+type ChainFileHeader struct {
+	Version int
+	Params  string // Name of the chain parameters
+	Blocks  int    // Number of blocks, genesis included
+	Genesis []byte // Hash of the genesis block
+}
+
+// ExportChain écrit les blocs de la chaîne principale, du genesis au sommet, dans w
+// progress est appelée après chaque bloc écrit avec sa hauteur
+func (chain *BlockChain) ExportChain(w io.Writer, progress func(height int)) error {
+	if len(chain.Base()) > 0 {
+		return errors.New("chain was pruned or loaded from a UTXO snapshot and lacks its oldest blocks")
+	}
+
+	hashes := chain.GetBlockHashes()
+	tip, err := chain.GetBlock(hashes[0])
+	if err != nil {
+		return err
+	}
+
+	checksum := sha256.New()
+	out := bufio.NewWriter(io.MultiWriter(w, checksum))
+
+	header := ChainFileHeader{chainFileVersion, chain.Params.Name, tip.Height + 1, hashes[len(hashes)-1]}
+	if err := writeChainFileHeader(out, header); err != nil {
+		return err
+	}
+
+	for i := len(hashes) - 1; i >= 0; i-- {
+		block, err := chain.GetBlock(hashes[i])
+		if err != nil {
+			return err
+		}
+		if err := writeChainFileItem(out, block.Serialize()); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(block.Height)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	_, err = w.Write(checksum.Sum(nil))
+	return err
+}
+
+// writeChainFileHeader écrit l'en-tête d'un fichier d'export
+func writeChainFileHeader(w io.Writer, header ChainFileHeader) error {
+	if _, err := io.WriteString(w, chainFileMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(header.Version)); err != nil {
+		return err
+	}
+	if err := writeChainFileItem(w, []byte(header.Params)); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint64(header.Blocks)); err != nil {
+		return err
+	}
+
+	return writeChainFileItem(w, header.Genesis)
+}
+
+// writeChainFileItem écrit data précédé de sa taille
+func writeChainFileItem(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+
+	return err
+}
+
+// ChainFile lit les blocs d'un fichier d'export
+type ChainFile struct {
+	Header ChainFileHeader
+
+	file   *os.File
+	reader *bufio.Reader
+	read   int // Blocks read so far
+}
+
+// OpenChainFile ouvre un fichier d'export après avoir vérifié son checksum et lu son en-tête
+func OpenChainFile(path string) (*ChainFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyChainFileChecksum(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	cf := &ChainFile{file: file, reader: bufio.NewReader(file)}
+	if err := cf.readHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return cf, nil
+}
+
+// verifyChainFileChecksum compare le SHA-256 du contenu aux 32 derniers octets du fichier
+func verifyChainFileChecksum(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size() - sha256.Size
+	if size < int64(len(chainFileMagic)) {
+		return errors.New("chain file is too short")
+	}
+
+	checksum := sha256.New()
+	if _, err := io.CopyN(checksum, file, size); err != nil {
+		return err
+	}
+	expected := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(file, expected); err != nil {
+		return err
+	}
+	if !bytes.Equal(checksum.Sum(nil), expected) {
+		return errors.New("chain file checksum mismatch, the file is corrupted or truncated")
+	}
+
+	return nil
+}
+
+// readHeader lit l'en-tête du fichier
+func (cf *ChainFile) readHeader() error {
+	magic := make([]byte, len(chainFileMagic))
+	if _, err := io.ReadFull(cf.reader, magic); err != nil {
+		return err
+	}
+	if string(magic) != chainFileMagic {
+		return errors.New("not a chain file")
+	}
+
+	var version uint32
+	if err := binary.Read(cf.reader, binary.BigEndian, &version); err != nil {
+		return err
+	}
+	if version != chainFileVersion {
+		return fmt.Errorf("unsupported chain file version %d", version)
+	}
+	params, err := readChainFileItem(cf.reader)
+	if err != nil {
+		return err
+	}
+	var blocks uint64
+	if err := binary.Read(cf.reader, binary.BigEndian, &blocks); err != nil {
+		return err
+	}
+	genesis, err := readChainFileItem(cf.reader)
+	if err != nil {
+		return err
+	}
+
+	cf.Header = ChainFileHeader{int(version), string(params), int(blocks), genesis}
+	return nil
+}
+
+// readChainFileItem lit une donnée précédée de sa taille
+func readChainFileItem(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > maxChainFileItem {
+		return nil, fmt.Errorf("chain file item of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Next retourne le bloc suivant du fichier, ou io.EOF après le dernier
+func (cf *ChainFile) Next() (*Block, error) {
+	if cf.read == cf.Header.Blocks {
+		return nil, io.EOF
+	}
+
+	data, err := readChainFileItem(cf.reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := deserializeChecked(data)
+	if err != nil {
+		return nil, fmt.Errorf("block %d of the chain file: %w", cf.read, err)
+	}
+	cf.read++
+
+	return block, nil
+}
+
+// Close ferme le fichier
+func (cf *ChainFile) Close() error {
+	return cf.file.Close()
+}
+
+// deserializeChecked décode un bloc en retournant une erreur plutôt qu'en paniquant
+func deserializeChecked(data []byte) (block *Block, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot decode block: %v", r)
+		}
+	}()
+
+	return Deserialize(data), nil
+}
+
+// ImportChain ajoute à la chaîne du nœud nodeId les blocs d'un fichier d'export, en validant
+// chacun et en mettant à jour le set UTXO au fur et à mesure
+// La chaîne est créée à partir du genesis du fichier si elle n'existe pas. Les blocs déjà présents
+// sont sautés : un import interrompu reprend là où il s'était arrêté. L'import s'arrête après le
+// bloc en cours quand ctx est annulé
+// progress est appelée après chaque bloc avec sa hauteur et le nombre de blocs du fichier
+func ImportChain(ctx context.Context, nodeId string, cf *ChainFile, progress func(height, total int)) (*BlockChain, error) {
+	params, err := ParamsByName(cf.Header.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	genesis, err := cf.Next()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(genesis.Hash, cf.Header.Genesis) {
+		return nil, errors.New("first block of the chain file is not its genesis")
+	}
+
+	var chain *BlockChain
+	if DBExists(fmt.Sprintf(dbPath, nodeId)) {
+		chain = ContinueBlockChain(nodeId)
+		if len(chain.Base()) > 0 {
+			return chain, errors.New("local chain was pruned or loaded from a UTXO snapshot, import into a new node")
+		}
+		if chain.Params.Name != params.Name {
+			return chain, fmt.Errorf("local chain uses the %s parameters, the file the %s ones", chain.Params.Name, params.Name)
+		}
+		if _, err := chain.GetBlock(genesis.Hash); err != nil {
+			return chain, errors.New("local chain has another genesis block")
+		}
+		// Une chaîne écrite par une version précédente a pu enregistrer des blocs sans mettre à
+		// jour le set UTXO : il reprend au bloc auquel il correspond
+		applied, err := UTXOSet{Blockchain: chain}.CatchUp()
+		if err != nil {
+			return chain, err
+		}
+		switch {
+		case applied < 0:
+			fmt.Printf("Resuming import above height %d, the UTXO set was rebuilt\n", chain.GetBestHeight())
+		case applied > 0:
+			fmt.Printf("Resuming import above height %d, %d blocks applied to the UTXO set\n", chain.GetBestHeight(), applied)
+		default:
+			fmt.Printf("Resuming import above height %d\n", chain.GetBestHeight())
+		}
+	} else {
+		if err := validateGenesis(genesis, params); err != nil {
+			return nil, err
+		}
+		chain = newBlockChain(nodeId, genesis, params)
+		UTXOSet{Blockchain: chain}.Reindex()
+	}
+	if progress != nil {
+		progress(0, cf.Header.Blocks)
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return chain, err
+		}
+
+		block, err := cf.Next()
+		if err == io.EOF {
+			return chain, nil
+		}
+		if err != nil {
+			return chain, err
+		}
+
+		if _, err := chain.GetBlock(block.Hash); err == nil {
+			continue
+		}
+		if !bytes.Equal(block.PrevHash, chain.LastHash()) {
+			return chain, fmt.Errorf("block %x at height %d does not extend the local chain", block.Hash, block.Height)
+		}
+		if err := chain.AddBlock(block); err != nil {
+			return chain, err
+		}
+
+		if progress != nil {
+			progress(block.Height, cf.Header.Blocks)
+		}
+	}
+}
+
+// validateGenesis vérifie la preuve de travail et la forme du bloc genesis d'un fichier
+func validateGenesis(genesis *Block, params Params) error {
+	if len(genesis.PrevHash) != 0 || genesis.Height != 0 {
+		return errors.New("chain file does not start with a genesis block")
+	}
+	if !NewProofOfWork(genesis, params.Difficulty).Validate() {
+		return errors.New("invalid proof of work in the genesis block")
+	}
+	if !bytes.Equal(genesis.MerkleRoot, genesis.HashTransactions()) {
+		return errors.New("merkle root of the genesis block does not match its transactions")
+	}
+	if len(genesis.Transactions) != 1 || !genesis.Transactions[0].IsCoinbase() {
+		return errors.New("genesis block must only hold its coinbase")
+	}
+
+	return nil
+}
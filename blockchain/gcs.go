@@ -0,0 +1,189 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+const (
+	GCSParamP = 19     // Bits du reste dans le codage de Golomb-Rice
+	GCSParamM = 784931 // Inverse du taux de faux positifs (1/M)
+)
+
+// GCSFilter est un ensemble codé de Golomb (Golomb-coded set) : la liste triée des hashes
+// des éléments, compressée en codant leurs écarts successifs en Golomb-Rice
+// Un filtre ne donne jamais de faux négatif, et un faux positif avec une probabilité 1/M
+type GCSFilter struct {
+	N    uint32 // Nombre d'éléments distincts
+	Key  []byte // Clé de hachage des éléments
+	Data []byte // Écarts codés en Golomb-Rice
+}
+
+// NewGCSFilter construit le filtre d'un ensemble d'éléments avec la clé donnée
+func NewGCSFilter(key []byte, items [][]byte) *GCSFilter {
+	unique := make(map[string]bool)
+	for _, item := range items {
+		unique[string(item)] = true
+	}
+
+	filter := &GCSFilter{N: uint32(len(unique)), Key: key}
+
+	var values []uint64
+	for item := range unique {
+		values = append(values, filter.hashItem([]byte(item)))
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	var w bitWriter
+	var last uint64
+	for _, v := range values {
+		w.writeGolombRice(v - last)
+		last = v
+	}
+	filter.Data = w.data
+
+	return filter
+}
+
+// hashItem projette le hash d'un élément uniformément dans [0, N*M)
+func (f *GCSFilter) hashItem(item []byte) uint64 {
+	hash := sha256.Sum256(append(append([]byte{}, f.Key...), item...))
+	value := binary.BigEndian.Uint64(hash[:8])
+
+	hi, _ := bits.Mul64(value, uint64(f.N)*GCSParamM)
+	return hi
+}
+
+// Match teste si un élément appartient (probablement) au filtre
+func (f *GCSFilter) Match(item []byte) bool {
+	return f.MatchAny([][]byte{item})
+}
+
+// MatchAny teste si au moins un des éléments appartient (probablement) au filtre
+// Les éléments sont hachés et triés, puis comparés au filtre en un seul parcours
+func (f *GCSFilter) MatchAny(items [][]byte) bool {
+	if f.N == 0 || len(items) == 0 {
+		return false
+	}
+
+	var targets []uint64
+	for _, item := range items {
+		targets = append(targets, f.hashItem(item))
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i] < targets[j] })
+
+	r := bitReader{data: f.Data}
+	var value uint64
+	t := 0
+	for i := uint32(0); i < f.N; i++ {
+		delta, err := r.readGolombRice()
+		if err != nil {
+			return false
+		}
+		value += delta
+
+		for t < len(targets) && targets[t] < value {
+			t++
+		}
+		if t == len(targets) {
+			return false
+		}
+		if targets[t] == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Serialize encode le filtre : nombre d'éléments sur 4 octets suivi des écarts codés
+// La clé n'est pas incluse, elle se déduit du bloc filtré
+func (f *GCSFilter) Serialize() []byte {
+	data := make([]byte, 4, 4+len(f.Data))
+	binary.BigEndian.PutUint32(data, f.N)
+
+	return append(data, f.Data...)
+}
+
+// DeserializeGCSFilter décode un filtre sérialisé avec la clé donnée
+func DeserializeGCSFilter(key, data []byte) (*GCSFilter, error) {
+	if len(data) < 4 {
+		return nil, errors.New("filter is too short")
+	}
+
+	return &GCSFilter{binary.BigEndian.Uint32(data[:4]), key, data[4:]}, nil
+}
+
+// bitWriter écrit une suite de bits, du bit de poids fort au bit de poids faible de chaque octet
+type bitWriter struct {
+	data  []byte
+	nbits uint
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.nbits%8 == 0 {
+		w.data = append(w.data, 0)
+	}
+	if bit {
+		w.data[len(w.data)-1] |= 0x80 >> (w.nbits % 8)
+	}
+	w.nbits++
+}
+
+// writeGolombRice code le quotient v >> P en unaire puis les P bits de poids faible
+func (w *bitWriter) writeGolombRice(v uint64) {
+	for q := v >> GCSParamP; q > 0; q-- {
+		w.writeBit(true)
+	}
+	w.writeBit(false)
+
+	for i := GCSParamP - 1; i >= 0; i-- {
+		w.writeBit(v>>uint(i)&1 == 1)
+	}
+}
+
+// bitReader relit les bits écrits par un bitWriter
+type bitReader struct {
+	data []byte
+	pos  uint
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos/8 >= uint(len(r.data)) {
+		return false, errors.New("unexpected end of filter")
+	}
+	bit := r.data[r.pos/8]&(0x80>>(r.pos%8)) != 0
+	r.pos++
+
+	return bit, nil
+}
+
+func (r *bitReader) readGolombRice() (uint64, error) {
+	var q uint64
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		q++
+	}
+
+	v := q << GCSParamP
+	for i := GCSParamP - 1; i >= 0; i-- {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit {
+			v |= 1 << uint(i)
+		}
+	}
+
+	return v, nil
+}
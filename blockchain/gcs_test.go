@@ -0,0 +1,96 @@
+package blockchain
+
+import (
+	"fmt"
+	"testing"
+)
+
+// gcsItems crée count éléments distincts préfixés par prefix
+func gcsItems(prefix string, count int) [][]byte {
+	var items [][]byte
+	for i := 0; i < count; i++ {
+		items = append(items, []byte(fmt.Sprintf("%s-%d", prefix, i)))
+	}
+	return items
+}
+
+// TestGCSFilter vérifie qu'un filtre reconnaît tous ses éléments, y compris après sérialisation,
+// et ne reconnaît presque aucun autre élément
+func TestGCSFilter(t *testing.T) {
+	const probes = 20000
+	key := []byte("block hash")
+
+	tests := []struct {
+		name  string
+		items [][]byte
+	}{
+		{"one item", gcsItems("in", 1)},
+		{"some items", gcsItems("in", 20)},
+		{"many items", gcsItems("in", 1000)},
+		{"duplicate items", append(gcsItems("in", 10), gcsItems("in", 10)...)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := NewGCSFilter(key, test.items)
+			decoded, err := DeserializeGCSFilter(key, filter.Serialize())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, f := range []*GCSFilter{filter, decoded} {
+				for _, item := range test.items {
+					if !f.Match(item) {
+						t.Fatalf("filter does not match its item %s", item)
+					}
+				}
+				if !f.MatchAny(append(gcsItems("out", 5), test.items[len(test.items)-1])) {
+					t.Fatal("filter does not match a set holding one of its items")
+				}
+			}
+
+			// Le taux de faux positifs attendu est 1/M : quelques-uns au plus sur probes essais
+			falsePositives := 0
+			for _, item := range gcsItems("out", probes) {
+				if decoded.Match(item) {
+					falsePositives++
+				}
+			}
+			if falsePositives > 3 {
+				t.Fatalf("%d false positives out of %d, expected about %.2f", falsePositives, probes, float64(probes)/GCSParamM)
+			}
+			if decoded.MatchAny(gcsItems("out", probes)) != (falsePositives > 0) {
+				t.Fatal("MatchAny and Match disagree")
+			}
+		})
+	}
+}
+
+// TestGCSFilterEdges vérifie les filtres vides, trop courts et lus avec une autre clé
+func TestGCSFilterEdges(t *testing.T) {
+	items := gcsItems("in", 50)
+	filter := NewGCSFilter([]byte("key"), items)
+
+	empty := NewGCSFilter([]byte("key"), nil)
+	if empty.N != 0 || empty.MatchAny(items) {
+		t.Fatal("empty filter matches")
+	}
+	if filter.MatchAny(nil) {
+		t.Fatal("filter matches an empty set")
+	}
+
+	if _, err := DeserializeGCSFilter([]byte("key"), []byte{0, 0}); err == nil {
+		t.Fatal("filter shorter than its size decoded")
+	}
+	data := filter.Serialize()
+
+	// Les valeurs dépendent de la clé : lu avec la clé d'un autre bloc, le filtre ne reconnaît plus
+	// ses éléments
+	other, err := DeserializeGCSFilter([]byte("other key"), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.MatchAny(items) {
+		t.Fatal("filter read with another key matches its items")
+	}
+}
@@ -0,0 +1,68 @@
+package blockchain
+
+import (
+	"blockchain-go/wallet"
+	"context"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// testChain est une chaîne regtest créée dans le répertoire temporaire du test, avec le wallet qui
+// reçoit la récompense du bloc genesis
+type testChain struct {
+	*BlockChain
+	t      *testing.T
+	wallet *wallet.Wallet
+}
+
+// newTestChain crée la chaîne regtest du nœud nodeId. Les chemins des données sont relatifs
+// (./tmp/...), le test travaille donc dans son propre répertoire
+// La base est fermée à la fin du test
+func newTestChain(t *testing.T, nodeId string) *testChain {
+	t.Helper()
+
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir("tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := wallet.MakeWallet()
+	chain := &testChain{CreateBlockChain(string(w.Address()), nodeId, RegtestParams), t, w}
+	UTXOSet{Blockchain: chain.BlockChain}.Reindex()
+	t.Cleanup(func() { chain.Database.Close() })
+
+	return chain
+}
+
+// mine mine count blocs qui récompensent le wallet de la chaîne, le premier avec les transactions
+// données
+func (c *testChain) mine(count int, txs ...*Transaction) {
+	c.t.Helper()
+
+	for i := 0; i < count; i++ {
+		block := append(txs, CoinbaseTx(string(c.wallet.Address()), "", 0))
+		if _, err := c.MineBlock(context.Background(), block); err != nil {
+			c.t.Fatal(err)
+		}
+		txs = nil
+	}
+}
+
+// send crée une transaction du wallet de la chaîne vers une nouvelle adresse
+func (c *testChain) send(amount int) *Transaction {
+	to := wallet.MakeWallet()
+	return NewTransaction(c.wallet, string(to.Address()), amount, 1, 0, &UTXOSet{Blockchain: c.BlockChain})
+}
+
+// checkUTXO vérifie que le set UTXO stocké et celui recalculé depuis les blocs valent want
+func (c *testChain) checkUTXO(want map[string]TXOutputs) {
+	c.t.Helper()
+
+	if got := c.FindUTXO(); !reflect.DeepEqual(got, want) {
+		c.t.Fatalf("UTXO set computed from the blocks has %d transactions, want %d", len(got), len(want))
+	}
+	if got, want := (UTXOSet{Blockchain: c.BlockChain}).CountTransactions(), len(want); got != want {
+		c.t.Fatalf("stored UTXO set has %d transactions, want %d", got, want)
+	}
+}
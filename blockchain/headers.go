@@ -0,0 +1,483 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/dgraph-io/badger"
+)
+
+const headersPath = "./tmp/headers_%s"
+
+var (
+	headerPrefix = []byte("hdr-")   // Prefix for block headers in the database
+	spvTxPrefix  = []byte("spvtx-") // Prefix for the light wallet's proven transactions
+	headerTipKey = []byte("hlh")    // Key of the best header hash
+	genesisKey   = []byte("hgen")   // Key of the genesis hash the light node accepts
+	filterTipKey = []byte("hcf")    // Key of the highest header whose filter is stored
+)
+
+// HeaderChain est la chaîne d'en-têtes d'un nœud léger (SPV)
+// Elle ne stocke ni les transactions des blocs ni le set UTXO
+type HeaderChain struct {
+	Database *badger.DB
+	Params   Params // Parameters the headers are validated with
+	Genesis  []byte // Only genesis header accepted, set with PinGenesis
+
+	tipHash  []byte
+	tipMutex sync.RWMutex // Guards tipHash
+	addMutex sync.Mutex   // Adds one header at a time
+}
+
+// SPVTx est une transaction du wallet léger, prouvée dans un bloc de la chaîne d'en-têtes
+type SPVTx struct {
+	BlockHash   []byte
+	Transaction Transaction
+}
+
+// OpenHeaderChain ouvre (ou crée) la chaîne d'en-têtes d'un nœud léger
+func OpenHeaderChain(nodeId string) *HeaderChain {
+	path := fmt.Sprintf(headersPath, nodeId)
+
+	opts := badger.DefaultOptions(path)
+	opts.Logger = nil
+	opts.Dir = path
+	opts.ValueDir = path
+
+	db, err := openDB(path, opts)
+	Handle(err)
+
+	var tipHash, genesis []byte
+	err = db.View(func(txn *badger.Txn) error {
+		if item, err := txn.Get(genesisKey); err == nil {
+			if genesis, err = item.ValueCopy(nil); err != nil {
+				return err
+			}
+		}
+		item, err := txn.Get(headerTipKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		Handle(err)
+		tipHash, err = item.ValueCopy(nil)
+		return err
+	})
+	Handle(err)
+
+	params, err := loadParams(db)
+	Handle(err)
+
+	return &HeaderChain{Database: db, Params: params, Genesis: genesis, tipHash: tipHash}
+}
+
+// TipHash retourne le hash du meilleur en-tête, vide si la chaîne est vide
+func (hc *HeaderChain) TipHash() []byte {
+	hc.tipMutex.RLock()
+	defer hc.tipMutex.RUnlock()
+
+	return hc.tipHash
+}
+
+// setTipHash remplace le hash du meilleur en-tête
+func (hc *HeaderChain) setTipHash(hash []byte) {
+	hc.tipMutex.Lock()
+	defer hc.tipMutex.Unlock()
+
+	hc.tipHash = hash
+}
+
+// PinGenesis fixe le bloc genesis du réseau suivi et les paramètres de sa chaîne : AddHeader refuse
+// tout autre genesis et valide les en-têtes avec params
+// Le genesis n'est pas codé en dur, chaque réseau crée le sien : sans genesis fixé, le premier pair
+// pourrait imposer n'importe quelle chaîne au nœud léger. Les paramètres sont enregistrés avec le
+// genesis et rechargés à l'ouverture, comme ceux d'une chaîne complète. Retourne une erreur si la
+// chaîne d'en-têtes suit déjà un autre genesis ou d'autres paramètres
+func (hc *HeaderChain) PinGenesis(hash []byte, params Params) error {
+	if len(hc.Genesis) > 0 && !bytes.Equal(hc.Genesis, hash) {
+		return fmt.Errorf("header chain already follows genesis %x", hc.Genesis)
+	}
+	if len(hc.Genesis) > 0 && hc.Params.Name != params.Name {
+		return fmt.Errorf("header chain already follows a %s chain", hc.Params.Name)
+	}
+	hc.addMutex.Lock()
+	defer hc.addMutex.Unlock()
+
+	if tip := hc.TipHash(); len(tip) > 0 {
+		genesis, err := hc.GetHeader(tip)
+		for err == nil && len(genesis.PrevHash) > 0 {
+			genesis, err = hc.GetHeader(genesis.PrevHash)
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(genesis.Hash, hash) {
+			return fmt.Errorf("stored headers start at genesis %x", genesis.Hash)
+		}
+	}
+
+	err := hc.Database.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(paramsKey, []byte(params.Name)); err != nil {
+			return err
+		}
+		return txn.Set(genesisKey, hash)
+	})
+	if err != nil {
+		return err
+	}
+	hc.Genesis = hash
+	hc.Params = params
+
+	return nil
+}
+
+// GetHeader récupère un en-tête par son hash
+func (hc *HeaderChain) GetHeader(hash []byte) (BlockHeader, error) {
+	var header BlockHeader
+
+	err := hc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(headerPrefix, hash...))
+		if err != nil {
+			return errors.New("Header is not found")
+		}
+		return item.Value(func(val []byte) error {
+			header = *DeserializeHeader(val)
+			return nil
+		})
+	})
+
+	return header, err
+}
+
+// BestHeight retourne la hauteur du meilleur en-tête, ou -1 si la chaîne est vide
+func (hc *HeaderChain) BestHeight() int {
+	tipHash := hc.TipHash()
+	if len(tipHash) == 0 {
+		return -1
+	}
+
+	tip, err := hc.GetHeader(tipHash)
+	Handle(err)
+
+	return tip.Height
+}
+
+// MedianTimePast retourne le temps médian de l'en-tête donné et de ses prédécesseurs
+func (hc *HeaderChain) MedianTimePast(hash []byte) int64 {
+	return medianTimePast(hash, hc.GetHeader)
+}
+
+// AddHeader valide puis ajoute un en-tête à la chaîne
+// Le premier en-tête accepté est le genesis annoncé par le premier pair complet
+// Retourne true si l'en-tête était inconnu
+func (hc *HeaderChain) AddHeader(h *BlockHeader) (bool, error) {
+	hc.addMutex.Lock()
+	defer hc.addMutex.Unlock()
+
+	if _, err := hc.GetHeader(h.Hash); err == nil {
+		return false, nil
+	}
+
+	if !ValidateHeader(h, hc.Params) {
+		return false, fmt.Errorf("header %x has an invalid proof of work", h.Hash)
+	}
+
+	if len(hc.TipHash()) == 0 {
+		if h.Height != 0 || len(h.PrevHash) != 0 {
+			return false, fmt.Errorf("header %x is not a genesis header", h.Hash)
+		}
+		if !bytes.Equal(h.Hash, hc.Genesis) {
+			return false, fmt.Errorf("genesis header %x is not the pinned genesis %x", h.Hash, hc.Genesis)
+		}
+	} else {
+		parent, err := hc.GetHeader(h.PrevHash)
+		if err != nil {
+			return false, fmt.Errorf("parent header %x not found", h.PrevHash)
+		}
+		if h.Height != parent.Height+1 {
+			return false, fmt.Errorf("bad height %d, parent is at %d", h.Height, parent.Height)
+		}
+		if h.Timestamp <= hc.MedianTimePast(parent.Hash) {
+			return false, errors.New("timestamp is not after median time past")
+		}
+		if err := checkFutureTime(h.Timestamp); err != nil {
+			return false, err
+		}
+	}
+
+	bestHeight := hc.BestHeight()
+	err := hc.Database.Update(func(txn *badger.Txn) error {
+		err := txn.Set(append(headerPrefix, h.Hash...), h.Serialize())
+		Handle(err)
+
+		if h.Height > bestHeight {
+			err = txn.Set(headerTipKey, h.Hash)
+			Handle(err)
+		}
+
+		return nil
+	})
+	Handle(err)
+	if h.Height > bestHeight {
+		hc.setTipHash(h.Hash)
+	}
+
+	return true, nil
+}
+
+// IsInMainChain vérifie qu'un en-tête appartient à la meilleure chaîne d'en-têtes
+func (hc *HeaderChain) IsInMainChain(hash []byte) bool {
+	target, err := hc.GetHeader(hash)
+	if err != nil {
+		return false
+	}
+
+	current := hc.TipHash()
+	for len(current) > 0 {
+		header, err := hc.GetHeader(current)
+		if err != nil {
+			return false
+		}
+		if header.Height == target.Height {
+			return bytes.Equal(header.Hash, target.Hash)
+		}
+		current = header.PrevHash
+	}
+
+	return false
+}
+
+// VerifyTxProof vérifie une preuve d'inclusion contre la chaîne d'en-têtes
+// Retourne le nombre de confirmations de la transaction
+func (hc *HeaderChain) VerifyTxProof(p *TxProof) (int, error) {
+	if err := p.Check(hc.Params); err != nil {
+		return 0, err
+	}
+	if !hc.IsInMainChain(p.Header.Hash) {
+		return 0, fmt.Errorf("block %x is not in our header chain", p.Header.Hash)
+	}
+
+	return hc.BestHeight() - p.Header.Height + 1, nil
+}
+
+// AddWalletTx enregistre une transaction du wallet dont la preuve a été vérifiée
+// Retourne true si la transaction était inconnue
+func (hc *HeaderChain) AddWalletTx(tx *Transaction, blockHash []byte) bool {
+	key := append(spvTxPrefix, tx.ID...)
+	added := false
+
+	err := hc.Database.Update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(key); err == nil {
+			return nil
+		}
+		added = true
+
+		var encoded bytes.Buffer
+		err := gob.NewEncoder(&encoded).Encode(SPVTx{blockHash, *tx})
+		Handle(err)
+
+		return txn.Set(key, encoded.Bytes())
+	})
+	Handle(err)
+
+	return added
+}
+
+// WalletTransactions retourne les transactions du wallet confirmées dans la meilleure chaîne
+func (hc *HeaderChain) WalletTransactions() []SPVTx {
+	var txs []SPVTx
+
+	err := hc.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(spvTxPrefix); it.ValidForPrefix(spvTxPrefix); it.Next() {
+			v, err := it.Item().ValueCopy(nil)
+			Handle(err)
+
+			var stx SPVTx
+			err = gob.NewDecoder(bytes.NewReader(v)).Decode(&stx)
+			Handle(err)
+			txs = append(txs, stx)
+		}
+		return nil
+	})
+	Handle(err)
+
+	var confirmed []SPVTx
+	for _, stx := range txs {
+		if hc.IsInMainChain(stx.BlockHash) {
+			confirmed = append(confirmed, stx)
+		}
+	}
+
+	return confirmed
+}
+
+// GetBalance calcule le solde d'une adresse à partir des transactions prouvées du wallet
+func (hc *HeaderChain) GetBalance(pubKeyHash []byte) int {
+	txs := hc.WalletTransactions()
+	spent := make(map[string]bool)
+
+	for _, stx := range txs {
+		for _, in := range stx.Transaction.Inputs {
+			spent[outpointKey(hex.EncodeToString(in.ID), in.Out)] = true
+		}
+	}
+
+	balance := 0
+	for _, stx := range txs {
+		txID := hex.EncodeToString(stx.Transaction.ID)
+		for outIdx, out := range stx.Transaction.Outputs {
+			if out.isLockedWithKey(pubKeyHash) && !spent[outpointKey(txID, outIdx)] {
+				balance += out.Value
+			}
+		}
+	}
+
+	return balance
+}
+
+// FilterTip retourne le hash de l'en-tête le plus haut dont le filtre compact est enregistré
+func (hc *HeaderChain) FilterTip() []byte {
+	var tipHash []byte
+
+	err := hc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(filterTipKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		Handle(err)
+		tipHash, err = item.ValueCopy(nil)
+		return err
+	})
+	Handle(err)
+
+	return tipHash
+}
+
+// SaveCFilter enregistre le filtre compact d'un bloc de la chaîne d'en-têtes
+func (hc *HeaderChain) SaveCFilter(cf CFilter) error {
+	header, err := hc.GetHeader(cf.BlockHash)
+	if err != nil {
+		return fmt.Errorf("filter for unknown block %x", cf.BlockHash)
+	}
+	if _, err := DeserializeBlockFilter(cf.BlockHash, cf.Filter); err != nil {
+		return err
+	}
+
+	tipHeight := -1
+	if tip := hc.FilterTip(); len(tip) > 0 {
+		if tipHeader, err := hc.GetHeader(tip); err == nil && hc.IsInMainChain(tip) {
+			tipHeight = tipHeader.Height
+		}
+	}
+
+	err = hc.Database.Update(func(txn *badger.Txn) error {
+		err := txn.Set(append(cfilterPrefix, cf.BlockHash...), cf.Filter)
+		Handle(err)
+
+		if header.Height > tipHeight {
+			err = txn.Set(filterTipKey, cf.BlockHash)
+		}
+		return err
+	})
+	Handle(err)
+
+	return nil
+}
+
+// GetCFilter retourne le filtre compact enregistré pour un bloc
+func (hc *HeaderChain) GetCFilter(blockHash []byte) (*GCSFilter, error) {
+	var data []byte
+
+	err := hc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(cfilterPrefix, blockHash...))
+		if err != nil {
+			return errors.New("Filter is not found")
+		}
+		data, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return DeserializeBlockFilter(blockHash, data)
+}
+
+// WalletFilterItems retourne les éléments à tester dans les filtres pour le wallet :
+// ses hashes de clé publique et les sorties qu'il possède déjà
+func (hc *HeaderChain) WalletFilterItems(pubKeyHashes [][]byte) [][]byte {
+	items := append([][]byte{}, pubKeyHashes...)
+
+	for _, stx := range hc.WalletTransactions() {
+		for outIdx, out := range stx.Transaction.Outputs {
+			for _, pubKeyHash := range pubKeyHashes {
+				if out.isLockedWithKey(pubKeyHash) {
+					items = append(items, OutpointFilterItem(stx.Transaction.ID, outIdx))
+					break
+				}
+			}
+		}
+	}
+
+	return items
+}
+
+// RescanFilters teste localement les filtres enregistrés de la chaîne principale
+// Retourne, du plus ancien au plus récent, les hashes des blocs à télécharger
+func (hc *HeaderChain) RescanFilters(pubKeyHashes [][]byte) [][]byte {
+	items := hc.WalletFilterItems(pubKeyHashes)
+	var matches [][]byte
+
+	current := hc.TipHash()
+	for len(current) > 0 {
+		header, err := hc.GetHeader(current)
+		if err != nil {
+			break
+		}
+		if filter, err := hc.GetCFilter(header.Hash); err == nil && filter.MatchAny(items) {
+			matches = append([][]byte{header.Hash}, matches...)
+		}
+		current = header.PrevHash
+	}
+
+	return matches
+}
+
+// ScanBlock vérifie un bloc complet contre la chaîne d'en-têtes puis enregistre
+// les transactions qui concernent le wallet. Retourne le nombre de transactions ajoutées
+func (hc *HeaderChain) ScanBlock(block *Block, pubKeyHashes [][]byte) (int, error) {
+	header, err := hc.GetHeader(block.Hash)
+	if err != nil {
+		return 0, fmt.Errorf("block %x is not in our header chain", block.Hash)
+	}
+	if !bytes.Equal(header.MerkleRoot, block.HashTransactions()) {
+		return 0, errors.New("transactions do not match the header's merkle root")
+	}
+
+	owned := make(map[string]bool)
+	for _, item := range hc.WalletFilterItems(pubKeyHashes) {
+		owned[string(item)] = true
+	}
+
+	added := 0
+	for _, tx := range block.Transactions {
+		relevant := tx.touchesKeys(pubKeyHashes)
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				relevant = relevant || owned[string(OutpointFilterItem(in.ID, in.Out))]
+			}
+		}
+
+		if relevant && hc.AddWalletTx(tx, block.Hash) {
+			added++
+		}
+	}
+
+	return added, nil
+}
@@ -0,0 +1,68 @@
+package blockchain
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+var mempoolPrefix = []byte("mempool-") // Prefix for unconfirmed transactions in the database
+
+// SaveMempoolTx enregistre une transaction non confirmée dans la base de données
+// Le mempool survit ainsi aux redémarrages et reste visible des commandes CLI
+func (chain *BlockChain) SaveMempoolTx(tx *Transaction) {
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(append(mempoolPrefix, tx.ID...), tx.Serialize())
+	})
+	Handle(err)
+}
+
+// DeleteMempoolTx retire une transaction du mempool persistant
+func (chain *BlockChain) DeleteMempoolTx(ID []byte) {
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		err := txn.Delete(append(mempoolPrefix, ID...))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		return err
+	})
+	Handle(err)
+}
+
+// MempoolTransactions retourne toutes les transactions du mempool persistant
+func (chain *BlockChain) MempoolTransactions() []Transaction {
+	var txs []Transaction
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(mempoolPrefix); it.ValidForPrefix(mempoolPrefix); it.Next() {
+			v, err := it.Item().ValueCopy(nil)
+			Handle(err)
+			txs = append(txs, DeserializeTransaction(v))
+		}
+		return nil
+	})
+	Handle(err)
+
+	return txs
+}
+
+// MempoolSpentOutputs retourne les outputs déjà dépensés par des transactions non confirmées
+func (chain *BlockChain) MempoolSpentOutputs() map[string]bool {
+	spent := make(map[string]bool)
+
+	for _, tx := range chain.MempoolTransactions() {
+		for _, in := range tx.Inputs {
+			spent[outpointKey(fmt.Sprintf("%x", in.ID), in.Out)] = true
+		}
+	}
+
+	return spent
+}
+
+// outpointKey identifie un output par l'ID hexadécimal de sa transaction et son index
+func outpointKey(txID string, outIdx int) string {
+	return fmt.Sprintf("%s:%d", txID, outIdx)
+}
@@ -1,10 +1,17 @@
 package blockchain
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
 
 // MerkleTree représente un arbre de Merkle pour vérifier l'intégrité des transactions
 type MerkleTree struct {
-	RootNode *MerkleNode
+	RootNode *MerkleNode     // Racine, qui engage aussi le nombre de feuilles
+	levels   [][]*MerkleNode // Niveaux de l'arbre, des feuilles vers la racine
 }
 
 // MerkleNode représente un nœud dans l'arbre de Merkle
@@ -14,17 +21,30 @@ type MerkleNode struct {
 	Data  []byte
 }
 
+// MerkleProof est une preuve d'inclusion d'une transaction dans un arbre de Merkle
+type MerkleProof struct {
+	TxID   []byte   // Transaction prouvée
+	Index  int      // Position de la transaction dans le bloc
+	Leaves int      // Nombre de transactions du bloc
+	Hashes [][]byte // Hashes frères, des feuilles vers la racine
+}
+
+// Préfixes des hashes de l'arbre : une feuille ne peut pas se faire passer pour un nœud interne,
+// ni un nœud interne pour la racine
+const (
+	leafPrefix byte = 0x00
+	nodePrefix byte = 0x01
+	rootPrefix byte = 0x02
+)
+
 // NewMerkleNode crée un nouveau nœud de l'arbre de Merkle
 func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	node := MerkleNode{}
 
 	if left == nil && right == nil {
-		hash := sha256.Sum256(data)
-		node.Data = hash[:]
+		node.Data = hashLeaf(data)
 	} else {
-		prevHashes := append(left.Data, right.Data...)
-		hash := sha256.Sum256(prevHashes)
-		node.Data = hash[:]
+		node.Data = hashPair(left.Data, right.Data)
 	}
 
 	node.Left = left
@@ -32,29 +52,119 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	return &node
 }
 
+// hashLeaf calcule le hash d'une feuille à partir de sa donnée
+func hashLeaf(data []byte) []byte {
+	hash := sha256.Sum256(append([]byte{leafPrefix}, data...))
+	return hash[:]
+}
+
+// hashPair calcule le hash d'un nœud interne à partir de ses deux enfants
+func hashPair(left, right []byte) []byte {
+	prevHashes := append(append([]byte{nodePrefix}, left...), right...)
+	hash := sha256.Sum256(prevHashes)
+	return hash[:]
+}
+
+// hashRoot calcule la racine de l'arbre à partir du nombre de feuilles et du sommet des nœuds
+// La forme de l'arbre dépend du nombre de feuilles : l'engager fixe la position d'une feuille prouvée
+func hashRoot(leaves int, top []byte) []byte {
+	data := make([]byte, 9, 9+len(top))
+	data[0] = rootPrefix
+	binary.BigEndian.PutUint64(data[1:], uint64(leaves))
+
+	hash := sha256.Sum256(append(data, top...))
+	return hash[:]
+}
+
 // NewMerkleTree construit un arbre de Merkle à partir d'un ensemble de données
+// À chaque niveau de taille impaire, le dernier nœud remonte tel quel au niveau suivant : il n'est
+// jamais dupliqué, deux listes de transactions différentes ne peuvent donc pas avoir la même racine
 func NewMerkleTree(data [][]byte) *MerkleTree {
-	var nodes []MerkleNode
-
-	if len(data)%2 != 0 {
-		data = append(data, data[len(data)-1]) // Duplicate last element if odd number
-	}
+	var nodes []*MerkleNode
 
 	for _, dat := range data {
-		nodes = append(nodes, *NewMerkleNode(nil, nil, dat))
+		nodes = append(nodes, NewMerkleNode(nil, nil, dat))
+	}
+	if len(nodes) == 0 {
+		nodes = append(nodes, NewMerkleNode(nil, nil, []byte{}))
 	}
 
+	tree := &MerkleTree{}
+
 	// Build the tree
-	for range len(data) / 2 {
-		var level []MerkleNode
+	for len(nodes) > 1 {
+		tree.levels = append(tree.levels, nodes)
 
-		for i := 0; i < len(nodes); i += 2 {
-			node := NewMerkleNode(&nodes[i], &nodes[i+1], nil)
-			level = append(level, *node)
+		var level []*MerkleNode
+		for i := 0; i+1 < len(nodes); i += 2 {
+			level = append(level, NewMerkleNode(nodes[i], nodes[i+1], nil))
+		}
+		if len(nodes)%2 != 0 {
+			level = append(level, nodes[len(nodes)-1]) // Promote the last node if odd number
 		}
 
 		nodes = level
 	}
 
-	return &MerkleTree{&nodes[0]}
+	tree.levels = append(tree.levels, nodes)
+	tree.RootNode = &MerkleNode{Left: nodes[0], Data: hashRoot(len(tree.levels[0]), nodes[0].Data)}
+
+	return tree
+}
+
+// Proof construit la preuve d'inclusion de la feuille à la position index
+func (t *MerkleTree) Proof(index int, txID []byte) (MerkleProof, error) {
+	if len(t.levels) == 0 || index < 0 || index >= len(t.levels[0]) {
+		return MerkleProof{}, errors.New("leaf index out of range")
+	}
+
+	proof := MerkleProof{TxID: txID, Index: index, Leaves: len(t.levels[0])}
+	for _, level := range t.levels[:len(t.levels)-1] {
+		if index^1 < len(level) {
+			proof.Hashes = append(proof.Hashes, level[index^1].Data)
+		}
+		index /= 2
+	}
+
+	return proof, nil
+}
+
+// RootHash recalcule la racine de Merkle à partir de la preuve
+// Index doit désigner une des Leaves feuilles, et Hashes contenir exactement un frère par niveau où
+// le nœud en a un. La racine engage Leaves : une preuve ne vérifie qu'à la position de sa feuille
+func (p MerkleProof) RootHash() ([]byte, error) {
+	if p.Index < 0 || p.Index >= p.Leaves {
+		return nil, fmt.Errorf("leaf index %d out of range for %d leaves", p.Index, p.Leaves)
+	}
+
+	hash := hashLeaf(p.TxID)
+	hashes := p.Hashes
+
+	index, width := p.Index, p.Leaves
+	for width > 1 {
+		if index^1 < width {
+			if len(hashes) == 0 {
+				return nil, errors.New("merkle proof is too short")
+			}
+			if index%2 == 0 {
+				hash = hashPair(hash, hashes[0])
+			} else {
+				hash = hashPair(hashes[0], hash)
+			}
+			hashes = hashes[1:]
+		}
+		index /= 2
+		width = (width + 1) / 2
+	}
+	if len(hashes) > 0 {
+		return nil, errors.New("merkle proof is too long")
+	}
+
+	return hashRoot(p.Leaves, hash), nil
+}
+
+// Verify vérifie que la preuve mène bien à la racine donnée
+func (p MerkleProof) Verify(root []byte) bool {
+	hash, err := p.RootHash()
+	return err == nil && bytes.Equal(hash, root)
 }
@@ -0,0 +1,92 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// merkleLeaves crée count données distinctes pour les feuilles d'un arbre
+func merkleLeaves(count int) [][]byte {
+	var data [][]byte
+	for i := 0; i < count; i++ {
+		data = append(data, []byte(fmt.Sprintf("tx-%d", i)))
+	}
+	return data
+}
+
+// TestMerkleProof construit puis vérifie la preuve de chaque feuille d'arbres de tailles paires
+// et impaires ; une preuve ne vérifie qu'à la position de sa feuille
+func TestMerkleProof(t *testing.T) {
+	for _, size := range []int{1, 2, 3, 5, 6, 7, 9, 13, 16, 17} {
+		t.Run(fmt.Sprintf("%d leaves", size), func(t *testing.T) {
+			data := merkleLeaves(size)
+			tree := NewMerkleTree(data)
+			root := tree.RootNode.Data
+
+			for i := range data {
+				proof, err := tree.Proof(i, data[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !proof.Verify(root) {
+					t.Fatalf("proof of leaf %d does not verify", i)
+				}
+
+				for _, index := range []int{-1, i + 1, i + 2, i + size, 1 << len(proof.Hashes)} {
+					if index == i {
+						continue
+					}
+					moved := proof
+					moved.Index = index
+					if moved.Verify(root) {
+						t.Fatalf("proof of leaf %d verifies at index %d", i, index)
+					}
+				}
+
+				// Le nombre de feuilles est engagé par la racine : une autre forme d'arbre ne vérifie à
+				// aucune position
+				for leaves := 1; leaves <= size+2; leaves++ {
+					for index := 0; index < leaves && leaves != size; index++ {
+						reshaped := proof
+						reshaped.Leaves, reshaped.Index = leaves, index
+						if reshaped.Verify(root) {
+							t.Fatalf("proof of leaf %d verifies as leaf %d of %d", i, index, leaves)
+						}
+					}
+				}
+
+				other := proof
+				other.TxID = []byte("other")
+				if other.Verify(root) {
+					t.Fatalf("proof of leaf %d verifies for another transaction", i)
+				}
+			}
+
+			if _, err := tree.Proof(size, data[0]); err == nil {
+				t.Fatal("proof built for a leaf out of range")
+			}
+		})
+	}
+}
+
+// TestMerkleMutation vérifie que des listes de données différentes ont des racines différentes,
+// même quand l'une répète le dernier élément de l'autre
+func TestMerkleMutation(t *testing.T) {
+	tests := []struct {
+		name        string
+		left, right [][]byte
+	}{
+		{"duplicated last leaf", merkleLeaves(3), append(merkleLeaves(3), []byte("tx-2"))},
+		{"duplicated last pair", merkleLeaves(6), append(merkleLeaves(6), []byte("tx-4"), []byte("tx-5"))},
+		{"inner node as a leaf", merkleLeaves(2), [][]byte{hashPair(hashLeaf([]byte("tx-0")), hashLeaf([]byte("tx-1")))}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if bytes.Equal(NewMerkleTree(test.left).RootNode.Data, NewMerkleTree(test.right).RootNode.Data) {
+				t.Fatal("different data have the same merkle root")
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package blockchain
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxNonce borne l'espace des nonces d'un en-tête
+// Une fois cet espace épuisé, le mineur change l'extra-nonce du coinbase et recommence
+const MaxNonce = math.MaxUint32
+
+// hashBatch est le nombre de hashes calculés par un worker entre deux vérifications d'annulation
+const hashBatch = 4096
+
+// ErrNonceSpaceExhausted signale qu'aucun nonce restant ne satisfait la cible
+var ErrNonceSpaceExhausted = errors.New("nonce space exhausted")
+
+// Miner cherche la preuve de travail d'un bloc en répartissant les nonces sur plusieurs workers
+type Miner struct {
+	Workers        int           // Number of mining goroutines
+	ReportInterval time.Duration // Period of the hashrate reports while mining
+
+	hashes uint64 // Hashes computed for the current block
+}
+
+// NewMiner crée un mineur qui utilise tous les cœurs de la machine
+func NewMiner() *Miner {
+	return &Miner{Workers: runtime.NumCPU(), ReportInterval: 10 * time.Second}
+}
+
+// Mine cherche un nonce valide pour le bloc d'une chaîne de difficulté difficulty et renseigne
+// son Nonce et son Hash
+// Si l'espace des nonces est épuisé, l'extra-nonce du coinbase est incrémenté, ce qui
+// change la racine de Merkle. Retourne l'erreur du contexte si le minage est annulé
+func (m *Miner) Mine(ctx context.Context, block *Block, difficulty int) error {
+	start := time.Now()
+	atomic.StoreUint64(&m.hashes, 0)
+
+	stopReport := m.reportHashrate(block.Height, start)
+	defer stopReport()
+
+	for extraNonce := int64(0); ; extraNonce++ {
+		if extraNonce > 0 {
+			if err := block.SetExtraNonce(extraNonce); err != nil {
+				return err
+			}
+		}
+
+		nonce, hash, err := m.search(ctx, block.Header(), difficulty, 0, DifficultyTarget(difficulty))
+		if err == ErrNonceSpaceExhausted {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		block.Nonce = nonce
+		block.Hash = hash
+
+		hashes := atomic.LoadUint64(&m.hashes)
+		elapsed := time.Since(start)
+		fmt.Printf("Mined block %d: nonce %d, extra-nonce %d, %d hashes in %s (%s)\n",
+			block.Height, nonce, extraNonce, hashes, elapsed.Round(time.Millisecond), formatHashrate(hashes, elapsed))
+
+		return nil
+	}
+}
+
+// SearchNonce cherche, à partir de startNonce, un nonce dont le hash de l'en-tête d'une chaîne de
+// difficulté difficulty a au moins shareDifficulty bits de tête à zéro. Sert aux parts d'un pool,
+// plus faciles que les blocs
+func (m *Miner) SearchNonce(ctx context.Context, header BlockHeader, difficulty, startNonce, shareDifficulty int) (int, []byte, error) {
+	return m.search(ctx, header, difficulty, startNonce, DifficultyTarget(shareDifficulty))
+}
+
+// DifficultyTarget retourne la cible qu'un hash doit rester sous pour avoir difficulty bits à zéro
+func DifficultyTarget(difficulty int) *big.Int {
+	target := big.NewInt(1)
+	target.Lsh(target, uint(256-difficulty))
+
+	return target
+}
+
+// search parcourt l'espace des nonces d'un en-tête avec tous les workers
+// Le worker i teste les nonces startNonce+i, startNonce+i+Workers...
+func (m *Miner) search(ctx context.Context, header BlockHeader, difficulty, startNonce int, target *big.Int) (int, []byte, error) {
+	workers := m.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	// Le nonce est encodé sur 8 octets après PrevHash, MerkleRoot et Timestamp
+	data := header.powData(0, difficulty)
+	nonceOffset := len(header.PrevHash) + len(header.MerkleRoot) + 8
+
+	searchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type solution struct {
+		nonce int
+		hash  []byte
+	}
+	found := make(chan solution, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(first int) {
+			defer wg.Done()
+
+			buf := append([]byte{}, data...)
+			var intHash big.Int
+			count := uint64(0)
+
+			for nonce := first; nonce <= MaxNonce; nonce += workers {
+				count++
+				if count == hashBatch {
+					atomic.AddUint64(&m.hashes, count)
+					count = 0
+					if searchCtx.Err() != nil {
+						return
+					}
+				}
+
+				binary.BigEndian.PutUint64(buf[nonceOffset:], uint64(nonce))
+				hash := sha256.Sum256(buf)
+				intHash.SetBytes(hash[:])
+
+				if intHash.Cmp(target) == -1 {
+					atomic.AddUint64(&m.hashes, count)
+					found <- solution{nonce, hash[:]}
+					cancel()
+					return
+				}
+			}
+			atomic.AddUint64(&m.hashes, count)
+		}(startNonce + i)
+	}
+	wg.Wait()
+
+	select {
+	case s := <-found:
+		return s.nonce, s.hash, nil
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	return 0, nil, ErrNonceSpaceExhausted
+}
+
+// reportHashrate affiche périodiquement le hashrate jusqu'à l'appel de la fonction retournée
+func (m *Miner) reportHashrate(height int, start time.Time) func() {
+	if m.ReportInterval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(m.ReportInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				hashes := atomic.LoadUint64(&m.hashes)
+				fmt.Printf("Mining block %d: %d hashes, %s\n", height, hashes, formatHashrate(hashes, time.Since(start)))
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// formatHashrate formate un nombre de hashes par seconde avec l'unité adaptée
+func formatHashrate(hashes uint64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		elapsed = time.Millisecond
+	}
+	rate := float64(hashes) / elapsed.Seconds()
+
+	switch {
+	case rate >= 1e9:
+		return fmt.Sprintf("%.2f GH/s", rate/1e9)
+	case rate >= 1e6:
+		return fmt.Sprintf("%.2f MH/s", rate/1e6)
+	case rate >= 1e3:
+		return fmt.Sprintf("%.2f kH/s", rate/1e3)
+	default:
+		return fmt.Sprintf("%.0f H/s", rate)
+	}
+}
+
+// SetExtraNonce remplace l'extra-nonce du coinbase du bloc et recalcule sa racine de Merkle
+func (b *Block) SetExtraNonce(extraNonce int64) error {
+	for _, tx := range b.Transactions {
+		if !tx.IsCoinbase() {
+			continue
+		}
+
+		instructions, err := parseScript(tx.Inputs[0].ScriptSig)
+		if err != nil || len(instructions) == 0 {
+			return errors.New("coinbase has no data to extend")
+		}
+
+		// Le premier push reste la donnée du coinbase, l'extra-nonce le suit
+		tx.Inputs[0].ScriptSig = append(PushData(instructions[0].Data), PushInt(extraNonce)...)
+		tx.ID = tx.Hash()
+		b.MerkleRoot = b.HashTransactions()
+
+		return nil
+	}
+
+	return errors.New("block has no coinbase")
+}
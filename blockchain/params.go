@@ -0,0 +1,64 @@
+package blockchain
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+// paramsKey désigne dans la base le nom des paramètres choisis à la création de la chaîne
+var paramsKey = []byte("params")
+
+// Params regroupe les paramètres de consensus d'une chaîne
+type Params struct {
+	Name       string
+	Difficulty int // Leading zero bits of a valid block hash
+}
+
+var (
+	// MainParams sont les paramètres par défaut
+	MainParams = Params{Name: "main", Difficulty: 12}
+	// RegtestParams sont les paramètres des tests : une difficulté triviale qui mine un bloc
+	// instantanément, et la commande generate
+	RegtestParams = Params{Name: "regtest", Difficulty: 1}
+)
+
+// ParamsByName retourne les paramètres qui portent ce nom
+func ParamsByName(name string) (Params, error) {
+	for _, params := range []Params{MainParams, RegtestParams} {
+		if params.Name == name {
+			return params, nil
+		}
+	}
+
+	return Params{}, fmt.Errorf("unknown chain parameters %q", name)
+}
+
+// IsRegtest indique si ce sont les paramètres de test
+func (p Params) IsRegtest() bool {
+	return p.Name == RegtestParams.Name
+}
+
+// loadParams lit les paramètres enregistrés dans la base à la création de la chaîne
+// Une chaîne créée avant l'enregistrement des paramètres utilise MainParams
+func loadParams(db *badger.DB) (Params, error) {
+	name := MainParams.Name
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(paramsKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		name = string(value)
+
+		return err
+	})
+	if err != nil {
+		return Params{}, err
+	}
+
+	return ParamsByName(name)
+}
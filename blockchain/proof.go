@@ -4,43 +4,72 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
-	"fmt"
 	"log"
-	"math"
 	"math/big"
 )
 
-const Difficulty = 12
-
 // ProofOfWork représente un algorithme de preuve de travail pour miner des blocs
 type ProofOfWork struct {
-	Block  *Block
-	Target *big.Int
+	Block      *Block
+	Target     *big.Int
+	Difficulty int // Leading zero bits required by the chain parameters
 }
 
-// NewProofOfWork crée une nouvelle instance de preuve de travail pour un bloc
-func NewProofOfWork(b *Block) *ProofOfWork {
+// NewProofOfWork crée une nouvelle instance de preuve de travail pour un bloc d'une chaîne de
+// difficulté difficulty
+func NewProofOfWork(b *Block, difficulty int) *ProofOfWork {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
-	pow := &ProofOfWork{b, target}
+	target.Lsh(target, uint(256-difficulty))
+	pow := &ProofOfWork{b, target, difficulty}
 
 	return pow
 }
 
 // InitData prépare les données à hasher pour la preuve de travail
 func (pow *ProofOfWork) InitData(nonce int) []byte {
+	header := pow.Block.Header()
+	return header.powData(nonce, pow.Difficulty)
+}
+
+// powData prépare les données de l'en-tête hashées par la preuve de travail
+// La difficulté de la chaîne en fait partie
+func (h *BlockHeader) powData(nonce, difficulty int) []byte {
 	data := bytes.Join(
 		[][]byte{
-			pow.Block.PrevHash,
-			pow.Block.HashTransactions(),
+			h.PrevHash,
+			h.MerkleRoot,
+			ToHex(h.Timestamp),
 			ToHex(int64(nonce)),
-			ToHex(int64(Difficulty)),
+			ToHex(int64(difficulty)),
 		},
 		[]byte{},
 	)
 	return data
 }
 
+// ValidateHeader vérifie la preuve de travail d'un en-tête seul, sans ses transactions, selon les
+// paramètres de sa chaîne
+func ValidateHeader(h *BlockHeader, params Params) bool {
+	hash := h.PowHash(h.Nonce, params.Difficulty)
+
+	return HashMeetsDifficulty(hash, params.Difficulty) && bytes.Equal(hash, h.Hash)
+}
+
+// PowHash calcule le hash de preuve de travail de l'en-tête pour un nonce, sur une chaîne de
+// difficulté difficulty
+func (h *BlockHeader) PowHash(nonce, difficulty int) []byte {
+	hash := sha256.Sum256(h.powData(nonce, difficulty))
+	return hash[:]
+}
+
+// HashMeetsDifficulty vérifie qu'un hash a au moins difficulty bits de tête à zéro
+func HashMeetsDifficulty(hash []byte, difficulty int) bool {
+	var intHash big.Int
+	intHash.SetBytes(hash)
+
+	return intHash.Cmp(DifficultyTarget(difficulty)) == -1
+}
+
 // ToHex convertit un nombre en représentation hexadécimale
 func ToHex(num int64) []byte {
 	buff := new(bytes.Buffer)
@@ -52,36 +81,10 @@ func ToHex(num int64) []byte {
 	return buff.Bytes()
 }
 
-// Run exécute l'algorithme de preuve de travail pour trouver un nonce valide
-func (pow *ProofOfWork) Run() (int, []byte) {
-	var intHash big.Int
-	var hash [32]byte
-
-	nonce := 0
-
-	for nonce < math.MaxInt64 {
-		data := pow.InitData(nonce)
-		hash = sha256.Sum256(data)
-
-		fmt.Printf("\r%x", hash)
-		intHash.SetBytes(hash[:])
-		if intHash.Cmp(pow.Target) == -1 {
-			break
-		} else {
-			nonce++
-		}
-	}
-	fmt.Println()
-
-	return nonce, hash[:]
-}
-
 // Validate vérifie qu'un bloc a une preuve de travail valide
 func (pow *ProofOfWork) Validate() bool {
-	var intHash big.Int
-	data := pow.InitData(pow.Block.Nonce)
-	hash := sha256.Sum256(data)
-	intHash.SetBytes(hash[:])
+	header := pow.Block.Header()
+	hash := header.PowHash(header.Nonce, pow.Difficulty)
 
-	return intHash.Cmp(pow.Target) == -1 && bytes.Equal(hash[:], pow.Block.Hash)
+	return HashMeetsDifficulty(hash, pow.Difficulty) && bytes.Equal(hash, header.Hash)
 }
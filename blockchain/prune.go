@@ -0,0 +1,235 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+)
+
+// MinBlocksToKeep est la fenêtre de réorganisation d'une chaîne élaguée : ses derniers blocs sont
+// toujours gardés au-dessus de la base. Le set UTXO d'une réorganisation est reconstruit en
+// rejouant ces blocs depuis celui de la base, ils tiennent lieu de données d'annulation
+const MinBlocksToKeep = 288
+
+// PruneTarget indique combien de corps de blocs un nœud élagué garde sous son sommet
+type PruneTarget struct {
+	Blocks int // Blocks kept below the tip
+	MB     int // Megabytes of block bodies kept below the tip
+}
+
+// ParsePruneTarget lit une cible d'élagage : une taille en mégaoctets (550MB) ou un nombre de blocs
+func ParsePruneTarget(value string) (PruneTarget, error) {
+	if size, ok := strings.CutSuffix(strings.ToUpper(value), "MB"); ok {
+		mb, err := strconv.Atoi(size)
+		if err != nil || mb <= 0 {
+			return PruneTarget{}, fmt.Errorf("invalid prune size %q", value)
+		}
+		return PruneTarget{MB: mb}, nil
+	}
+
+	blocks, err := strconv.Atoi(value)
+	if err != nil || blocks <= 0 {
+		return PruneTarget{}, fmt.Errorf("invalid prune target %q, expected a number of blocks or a size such as 550MB", value)
+	}
+
+	return PruneTarget{Blocks: blocks}, nil
+}
+
+// Enabled indique si la cible demande d'élaguer la chaîne
+func (t PruneTarget) Enabled() bool {
+	return t.Blocks > 0 || t.MB > 0
+}
+
+// String décrit la cible comme ParsePruneTarget la lit
+func (t PruneTarget) String() string {
+	if t.MB > 0 {
+		return fmt.Sprintf("%dMB", t.MB)
+	}
+
+	return strconv.Itoa(t.Blocks)
+}
+
+// PruneHeight retourne la hauteur de la base qui respecte la cible
+// Les MinBlocksToKeep derniers blocs sont toujours gardés
+func (chain *BlockChain) PruneHeight(target PruneTarget) int {
+	height := chain.GetBestHeight() - max(target.Blocks, MinBlocksToKeep)
+	if target.MB > 0 {
+		height = min(height, chain.heightForSize(int64(target.MB)<<20))
+	}
+
+	return height
+}
+
+// heightForSize retourne la plus basse hauteur à partir de laquelle les corps des blocs jusqu'au
+// sommet tiennent en size octets
+func (chain *BlockChain) heightForSize(size int64) int {
+	var total int64
+
+	hash := chain.LastHash()
+	for {
+		var block *Block
+		err := chain.Database.View(func(txn *badger.Txn) error {
+			item, err := txn.Get(hash)
+			if err != nil {
+				return err
+			}
+			total += item.ValueSize()
+			return item.Value(func(val []byte) error {
+				block = Deserialize(val)
+				return nil
+			})
+		})
+		Handle(err)
+
+		if total > size {
+			return block.Height + 1
+		}
+		if bytes.Equal(block.Hash, chain.Base()) || len(block.PrevHash) == 0 {
+			return block.Height
+		}
+		hash = block.PrevHash
+	}
+}
+
+// BaseHeight retourne la hauteur de la base de la chaîne, 0 pour une chaîne qui part du genesis
+func (chain *BlockChain) BaseHeight() int {
+	if len(chain.Base()) == 0 {
+		return 0
+	}
+
+	base, err := chain.GetHeader(chain.Base())
+	Handle(err)
+
+	return base.Height
+}
+
+// Prune fait du bloc de la chaîne principale à la hauteur height la base de la chaîne : son set
+// UTXO est enregistré et seuls les en-têtes des blocs précédents restent nécessaires
+// Les corps passés sous la base sont supprimés à l'élagage suivant : un parcours de la chaîne
+// commencé avant celui-ci peut encore les lire
+// Retourne le nombre de blocs passés sous la base
+func (chain *BlockChain) Prune(height int) (int, error) {
+	// La base ne change pas pendant qu'un bloc d'une branche concurrente est rejoué
+	chain.blockMutex.Lock()
+	defer chain.blockMutex.Unlock()
+
+	if limit := chain.GetBestHeight() - MinBlocksToKeep; height > limit {
+		return 0, fmt.Errorf("cannot prune above height %d, the last %d blocks are kept", limit, MinBlocksToKeep)
+	}
+	if height <= chain.BaseHeight() {
+		return 0, nil
+	}
+
+	if err := chain.deletePrunedBodies(); err != nil {
+		return 0, err
+	}
+
+	base, err := chain.headerAtHeight(height)
+	if err != nil {
+		return 0, err
+	}
+	UTXO := chain.findUTXOAt(base.Hash)
+
+	var pruned []BlockHeader
+	hash := base.PrevHash
+	for {
+		block, err := chain.GetBlock(hash)
+		if err != nil {
+			return 0, err
+		}
+		pruned = append(pruned, block.Header())
+		// Les filtres compacts restent servis aux nœuds légers après l'élagage
+		if _, err := chain.GetCFilter(block.Hash); err != nil {
+			return 0, err
+		}
+		if bytes.Equal(block.Hash, chain.Base()) || len(block.PrevHash) == 0 {
+			break
+		}
+		hash = block.PrevHash
+	}
+
+	batch := chain.Database.NewWriteBatch()
+	defer batch.Cancel()
+	for _, h := range pruned {
+		if err := batch.Set(append(headerPrefix, h.Hash...), h.Serialize()); err != nil {
+			return 0, err
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		return 0, err
+	}
+
+	// Le set UTXO de la base et la base changent ensemble
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		var old [][]byte
+		for it.Seek(baseUTXOPrefix); it.ValidForPrefix(baseUTXOPrefix); it.Next() {
+			old = append(old, it.Item().KeyCopy(nil))
+		}
+		it.Close()
+
+		for _, key := range old {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		for txId, outs := range UTXO {
+			key, err := hex.DecodeString(txId)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(append(baseUTXOPrefix, key...), outs.SerializeOutputs()); err != nil {
+				return err
+			}
+		}
+
+		return txn.Set(baseKey, base.Hash)
+	})
+	if err != nil {
+		return 0, err
+	}
+	chain.setBase(base.Hash)
+
+	return len(pruned), nil
+}
+
+// deletePrunedBodies supprime les corps des blocs passés sous la base lors de l'élagage précédent
+func (chain *BlockChain) deletePrunedBodies() error {
+	if len(chain.Base()) == 0 {
+		return nil
+	}
+	base, err := chain.GetHeader(chain.Base())
+	if err != nil {
+		return err
+	}
+
+	var hashes [][]byte
+	hash := base.PrevHash
+	for len(hash) > 0 {
+		block, err := chain.GetBlock(hash)
+		if err != nil {
+			// Déjà supprimé, ou chaîne chargée depuis un snapshot
+			break
+		}
+		hashes = append(hashes, hash)
+		hash = block.PrevHash
+	}
+
+	// Du plus ancien au plus récent : interrompue, la suppression laisse des corps juste sous la
+	// base, que l'élagage suivant retrouve
+	batch := chain.Database.NewWriteBatch()
+	defer batch.Cancel()
+	for i := len(hashes) - 1; i >= 0; i-- {
+		if err := batch.Delete(hashes[i]); err != nil {
+			return err
+		}
+	}
+
+	return batch.Flush()
+}
@@ -0,0 +1,87 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestPrune élague une chaîne en plusieurs fois et la rouvre entre chaque élagage : la base est
+// restaurée, le set UTXO ne change pas et seuls les corps des blocs sous l'avant-dernière base
+// sont supprimés
+func TestPrune(t *testing.T) {
+	chain := newTestChain(t, "pruned")
+	chain.mine(1, chain.send(5))
+	chain.mine(MinBlocksToKeep + 10)
+	hashes := chain.GetBlockHashes()
+	best := chain.GetBestHeight()
+	blockAt := func(height int) []byte { return hashes[best-height] }
+	want := chain.FindUTXO()
+
+	tests := []struct {
+		name       string
+		height     int
+		pruned     int // Blocks passed under the base
+		valid      bool
+		baseHeight int // Base height after pruning
+		bodiesFrom int // Lowest height whose block body is still stored
+	}{
+		{"above the kept blocks", best - MinBlocksToKeep + 1, 0, false, 0, 0},
+		{"first base", 5, 5, true, 5, 0},
+		{"below the base", 3, 0, true, 5, 0},
+		{"second base", 8, 3, true, 8, 5},
+		{"highest base", best - MinBlocksToKeep, best - MinBlocksToKeep - 8, true, best - MinBlocksToKeep, 8},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pruned, err := chain.Prune(test.height)
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("pruned at height %d", test.height)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pruned != test.pruned {
+				t.Fatalf("%d blocks pruned, want %d", pruned, test.pruned)
+			}
+
+			chain.reopen("pruned")
+			if got := chain.BaseHeight(); got != test.baseHeight {
+				t.Fatalf("base restored at height %d, want %d", got, test.baseHeight)
+			}
+			if test.baseHeight > 0 && !bytes.Equal(chain.Base(), blockAt(test.baseHeight)) {
+				t.Fatalf("base restored at block %x, want %x", chain.Base(), blockAt(test.baseHeight))
+			}
+
+			for height := 0; height <= best; height++ {
+				if _, err := chain.GetHeader(blockAt(height)); err != nil {
+					t.Fatalf("header at height %d: %v", height, err)
+				}
+				_, err := chain.GetBlock(blockAt(height))
+				if height < test.bodiesFrom && err == nil {
+					t.Fatalf("block at height %d is still stored", height)
+				}
+				if height >= test.bodiesFrom && err != nil {
+					t.Fatalf("block at height %d: %v", height, err)
+				}
+			}
+
+			chain.checkUTXO(want)
+			UTXOSet{Blockchain: chain.BlockChain}.Reindex()
+			chain.checkUTXO(want)
+		})
+	}
+}
+
+// reopen ferme la base puis rouvre la chaîne comme au redémarrage du nœud
+func (c *testChain) reopen(nodeId string) {
+	c.t.Helper()
+
+	if err := c.Database.Close(); err != nil {
+		c.t.Fatal(err)
+	}
+	c.BlockChain = ContinueBlockChain(nodeId)
+}
@@ -0,0 +1,660 @@
+package blockchain
+
+import (
+	"blockchain-go/wallet"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Opcodes reconnus par le moteur de script
+const (
+	OP_0                   byte = 0x00
+	OP_PUSHDATA1           byte = 0x4c
+	OP_PUSHDATA2           byte = 0x4d
+	OP_1NEGATE             byte = 0x4f
+	OP_1                   byte = 0x51
+	OP_16                  byte = 0x60
+	OP_NOP                 byte = 0x61
+	OP_VERIFY              byte = 0x69
+	OP_RETURN              byte = 0x6a
+	OP_DROP                byte = 0x75
+	OP_DUP                 byte = 0x76
+	OP_EQUAL               byte = 0x87
+	OP_EQUALVERIFY         byte = 0x88
+	OP_SHA256              byte = 0xa8
+	OP_HASH160             byte = 0xa9
+	OP_HASH256             byte = 0xaa
+	OP_CHECKSIG            byte = 0xac
+	OP_CHECKSIGVERIFY      byte = 0xad
+	OP_CHECKMULTISIG       byte = 0xae
+	OP_CHECKMULTISIGVERIFY byte = 0xaf
+	OP_CHECKLOCKTIMEVERIFY byte = 0xb1
+	OP_CHECKSEQUENCEVERIFY byte = 0xb2
+)
+
+// Limites d'exécution des scripts
+const (
+	MaxScriptSize         = 10000 // Taille maximale d'un script en octets
+	MaxScriptElementSize  = 520   // Taille maximale d'un élément poussé sur la pile
+	MaxStackSize          = 1000  // Nombre maximal d'éléments sur la pile
+	MaxOpsPerScript       = 201   // Nombre maximal d'opcodes non-push par script
+	MaxPubKeysPerMultisig = 20    // Nombre maximal de clés dans un OP_CHECKMULTISIG
+	MaxNullDataSize       = 80    // Taille maximale des données d'un output OP_RETURN standard
+	maxScriptNumLen       = 4     // Taille maximale d'un entier de script
+	maxLockTimeNumLen     = 5     // Taille maximale des opérandes de timelock
+)
+
+var opcodeNames = map[byte]string{
+	OP_0:                   "OP_0",
+	OP_PUSHDATA1:           "OP_PUSHDATA1",
+	OP_PUSHDATA2:           "OP_PUSHDATA2",
+	OP_1NEGATE:             "OP_1NEGATE",
+	OP_NOP:                 "OP_NOP",
+	OP_VERIFY:              "OP_VERIFY",
+	OP_RETURN:              "OP_RETURN",
+	OP_DROP:                "OP_DROP",
+	OP_DUP:                 "OP_DUP",
+	OP_EQUAL:               "OP_EQUAL",
+	OP_EQUALVERIFY:         "OP_EQUALVERIFY",
+	OP_SHA256:              "OP_SHA256",
+	OP_HASH160:             "OP_HASH160",
+	OP_HASH256:             "OP_HASH256",
+	OP_CHECKSIG:            "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY:      "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+	OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+// SignatureChecker fournit au moteur de script les vérifications qui dépendent de la transaction
+type SignatureChecker interface {
+	CheckSig(sig, pubKey, subscript []byte) bool
+	CheckLockTime(lockTime int64) bool
+	CheckSequence(sequence int64) bool
+}
+
+// instruction représente un opcode décodé avec ses éventuelles données
+type instruction struct {
+	Op   byte
+	Data []byte
+}
+
+// isPush indique si l'instruction se contente de pousser une valeur sur la pile
+func (ins instruction) isPush() bool {
+	return ins.Op <= OP_16
+}
+
+// parseScript découpe un script en instructions
+func parseScript(script []byte) ([]instruction, error) {
+	var instructions []instruction
+
+	for i := 0; i < len(script); {
+		op := script[i]
+		i++
+
+		var size int
+		switch {
+		case op > OP_0 && op < OP_PUSHDATA1:
+			size = int(op)
+		case op == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, errors.New("script: truncated OP_PUSHDATA1")
+			}
+			size = int(script[i])
+			i++
+		case op == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, errors.New("script: truncated OP_PUSHDATA2")
+			}
+			size = int(binary.LittleEndian.Uint16(script[i : i+2]))
+			i += 2
+		default:
+			instructions = append(instructions, instruction{Op: op})
+			continue
+		}
+
+		if i+size > len(script) {
+			return nil, errors.New("script: push past end of script")
+		}
+		instructions = append(instructions, instruction{op, script[i : i+size]})
+		i += size
+	}
+
+	return instructions, nil
+}
+
+// PushData construit l'instruction qui pousse data sur la pile
+func PushData(data []byte) []byte {
+	var script []byte
+
+	switch {
+	case len(data) == 0:
+		script = []byte{OP_0}
+	case len(data) < int(OP_PUSHDATA1):
+		script = []byte{byte(len(data))}
+	case len(data) <= 0xff:
+		script = []byte{OP_PUSHDATA1, byte(len(data))}
+	default:
+		script = []byte{OP_PUSHDATA2, 0, 0}
+		binary.LittleEndian.PutUint16(script[1:], uint16(len(data)))
+	}
+
+	return append(script, data...)
+}
+
+// PushInt construit l'instruction qui pousse l'entier n sur la pile
+func PushInt(n int64) []byte {
+	switch {
+	case n == 0:
+		return []byte{OP_0}
+	case n == -1:
+		return []byte{OP_1NEGATE}
+	case n >= 1 && n <= 16:
+		return []byte{OP_1 + byte(n-1)}
+	}
+
+	return PushData(encodeScriptNum(n))
+}
+
+// encodeScriptNum encode un entier au format minimal petit-boutiste signé des scripts
+func encodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+
+	negative := n < 0
+	abs := uint64(n)
+	if negative {
+		abs = uint64(-n)
+	}
+
+	var result []byte
+	for abs > 0 {
+		result = append(result, byte(abs&0xff))
+		abs >>= 8
+	}
+
+	if result[len(result)-1]&0x80 != 0 {
+		if negative {
+			result = append(result, 0x80)
+		} else {
+			result = append(result, 0x00)
+		}
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+
+	return result
+}
+
+// decodeScriptNum décode un entier de script en refusant les encodages non minimaux
+func decodeScriptNum(data []byte, maxLen int) (int64, error) {
+	if len(data) > maxLen {
+		return 0, fmt.Errorf("script: number is %d bytes, max %d", len(data), maxLen)
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if data[len(data)-1]&0x7f == 0 {
+		if len(data) == 1 || data[len(data)-2]&0x80 == 0 {
+			return 0, errors.New("script: non-minimal number encoding")
+		}
+	}
+
+	var result int64
+	for i, b := range data {
+		result |= int64(b) << uint(8*i)
+	}
+
+	if data[len(data)-1]&0x80 != 0 {
+		result &= ^(int64(0x80) << uint(8*(len(data)-1)))
+		return -result, nil
+	}
+
+	return result, nil
+}
+
+// castToBool interprète un élément de pile comme un booléen
+func castToBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			// Un zéro négatif (0x80 en dernier octet) reste faux
+			if i == len(data)-1 && b == 0x80 {
+				return false
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// scriptStack est la pile de travail de l'interpréteur
+type scriptStack struct {
+	items [][]byte
+}
+
+func (s *scriptStack) push(data []byte) error {
+	if len(s.items) >= MaxStackSize {
+		return errors.New("script: stack size limit exceeded")
+	}
+	s.items = append(s.items, data)
+	return nil
+}
+
+func (s *scriptStack) pop() ([]byte, error) {
+	if len(s.items) == 0 {
+		return nil, errors.New("script: pop from empty stack")
+	}
+	top := s.items[len(s.items)-1]
+	s.items = s.items[:len(s.items)-1]
+	return top, nil
+}
+
+func (s *scriptStack) peek() ([]byte, error) {
+	if len(s.items) == 0 {
+		return nil, errors.New("script: peek at empty stack")
+	}
+	return s.items[len(s.items)-1], nil
+}
+
+func (s *scriptStack) popInt(maxLen int) (int64, error) {
+	data, err := s.pop()
+	if err != nil {
+		return 0, err
+	}
+	return decodeScriptNum(data, maxLen)
+}
+
+func (s *scriptStack) pushBool(v bool) error {
+	if v {
+		return s.push([]byte{1})
+	}
+	return s.push(nil)
+}
+
+// ExecuteScripts exécute le script de déverrouillage puis le script de verrouillage
+// Retourne une erreur si les conditions de dépense ne sont pas satisfaites
+func ExecuteScripts(scriptSig, scriptPubKey []byte, checker SignatureChecker) error {
+	sigInstructions, err := parseScript(scriptSig)
+	if err != nil {
+		return err
+	}
+	for _, ins := range sigInstructions {
+		if !ins.isPush() {
+			return errors.New("script: unlocking script must be push-only")
+		}
+	}
+
+	stack := &scriptStack{}
+	if err := executeScript(scriptSig, stack, checker); err != nil {
+		return err
+	}
+	if err := executeScript(scriptPubKey, stack, checker); err != nil {
+		return err
+	}
+
+	top, err := stack.peek()
+	if err != nil {
+		return errors.New("script: empty stack after execution")
+	}
+	if !castToBool(top) {
+		return errors.New("script: evaluated to false")
+	}
+
+	return nil
+}
+
+// executeScript exécute un script unique sur la pile donnée
+func executeScript(script []byte, stack *scriptStack, checker SignatureChecker) error {
+	if len(script) > MaxScriptSize {
+		return fmt.Errorf("script: size %d exceeds limit %d", len(script), MaxScriptSize)
+	}
+
+	instructions, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	opCount := 0
+	for _, ins := range instructions {
+		if len(ins.Data) > MaxScriptElementSize {
+			return errors.New("script: push exceeds element size limit")
+		}
+		if ins.Op > OP_16 {
+			opCount++
+			if opCount > MaxOpsPerScript {
+				return errors.New("script: operation limit exceeded")
+			}
+		}
+
+		if err := executeOpcode(ins, script, stack, checker); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// executeOpcode applique une instruction à la pile
+func executeOpcode(ins instruction, script []byte, stack *scriptStack, checker SignatureChecker) error {
+	switch op := ins.Op; {
+	case op == OP_0:
+		return stack.push(nil)
+
+	case op < OP_PUSHDATA1 || op == OP_PUSHDATA1 || op == OP_PUSHDATA2:
+		return stack.push(ins.Data)
+
+	case op == OP_1NEGATE:
+		return stack.push(encodeScriptNum(-1))
+
+	case op >= OP_1 && op <= OP_16:
+		return stack.push(encodeScriptNum(int64(op - OP_1 + 1)))
+
+	case op == OP_NOP:
+		return nil
+
+	case op == OP_VERIFY:
+		return verifyTop(stack, "OP_VERIFY")
+
+	case op == OP_RETURN:
+		return errors.New("script: OP_RETURN encountered")
+
+	case op == OP_DROP:
+		_, err := stack.pop()
+		return err
+
+	case op == OP_DUP:
+		top, err := stack.peek()
+		if err != nil {
+			return err
+		}
+		return stack.push(append([]byte{}, top...))
+
+	case op == OP_EQUAL || op == OP_EQUALVERIFY:
+		a, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		b, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		if err := stack.pushBool(bytes.Equal(a, b)); err != nil {
+			return err
+		}
+		if op == OP_EQUALVERIFY {
+			return verifyTop(stack, "OP_EQUALVERIFY")
+		}
+		return nil
+
+	case op == OP_SHA256 || op == OP_HASH160 || op == OP_HASH256:
+		data, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		var hash []byte
+		switch op {
+		case OP_SHA256:
+			sum := sha256.Sum256(data)
+			hash = sum[:]
+		case OP_HASH160:
+			hash = wallet.PublicKeyHash(data)
+		default:
+			first := sha256.Sum256(data)
+			second := sha256.Sum256(first[:])
+			hash = second[:]
+		}
+		return stack.push(hash)
+
+	case op == OP_CHECKSIG || op == OP_CHECKSIGVERIFY:
+		pubKey, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		sig, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		if err := stack.pushBool(checker.CheckSig(sig, pubKey, script)); err != nil {
+			return err
+		}
+		if op == OP_CHECKSIGVERIFY {
+			return verifyTop(stack, "OP_CHECKSIGVERIFY")
+		}
+		return nil
+
+	case op == OP_CHECKMULTISIG || op == OP_CHECKMULTISIGVERIFY:
+		ok, err := checkMultisig(stack, script, checker)
+		if err != nil {
+			return err
+		}
+		if err := stack.pushBool(ok); err != nil {
+			return err
+		}
+		if op == OP_CHECKMULTISIGVERIFY {
+			return verifyTop(stack, "OP_CHECKMULTISIGVERIFY")
+		}
+		return nil
+
+	case op == OP_CHECKLOCKTIMEVERIFY || op == OP_CHECKSEQUENCEVERIFY:
+		top, err := stack.peek()
+		if err != nil {
+			return err
+		}
+		n, err := decodeScriptNum(top, maxLockTimeNumLen)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return errors.New("script: negative timelock")
+		}
+		if op == OP_CHECKLOCKTIMEVERIFY && !checker.CheckLockTime(n) {
+			return errors.New("script: locktime requirement not satisfied")
+		}
+		if op == OP_CHECKSEQUENCEVERIFY && !checker.CheckSequence(n) {
+			return errors.New("script: sequence requirement not satisfied")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("script: unknown opcode 0x%02x", ins.Op)
+}
+
+// verifyTop retire le sommet de la pile et échoue s'il est faux
+func verifyTop(stack *scriptStack, name string) error {
+	top, err := stack.pop()
+	if err != nil {
+		return err
+	}
+	if !castToBool(top) {
+		return fmt.Errorf("script: %s failed", name)
+	}
+	return nil
+}
+
+// checkMultisig évalue OP_CHECKMULTISIG : <sig...> <m> <pubkey...> <n>
+// Les signatures doivent apparaître dans le même ordre que les clés
+func checkMultisig(stack *scriptStack, script []byte, checker SignatureChecker) (bool, error) {
+	n, err := stack.popInt(maxScriptNumLen)
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > MaxPubKeysPerMultisig {
+		return false, fmt.Errorf("script: invalid pubkey count %d", n)
+	}
+
+	pubKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if pubKeys[i], err = stack.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	m, err := stack.popInt(maxScriptNumLen)
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, fmt.Errorf("script: invalid signature count %d", m)
+	}
+
+	sigs := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		if sigs[i], err = stack.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	keyIdx := 0
+	for _, sig := range sigs {
+		for keyIdx < len(pubKeys) && !checker.CheckSig(sig, pubKeys[keyIdx], script) {
+			keyIdx++
+		}
+		if keyIdx == len(pubKeys) {
+			return false, nil
+		}
+		keyIdx++
+	}
+
+	return true, nil
+}
+
+// P2PKHScript construit le script standard de paiement à un hash de clé publique
+func P2PKHScript(pubKeyHash []byte) []byte {
+	script := []byte{OP_DUP, OP_HASH160}
+	script = append(script, PushData(pubKeyHash)...)
+	return append(script, OP_EQUALVERIFY, OP_CHECKSIG)
+}
+
+// P2PKHSigScript construit le script de déverrouillage d'une sortie P2PKH
+func P2PKHSigScript(sig, pubKey []byte) []byte {
+	return append(PushData(sig), PushData(pubKey)...)
+}
+
+// MultisigScript construit un script m-parmi-n
+func MultisigScript(m int, pubKeys [][]byte) []byte {
+	script := PushInt(int64(m))
+	for _, pubKey := range pubKeys {
+		script = append(script, PushData(pubKey)...)
+	}
+	script = append(script, PushInt(int64(len(pubKeys)))...)
+	return append(script, OP_CHECKMULTISIG)
+}
+
+// MultisigSigScript construit le script de déverrouillage d'une sortie multisig
+func MultisigSigScript(sigs [][]byte) []byte {
+	var script []byte
+	for _, sig := range sigs {
+		script = append(script, PushData(sig)...)
+	}
+	return script
+}
+
+// NullDataScript construit un script OP_RETURN <data>, prouvablement non dépensable
+func NullDataScript(data []byte) []byte {
+	return append([]byte{OP_RETURN}, PushData(data)...)
+}
+
+// ExtractNullData retourne les données d'un script OP_RETURN <data>
+func ExtractNullData(script []byte) ([]byte, bool) {
+	if len(script) == 0 || script[0] != OP_RETURN {
+		return nil, false
+	}
+
+	instructions, err := parseScript(script[1:])
+	if err != nil || len(instructions) > 1 {
+		return nil, false
+	}
+	if len(instructions) == 0 {
+		return []byte{}, true
+	}
+	if !instructions[0].isPush() {
+		return nil, false
+	}
+
+	return instructions[0].Data, true
+}
+
+// IsUnspendable indique si aucun script de déverrouillage ne peut satisfaire ce script
+func IsUnspendable(script []byte) bool {
+	return (len(script) > 0 && script[0] == OP_RETURN) || len(script) > MaxScriptSize
+}
+
+// ExtractPubKeyHash retourne le hash de clé publique d'un script P2PKH, ou nil
+func ExtractPubKeyHash(script []byte) []byte {
+	instructions, err := parseScript(script)
+	if err != nil || len(instructions) != 5 {
+		return nil
+	}
+
+	if instructions[0].Op != OP_DUP || instructions[1].Op != OP_HASH160 ||
+		len(instructions[2].Data) != 20 || instructions[3].Op != OP_EQUALVERIFY ||
+		instructions[4].Op != OP_CHECKSIG {
+		return nil
+	}
+
+	return instructions[2].Data
+}
+
+// DisassembleScript retourne une représentation lisible d'un script
+func DisassembleScript(script []byte) string {
+	instructions, err := parseScript(script)
+	if err != nil {
+		return fmt.Sprintf("[invalid script %x]", script)
+	}
+
+	var parts []string
+	for _, ins := range instructions {
+		switch {
+		case ins.Data != nil:
+			parts = append(parts, fmt.Sprintf("%x", ins.Data))
+		case ins.Op >= OP_1 && ins.Op <= OP_16:
+			parts = append(parts, fmt.Sprintf("OP_%d", ins.Op-OP_1+1))
+		case opcodeNames[ins.Op] != "":
+			parts = append(parts, opcodeNames[ins.Op])
+		default:
+			parts = append(parts, fmt.Sprintf("OP_UNKNOWN_0x%02x", ins.Op))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// EncodeSignature encode une signature ECDSA sur 64 octets (r || s)
+func EncodeSignature(r, s *big.Int) []byte {
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return sig
+}
+
+// verifySignature vérifie une signature encodée avec EncodeSignature
+func verifySignature(sig, pubKey, hash []byte) bool {
+	if len(sig) != 64 || len(pubKey) == 0 || len(pubKey)%2 != 0 {
+		return false
+	}
+
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+
+	keyLen := len(pubKey)
+	x := new(big.Int).SetBytes(pubKey[:(keyLen / 2)])
+	y := new(big.Int).SetBytes(pubKey[(keyLen / 2):])
+
+	curve := elliptic.P256()
+	if !curve.IsOnCurve(x, y) {
+		return false
+	}
+
+	rawPubKey := ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	return ecdsa.Verify(&rawPubKey, hash, r, s)
+}
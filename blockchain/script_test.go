@@ -0,0 +1,172 @@
+package blockchain
+
+import (
+	"blockchain-go/wallet"
+	"bytes"
+	"testing"
+)
+
+// spendingTx crée une transaction à une entrée, avec la séquence et le locktime donnés
+func spendingTx(sequence uint32, lockTime int64) *Transaction {
+	return &Transaction{
+		ID:       []byte("spending"),
+		Inputs:   []TXInput{{ID: []byte("funding"), Out: 0, Sequence: sequence}},
+		Outputs:  []TXOutput{{Value: 1, ScriptPubKey: NullDataScript(nil)}},
+		LockTime: lockTime,
+	}
+}
+
+// TestExecuteScripts exécute des scripts de déverrouillage contre des scripts de verrouillage
+// standards, signés avec de vraies clés
+func TestExecuteScripts(t *testing.T) {
+	alice, bob, carol := wallet.MakeWallet(), wallet.MakeWallet(), wallet.MakeWallet()
+	p2pkh := P2PKHScript(wallet.PublicKeyHash(alice.PublicKey))
+	multisig := MultisigScript(2, [][]byte{alice.PublicKey, bob.PublicKey, carol.PublicKey})
+	cltv := append(PushInt(100), OP_CHECKLOCKTIMEVERIFY)
+	csv := append(PushInt(10), OP_CHECKSEQUENCEVERIFY)
+
+	tests := []struct {
+		name         string
+		tx           *Transaction
+		scriptPubKey []byte
+		scriptSig    func(tx *Transaction) []byte
+		valid        bool
+	}{
+		{
+			name: "p2pkh", tx: spendingTx(SequenceFinal, 0), scriptPubKey: p2pkh,
+			scriptSig: func(tx *Transaction) []byte {
+				return P2PKHSigScript(tx.SignInput(0, alice.PrivateKey, p2pkh), alice.PublicKey)
+			},
+			valid: true,
+		},
+		{
+			name: "p2pkh with another key", tx: spendingTx(SequenceFinal, 0), scriptPubKey: p2pkh,
+			scriptSig: func(tx *Transaction) []byte {
+				return P2PKHSigScript(tx.SignInput(0, bob.PrivateKey, p2pkh), bob.PublicKey)
+			},
+		},
+		{
+			name: "p2pkh signed by another key", tx: spendingTx(SequenceFinal, 0), scriptPubKey: p2pkh,
+			scriptSig: func(tx *Transaction) []byte {
+				return P2PKHSigScript(tx.SignInput(0, bob.PrivateKey, p2pkh), alice.PublicKey)
+			},
+		},
+		{
+			name: "p2pkh with an operation in the unlocking script", tx: spendingTx(SequenceFinal, 0), scriptPubKey: p2pkh,
+			scriptSig: func(tx *Transaction) []byte {
+				sig := P2PKHSigScript(tx.SignInput(0, alice.PrivateKey, p2pkh), alice.PublicKey)
+				return append(sig, OP_DUP, OP_DROP)
+			},
+		},
+		{
+			name: "multisig 2 of 3", tx: spendingTx(SequenceFinal, 0), scriptPubKey: multisig,
+			scriptSig: func(tx *Transaction) []byte {
+				return MultisigSigScript([][]byte{
+					tx.SignInput(0, alice.PrivateKey, multisig),
+					tx.SignInput(0, carol.PrivateKey, multisig),
+				})
+			},
+			valid: true,
+		},
+		{
+			name: "multisig with signatures out of order", tx: spendingTx(SequenceFinal, 0), scriptPubKey: multisig,
+			scriptSig: func(tx *Transaction) []byte {
+				return MultisigSigScript([][]byte{
+					tx.SignInput(0, carol.PrivateKey, multisig),
+					tx.SignInput(0, alice.PrivateKey, multisig),
+				})
+			},
+		},
+		{
+			name: "multisig with the same signature twice", tx: spendingTx(SequenceFinal, 0), scriptPubKey: multisig,
+			scriptSig: func(tx *Transaction) []byte {
+				sig := tx.SignInput(0, bob.PrivateKey, multisig)
+				return MultisigSigScript([][]byte{sig, sig})
+			},
+		},
+		{
+			name: "multisig with one signature", tx: spendingTx(SequenceFinal, 0), scriptPubKey: multisig,
+			scriptSig: func(tx *Transaction) []byte {
+				return MultisigSigScript([][]byte{tx.SignInput(0, alice.PrivateKey, multisig)})
+			},
+		},
+		{
+			name: "cltv at the locktime", tx: spendingTx(0, 100), scriptPubKey: cltv,
+			scriptSig: func(*Transaction) []byte { return nil }, valid: true,
+		},
+		{
+			name: "cltv before the locktime", tx: spendingTx(0, 99), scriptPubKey: cltv,
+			scriptSig: func(*Transaction) []byte { return nil },
+		},
+		{
+			name: "cltv with a timestamp locktime", tx: spendingTx(0, LockTimeThreshold+100), scriptPubKey: cltv,
+			scriptSig: func(*Transaction) []byte { return nil },
+		},
+		{
+			name: "cltv with a final input", tx: spendingTx(SequenceFinal, 100), scriptPubKey: cltv,
+			scriptSig: func(*Transaction) []byte { return nil },
+		},
+		{
+			name: "csv at the sequence", tx: spendingTx(10, 0), scriptPubKey: csv,
+			scriptSig: func(*Transaction) []byte { return nil }, valid: true,
+		},
+		{
+			name: "csv before the sequence", tx: spendingTx(9, 0), scriptPubKey: csv,
+			scriptSig: func(*Transaction) []byte { return nil },
+		},
+		{
+			name: "csv with a time sequence", tx: spendingTx(SequenceLockTimeTypeFlag|10, 0), scriptPubKey: csv,
+			scriptSig: func(*Transaction) []byte { return nil },
+		},
+		{
+			name: "csv with a disabled sequence", tx: spendingTx(SequenceLockTimeDisableFlag|10, 0), scriptPubKey: csv,
+			scriptSig: func(*Transaction) []byte { return nil },
+		},
+		{
+			name: "op_return", tx: spendingTx(SequenceFinal, 0), scriptPubKey: NullDataScript([]byte("data")),
+			scriptSig: func(*Transaction) []byte { return PushInt(1) },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ExecuteScripts(test.scriptSig(test.tx), test.scriptPubKey, &TxSigChecker{test.tx, 0})
+			if test.valid && err != nil {
+				t.Fatalf("script rejected: %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatal("script accepted")
+			}
+		})
+	}
+}
+
+// TestNullData vérifie qu'un output OP_RETURN est non dépensable et rend ses données
+func TestNullData(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"short", []byte("hello")},
+		{"standard size", bytes.Repeat([]byte{0xab}, MaxNullDataSize)},
+		{"pushdata2", bytes.Repeat([]byte{0xcd}, 300)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			script := NullDataScript(test.data)
+			if !IsUnspendable(script) {
+				t.Fatal("OP_RETURN script is spendable")
+			}
+			data, ok := ExtractNullData(script)
+			if !ok || !bytes.Equal(data, test.data) {
+				t.Fatalf("extracted %x, %v, want %x", data, ok, test.data)
+			}
+		})
+	}
+
+	if _, ok := ExtractNullData(P2PKHScript(make([]byte, 20))); ok {
+		t.Fatal("P2PKH script read as OP_RETURN")
+	}
+}
@@ -0,0 +1,162 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+
+	"github.com/dgraph-io/badger"
+)
+
+var sharePrefix = []byte("share-") // Prefix for the mining pool's worker accounts in the database
+
+// ShareAccount compte les parts (shares) valides soumises par un worker du pool
+// Les parts du tour en cours, pas encore payées, répartissent la récompense du prochain bloc trouvé par le pool
+type ShareAccount struct {
+	Worker      string
+	Address     string // Payout address of the worker
+	RoundShares uint64 // Shares not yet paid by a block found by the pool
+	TotalShares uint64 // Shares since the worker joined the pool
+	Blocks      int    // Blocks found by the worker
+}
+
+// Serialize sérialise un compte de worker en bytes
+func (a *ShareAccount) Serialize() []byte {
+	var encoded bytes.Buffer
+
+	err := gob.NewEncoder(&encoded).Encode(a)
+	Handle(err)
+
+	return encoded.Bytes()
+}
+
+// DeserializeShareAccount désérialise des bytes en compte de worker
+func DeserializeShareAccount(data []byte) ShareAccount {
+	var account ShareAccount
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&account)
+	Handle(err)
+
+	return account
+}
+
+// AddShare crédite une part valide au worker, et un bloc si la part en était un
+func (chain *BlockChain) AddShare(worker, address string, foundBlock bool) {
+	key := append(append([]byte{}, sharePrefix...), worker...)
+
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		account := ShareAccount{Worker: worker}
+
+		item, err := txn.Get(key)
+		if err == nil {
+			err = item.Value(func(val []byte) error {
+				account = DeserializeShareAccount(val)
+				return nil
+			})
+			Handle(err)
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		account.Address = address
+		account.RoundShares++
+		account.TotalShares++
+		if foundBlock {
+			account.Blocks++
+		}
+
+		return txn.Set(key, account.Serialize())
+	})
+	Handle(err)
+}
+
+// ShareAccounts retourne les comptes de tous les workers du pool, triés par nom
+func (chain *BlockChain) ShareAccounts() []ShareAccount {
+	var accounts []ShareAccount
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(sharePrefix); it.ValidForPrefix(sharePrefix); it.Next() {
+			err := it.Item().Value(func(val []byte) error {
+				accounts = append(accounts, DeserializeShareAccount(val))
+				return nil
+			})
+			Handle(err)
+		}
+		return nil
+	})
+	Handle(err)
+
+	return accounts
+}
+
+// SettleShares retire du tour en cours les parts payées par le coinbase d'un bloc trouvé par le pool
+// paid est l'état des comptes au moment où le travail du bloc a été construit : les parts
+// soumises depuis restent dans le tour et seront payées par un prochain bloc
+func (chain *BlockChain) SettleShares(paid []ShareAccount) {
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		for _, settled := range paid {
+			key := append(append([]byte{}, sharePrefix...), settled.Worker...)
+			item, err := txn.Get(key)
+			if err != nil {
+				return err
+			}
+
+			var account ShareAccount
+			err = item.Value(func(val []byte) error {
+				account = DeserializeShareAccount(val)
+				return nil
+			})
+			Handle(err)
+
+			if account.RoundShares > settled.RoundShares {
+				account.RoundShares -= settled.RoundShares
+			} else {
+				account.RoundShares = 0
+			}
+			if err := txn.Set(key, account.Serialize()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	Handle(err)
+}
+
+// PoolPayouts répartit reward entre les adresses des workers, proportionnellement à leurs parts
+// du tour en cours. Les restes des divisions, ou toute la récompense si aucune part n'a été
+// soumise, reviennent à l'opérateur du pool
+func PoolPayouts(accounts []ShareAccount, reward int, operator string) []TXOutput {
+	shares := make(map[string]uint64)
+	var total uint64
+	for _, account := range accounts {
+		shares[account.Address] += account.RoundShares
+		total += account.RoundShares
+	}
+
+	var addresses []string
+	for address, count := range shares {
+		if count > 0 {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+
+	var outputs []TXOutput
+	paid := 0
+	for _, address := range addresses {
+		value := int(uint64(reward) * shares[address] / total)
+		if value == 0 {
+			continue
+		}
+		outputs = append(outputs, *NewTXOutput(value, address))
+		paid += value
+	}
+	if reward > paid {
+		outputs = append(outputs, *NewTXOutput(reward-paid, operator))
+	}
+
+	return outputs
+}
@@ -0,0 +1,57 @@
+package blockchain
+
+import "bytes"
+
+// MaxHeadersPerMessage limite le nombre d'en-têtes envoyés en une réponse
+const MaxHeadersPerMessage = 2000
+
+// GetHeadersAfter retourne, du plus ancien au plus récent, les en-têtes de la chaîne principale
+// qui suivent le bloc fromHash. Si fromHash n'est pas dans la chaîne principale, la liste part du genesis
+func (chain *BlockChain) GetHeadersAfter(fromHash []byte) []BlockHeader {
+	var headers []BlockHeader
+
+	// Les en-têtes sont parcourus plutôt que les blocs : une chaîne élaguée ou chargée depuis un
+	// snapshot n'a que les en-têtes sous sa base
+	hash := chain.LastHash()
+	for len(hash) > 0 {
+		if len(fromHash) > 0 && bytes.Equal(hash, fromHash) {
+			break
+		}
+		header, err := chain.GetHeader(hash)
+		Handle(err)
+		headers = append(headers, header)
+
+		hash = header.PrevHash
+	}
+
+	for i, j := 0, len(headers)-1; i < j; i, j = i+1, j-1 {
+		headers[i], headers[j] = headers[j], headers[i]
+	}
+
+	if len(headers) > MaxHeadersPerMessage {
+		headers = headers[:MaxHeadersPerMessage]
+	}
+
+	return headers
+}
+
+// touchesKeys indique si une transaction concerne l'un des hashes de clé publique donnés
+func (tx *Transaction) touchesKeys(pubKeyHashes [][]byte) bool {
+	for _, pubKeyHash := range pubKeyHashes {
+		for _, out := range tx.Outputs {
+			if out.isLockedWithKey(pubKeyHash) {
+				return true
+			}
+		}
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			if in.UsesKey(pubKeyHash) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,165 @@
+package blockchain
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	LockTimeThreshold           = 500000000   // En dessous : hauteur de bloc, au dessus : timestamp Unix
+	SequenceFinal               = 0xffffffff  // Séquence d'une entrée sans verrou
+	SequenceLockTimeDisableFlag = 1 << 31     // Désactive le verrou relatif de l'entrée
+	SequenceLockTimeTypeFlag    = 1 << 22     // Verrou relatif exprimé en temps plutôt qu'en blocs
+	SequenceLockTimeMask        = 0x0000ffff  // Valeur du verrou relatif
+	SequenceLockTimeGranularity = 9           // Les verrous en temps comptent par tranches de 512 secondes
+	MedianTimeSpan              = 11          // Nombre de blocs utilisés pour le temps médian
+	MaxFutureBlockTime          = 2 * 60 * 60 // Avance maximale, en secondes, d'un bloc sur l'heure locale
+)
+
+// SequenceLock représente la hauteur et le temps médian qu'un bloc doit strictement dépasser
+// pour pouvoir inclure une transaction dont les entrées portent des verrous relatifs
+type SequenceLock struct {
+	MinHeight int
+	MinTime   int64
+}
+
+// Satisfied vérifie si un bloc de hauteur height et de temps médian mtp respecte le verrou
+func (lock SequenceLock) Satisfied(height int, mtp int64) bool {
+	return lock.MinHeight < height && lock.MinTime < mtp
+}
+
+// IsFinal vérifie si une transaction peut être incluse dans un bloc de hauteur et de temps donnés
+func (tx *Transaction) IsFinal(height int, blockTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+
+	target := int64(height)
+	if tx.LockTime >= LockTimeThreshold {
+		target = blockTime
+	}
+	if tx.LockTime < target {
+		return true
+	}
+
+	// Toutes les entrées finales désactivent le locktime
+	for _, in := range tx.Inputs {
+		if in.Sequence != SequenceFinal {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkFutureTime refuse un horodatage trop en avance sur l'heure locale : sans cette borne, des
+// mineurs pourraient pousser le temps médian dans le futur et libérer trop tôt les verrous en temps
+func checkFutureTime(timestamp int64) error {
+	if limit := time.Now().Unix() + MaxFutureBlockTime; timestamp > limit {
+		return fmt.Errorf("timestamp %d is more than %d seconds ahead of the local time", timestamp, MaxFutureBlockTime)
+	}
+
+	return nil
+}
+
+// MedianTimePast retourne la médiane des timestamps du bloc donné et de ses prédécesseurs
+func (chain *BlockChain) MedianTimePast(hash []byte) int64 {
+	return medianTimePast(hash, chain.GetHeader)
+}
+
+// medianTimePast calcule le temps médian en remontant les en-têtes fournis par getHeader
+func medianTimePast(hash []byte, getHeader func([]byte) (BlockHeader, error)) int64 {
+	var timestamps []int64
+
+	for len(hash) > 0 && len(timestamps) < MedianTimeSpan {
+		header, err := getHeader(hash)
+		if err != nil {
+			break
+		}
+		timestamps = append(timestamps, header.Timestamp)
+		hash = header.PrevHash
+	}
+
+	if len(timestamps) == 0 {
+		return 0
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2]
+}
+
+// calculateSequenceLock calcule le verrou relatif imposé par les entrées d'une transaction d'un
+// bloc construit sur prevHash. prevHeights donne la hauteur du bloc de la sortie dépensée par
+// chaque entrée
+func (chain *BlockChain) calculateSequenceLock(tx *Transaction, prevHash []byte, prevHeights []int) (SequenceLock, error) {
+	lock := SequenceLock{-1, -1}
+
+	if tx.IsCoinbase() {
+		return lock, nil
+	}
+
+	for i, in := range tx.Inputs {
+		if in.Sequence&SequenceLockTimeDisableFlag != 0 {
+			continue
+		}
+
+		value := int64(in.Sequence & SequenceLockTimeMask)
+
+		if in.Sequence&SequenceLockTimeTypeFlag != 0 {
+			// Le temps part du temps médian du bloc précédant celui de la sortie dépensée
+			start, err := chain.ancestorAtHeight(prevHash, max(prevHeights[i]-1, 0))
+			if err != nil {
+				return lock, err
+			}
+			minTime := chain.MedianTimePast(start.Hash) + value<<SequenceLockTimeGranularity - 1
+			if minTime > lock.MinTime {
+				lock.MinTime = minTime
+			}
+		} else {
+			minHeight := prevHeights[i] + int(value) - 1
+			if minHeight > lock.MinHeight {
+				lock.MinHeight = minHeight
+			}
+		}
+	}
+
+	return lock, nil
+}
+
+// checkTransactionLocks vérifie le locktime et les verrous relatifs d'une transaction
+// pour une inclusion dans un bloc de hauteur height construit sur prevHash
+func (chain *BlockChain) checkTransactionLocks(tx *Transaction, height int, prevHash []byte, prevHeights []int) error {
+	mtp := chain.MedianTimePast(prevHash)
+
+	if !tx.IsFinal(height, mtp) {
+		return fmt.Errorf("transaction %x is not final (locktime %d)", tx.ID, tx.LockTime)
+	}
+
+	lock, err := chain.calculateSequenceLock(tx, prevHash, prevHeights)
+	if err != nil {
+		return err
+	}
+	if !lock.Satisfied(height, mtp) {
+		return fmt.Errorf("transaction %x has unsatisfied relative locks", tx.ID)
+	}
+
+	return nil
+}
+
+// CheckLocksForNextBlock vérifie si une transaction pourrait entrer dans le prochain bloc
+func (chain *BlockChain) CheckLocksForNextBlock(tx *Transaction) error {
+	prevHeights := make([]int, len(tx.Inputs))
+	if !tx.IsCoinbase() {
+		for i, in := range tx.Inputs {
+			_, outs, err := chain.findSpentTransaction(in)
+			if err != nil {
+				return err
+			}
+			prevHeights[i] = outs.Height
+		}
+	}
+
+	return chain.checkTransactionLocks(tx, chain.GetBestHeight()+1, chain.LastHash(), prevHeights)
+}
@@ -4,22 +4,22 @@ import (
 	"blockchain-go/wallet"
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"log"
-	"math/big"
 	"strings"
 )
 
 // Transaction représente une transaction dans la blockchain
 type Transaction struct {
-	ID      []byte     // Unique identifier of the transaction
-	Inputs  []TXInput  // List of transaction inputs
-	Outputs []TXOutput // List of transaction outputs
+	ID       []byte     // Unique identifier of the transaction
+	Inputs   []TXInput  // List of transaction inputs
+	Outputs  []TXOutput // List of transaction outputs
+	LockTime int64      // Height or Unix time before which the transaction cannot be mined
 }
 
 // Serialize sérialise une transaction en bytes
@@ -44,19 +44,56 @@ func DeserializeTransaction(data []byte) Transaction {
 }
 
 // Hash calcule le hash SHA256 d'une transaction
+// Le hash porte sur un encodage canonique : l'encodage gob dépend de l'ordre dans lequel
+// chaque processus enregistre ses types et ne donnerait pas le même ID sur tous les nœuds
 func (tx *Transaction) Hash() []byte {
-	var hash [32]byte
+	hash := sha256.Sum256(tx.hashData())
 
-	txCopy := *tx
-	txCopy.ID = []byte{} // Set ID to nil to avoid hashing it again
+	return hash[:]
+}
 
-	hash = sha256.Sum256(txCopy.Serialize())
+// hashData encode les champs d'une transaction, hors ID, dans un ordre fixe
+func (tx *Transaction) hashData() []byte {
+	var data bytes.Buffer
 
-	return hash[:]
+	writeInt := func(v int64) {
+		binary.Write(&data, binary.BigEndian, v)
+	}
+	writeBytes := func(b []byte) {
+		writeInt(int64(len(b)))
+		data.Write(b)
+	}
+
+	writeInt(int64(len(tx.Inputs)))
+	for _, in := range tx.Inputs {
+		writeBytes(in.ID)
+		writeInt(int64(in.Out))
+		writeBytes(in.ScriptSig)
+		writeInt(int64(in.Sequence))
+	}
+
+	writeInt(int64(len(tx.Outputs)))
+	for _, out := range tx.Outputs {
+		writeInt(int64(out.Value))
+		writeBytes(out.ScriptPubKey)
+	}
+
+	writeInt(tx.LockTime)
+
+	return data.Bytes()
 }
 
+// Subsidy est la récompense de minage créée par chaque bloc, hors frais
+const Subsidy = 20
+
 // CoinbaseTx crée une transaction coinbase (récompense de minage)
-func CoinbaseTx(to, data string) *Transaction {
+// Le mineur reçoit la récompense du bloc plus les frais des transactions qu'il inclut
+func CoinbaseTx(to, data string, fees int) *Transaction {
+	return CoinbaseTxOutputs(data, []TXOutput{*NewTXOutput(Subsidy+fees, to)})
+}
+
+// CoinbaseTxOutputs crée une transaction coinbase qui répartit la récompense entre plusieurs sorties
+func CoinbaseTxOutputs(data string, outputs []TXOutput) *Transaction {
 	if data == "" {
 		randData := make([]byte, 24)
 		_, err := rand.Read(randData)
@@ -64,9 +101,8 @@ func CoinbaseTx(to, data string) *Transaction {
 		data = fmt.Sprintf("%x", randData)
 	}
 
-	txIn := TXInput{[]byte{}, -1, nil, []byte(data)}
-	txOut := NewTXOutput(20, to)
-	tx := Transaction{nil, []TXInput{txIn}, []TXOutput{*txOut}}
+	txIn := TXInput{[]byte{}, -1, PushData([]byte(data)), SequenceFinal}
+	tx := Transaction{nil, []TXInput{txIn}, outputs, 0}
 	tx.ID = tx.Hash()
 
 	return &tx
@@ -78,6 +114,7 @@ func (tx *Transaction) IsCoinbase() bool {
 }
 
 // Sign signe les entrées d'une transaction avec la clé privée donnée
+// Chaque entrée reçoit un script de déverrouillage P2PKH <signature> <clé publique>
 func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
 	if tx.IsCoinbase() {
 		return
@@ -89,42 +126,54 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 		}
 	}
 
-	txCopy := tx.TrimmedCopy()
+	pubKey := append(privKey.PublicKey.X.Bytes(), privKey.PublicKey.Y.Bytes()...)
 
-	for inId, in := range txCopy.Inputs {
+	for inId, in := range tx.Inputs {
 		prevTx := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inId].PubKey = nil
+		subscript := prevTx.Outputs[in.Out].ScriptPubKey
 
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
-		Handle(err)
-		signature := append(r.Bytes(), s.Bytes()...)
-
-		tx.Inputs[inId].Signature = signature
+		signature := tx.SignInput(inId, privKey, subscript)
+		tx.Inputs[inId].ScriptSig = P2PKHSigScript(signature, pubKey)
 	}
 }
 
-// TrimmedCopy crée une copie de la transaction sans les signatures pour la signature
+// SignInput produit la signature d'une entrée pour le script de verrouillage donné
+// Utile pour construire des scripts de déverrouillage non standards (multisig...)
+func (tx *Transaction) SignInput(inId int, privKey ecdsa.PrivateKey, subscript []byte) []byte {
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, tx.SigHash(inId, subscript))
+	Handle(err)
+
+	return EncodeSignature(r, s)
+}
+
+// SigHash calcule le hash signé pour une entrée : la copie allégée de la transaction
+// dans laquelle seule cette entrée porte le script de verrouillage qu'elle dépense
+func (tx *Transaction) SigHash(inId int, subscript []byte) []byte {
+	txCopy := tx.TrimmedCopy()
+	txCopy.Inputs[inId].ScriptSig = subscript
+
+	return txCopy.Hash()
+}
+
+// TrimmedCopy crée une copie de la transaction sans les scripts de déverrouillage pour la signature
 func (tx *Transaction) TrimmedCopy() Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
 
 	for _, in := range tx.Inputs {
-		inputs = append(inputs, TXInput{in.ID, in.Out, nil, nil})
+		inputs = append(inputs, TXInput{in.ID, in.Out, nil, in.Sequence})
 	}
 
 	for _, out := range tx.Outputs {
-		outputs = append(outputs, TXOutput{out.Value, out.PubKeyHash})
+		outputs = append(outputs, TXOutput{out.Value, out.ScriptPubKey})
 	}
 
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.LockTime}
 
 	return txCopy
 }
 
-// Verify vérifie les signatures d'une transaction
+// Verify exécute les scripts de chaque entrée contre la sortie qu'elle dépense
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	if tx.IsCoinbase() {
 		return true
@@ -136,30 +185,15 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		}
 	}
 
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
-
 	for inId, in := range tx.Inputs {
 		prevTx := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inId].PubKey = nil
-
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(in.Signature)
-		r.SetBytes(in.Signature[:(sigLen / 2)])
-		s.SetBytes(in.Signature[(sigLen / 2):])
-
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(in.PubKey)
-		x.SetBytes(in.PubKey[:(keyLen / 2)])
-		y.SetBytes(in.PubKey[(keyLen / 2):])
-
-		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		if !ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) {
+		if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+			return false
+		}
+
+		checker := &TxSigChecker{tx, inId}
+		if err := ExecuteScripts(in.ScriptSig, prevTx.Outputs[in.Out].ScriptPubKey, checker); err != nil {
+			fmt.Printf("Input %d of transaction %x rejected: %v\n", inId, tx.ID, err)
 			return false
 		}
 	}
@@ -167,61 +201,175 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	return true
 }
 
-// NewTransaction crée une nouvelle transaction normale
-func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Transaction {
+// TxSigChecker relie le moteur de script à l'entrée d'une transaction
+type TxSigChecker struct {
+	Tx    *Transaction // Transaction en cours de vérification
+	Input int          // Index de l'entrée dont on exécute les scripts
+}
+
+// CheckSig vérifie une signature sur le hash de l'entrée
+func (c *TxSigChecker) CheckSig(sig, pubKey, subscript []byte) bool {
+	return verifySignature(sig, pubKey, c.Tx.SigHash(c.Input, subscript))
+}
+
+// CheckLockTime vérifie une condition OP_CHECKLOCKTIMEVERIFY
+// Le locktime de la transaction doit être du même type et au moins égal à celui du script
+func (c *TxSigChecker) CheckLockTime(lockTime int64) bool {
+	txLockTime := c.Tx.LockTime
+	if (lockTime < LockTimeThreshold) != (txLockTime < LockTimeThreshold) {
+		return false
+	}
+	if lockTime > txLockTime {
+		return false
+	}
+
+	// Une entrée finale désactiverait le locktime de la transaction
+	return c.Tx.Inputs[c.Input].Sequence != SequenceFinal
+}
+
+// CheckSequence vérifie une condition OP_CHECKSEQUENCEVERIFY
+// La séquence de l'entrée doit imposer un verrou relatif au moins aussi long que celui du script
+func (c *TxSigChecker) CheckSequence(sequence int64) bool {
+	if sequence&SequenceLockTimeDisableFlag != 0 {
+		return true
+	}
+
+	txSequence := int64(c.Tx.Inputs[c.Input].Sequence)
+	if txSequence&SequenceLockTimeDisableFlag != 0 {
+		return false
+	}
+
+	mask := int64(SequenceLockTimeTypeFlag | SequenceLockTimeMask)
+	if (sequence & SequenceLockTimeTypeFlag) != (txSequence & SequenceLockTimeTypeFlag) {
+		return false
+	}
+
+	return sequence&mask <= txSequence&mask
+}
+
+// NewTransaction crée une nouvelle transaction normale qui laisse fee au mineur
+// Un lockTime non nul empêche la transaction d'être minée avant cette hauteur ou ce timestamp
+func NewTransaction(w *wallet.Wallet, to string, amount, fee int, lockTime int64, UTXO *UTXOSet) *Transaction {
+	outputs := []TXOutput{*NewTXOutput(amount, to)}
+
+	return buildTransaction(w, outputs, fee, lockTime, UTXO)
+}
+
+// NewDataTransaction crée une transaction qui ancre des données dans une sortie OP_RETURN
+// Au moins un output du wallet est dépensé et rendu en monnaie, hors frais
+func NewDataTransaction(w *wallet.Wallet, data []byte, fee int, UTXO *UTXOSet) *Transaction {
+	if len(data) > MaxNullDataSize {
+		log.Panicf("Error: data is %d bytes, max %d", len(data), MaxNullDataSize)
+	}
+
+	outputs := []TXOutput{*NewNullDataOutput(data)}
+
+	return buildTransaction(w, outputs, fee, 0, UTXO)
+}
+
+// buildTransaction sélectionne des outputs du wallet couvrant les outputs donnés et les frais,
+// ajoute la monnaie rendue après les outputs puis signe la transaction
+func buildTransaction(w *wallet.Wallet, outputs []TXOutput, fee int, lockTime int64, UTXO *UTXOSet) *Transaction {
 	var inputs []TXInput
-	var outputs []TXOutput
+
+	spent := fee
+	for _, out := range outputs {
+		spent += out.Value
+	}
+	needed := spent
+	if needed < 1 {
+		needed = 1 // A transaction needs at least one input
+	}
 
 	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
-	fmt.Printf("Finding spendable outputs for address %s, amount needed: %d\n", w.Address(), amount)
-	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	fmt.Printf("Finding spendable outputs for address %s, amount needed: %d\n", w.Address(), needed)
+	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, needed)
 	fmt.Printf("Found %d coins in spendable outputs\n", acc)
 
-	if acc < amount {
+	if acc < needed {
 		log.Panic("Error: not enough funds")
 	}
 
+	sequence := uint32(SequenceFinal)
+	if lockTime > 0 {
+		sequence = SequenceFinal - 1 // Non-final inputs enable the transaction locktime
+	}
+
 	for txid, outs := range validOutputs {
 		txID, err := hex.DecodeString(txid)
 		Handle(err)
 
 		for _, out := range outs {
-			input := TXInput{txID, out, nil, w.PublicKey}
+			input := TXInput{txID, out, nil, sequence}
 			inputs = append(inputs, input)
 		}
 	}
 
 	from := fmt.Sprintf("%s", w.Address())
 
-	outputs = append(outputs, *NewTXOutput(amount, to))
-
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	if acc > spent {
+		outputs = append(outputs, *NewTXOutput(acc-spent, from))
 	}
 
-	tx := Transaction{nil, inputs, outputs}
-	tx.ID = tx.Hash()
+	tx := Transaction{nil, inputs, outputs, lockTime}
 	UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey)
+	tx.ID = tx.Hash() // The ID commits to the unlocking scripts as well
 
 	return &tx
 }
 
+// CheckStandard vérifie les règles de relais appliquées aux transactions du mempool
+// Une transaction ne porte au plus qu'un output de données, sans valeur et limité à MaxNullDataSize
+func (tx *Transaction) CheckStandard() error {
+	if _, err := tx.outputsValue(); err != nil {
+		return err
+	}
+
+	dataOutputs := 0
+
+	for i, out := range tx.Outputs {
+		data, ok := ExtractNullData(out.ScriptPubKey)
+		if !ok {
+			continue
+		}
+
+		dataOutputs++
+		if dataOutputs > 1 {
+			return fmt.Errorf("transaction %x has more than one data output", tx.ID)
+		}
+		if len(data) > MaxNullDataSize {
+			return fmt.Errorf("output %d of transaction %x carries %d bytes, max %d", i, tx.ID, len(data), MaxNullDataSize)
+		}
+		if out.Value != 0 {
+			return fmt.Errorf("output %d of transaction %x burns %d coins", i, tx.ID, out.Value)
+		}
+	}
+
+	return nil
+}
+
 // String retourne une représentation string de la transaction
 func (tx *Transaction) String() string {
 	var lines []string
 	lines = append(lines, fmt.Sprintf("-- Transaction %x:", tx.ID))
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("		LockTime: %d", tx.LockTime))
+	}
 	for i, input := range tx.Inputs {
 		lines = append(lines, fmt.Sprintf("		Input %d:", i))
 		lines = append(lines, fmt.Sprintf("			TXID: %x", input.ID))
 		lines = append(lines, fmt.Sprintf("			Out: %d", input.Out))
-		lines = append(lines, fmt.Sprintf("			Signature: %x", input.Signature))
-		lines = append(lines, fmt.Sprintf("			PubKey: %x", input.PubKey))
+		lines = append(lines, fmt.Sprintf("			ScriptSig: %s", DisassembleScript(input.ScriptSig)))
+		lines = append(lines, fmt.Sprintf("			Sequence: %x", input.Sequence))
 	}
 
 	for i, output := range tx.Outputs {
 		lines = append(lines, fmt.Sprintf("		Output %d:", i))
 		lines = append(lines, fmt.Sprintf("			Value: %d", output.Value))
-		lines = append(lines, fmt.Sprintf("			PubKeyHash: %x", output.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("			Script: %s", DisassembleScript(output.ScriptPubKey)))
+		if data, ok := ExtractNullData(output.ScriptPubKey); ok {
+			lines = append(lines, fmt.Sprintf("			Data: %x", data))
+		}
 	}
 
 	return strings.Join(lines, "\n")
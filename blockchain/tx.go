@@ -10,47 +10,91 @@ import (
 type TXInput struct {
 	ID        []byte // Référence à la transaction contenant la sortie
 	Out       int    // Index de la sortie dans la transaction référencée
-	Signature []byte // Signature pour débloquer la sortie
-	PubKey    []byte // Clé publique de l'expéditeur
+	ScriptSig []byte // Script de déverrouillage (signature et clé publique pour P2PKH)
+	Sequence  uint32 // Verrou relatif de l'entrée (SequenceFinal pour le désactiver)
 }
 
 // TXOutput représente une sortie de transaction
 type TXOutput struct {
-	Value      int    // Montant de coins
-	PubKeyHash []byte // Script pour verrouiller la sortie
+	Value        int    // Montant de coins
+	ScriptPubKey []byte // Script pour verrouiller la sortie
 }
 
-// TXOutputs représente une liste de sorties de transaction
+// TXOutputs représente les sorties non dépensées d'une transaction
 type TXOutputs struct {
-	Outputs []*TXOutput // Liste des sorties de transaction
+	Outputs  map[int]TXOutput // Sorties indexées par leur position dans la transaction
+	Height   int              // Hauteur du bloc contenant la transaction
+	Coinbase bool             // Sorties d'une transaction coinbase
+}
+
+// NewTXOutputs crée l'entrée UTXO des sorties dépensables d'une transaction minée à la hauteur donnée
+func NewTXOutputs(tx *Transaction, height int) TXOutputs {
+	outs := TXOutputs{make(map[int]TXOutput), height, tx.IsCoinbase()}
+	for outIdx, out := range tx.Outputs {
+		if !out.IsUnspendable() {
+			outs.Outputs[outIdx] = out
+		}
+	}
+
+	return outs
+}
+
+// IsMature vérifie si les sorties peuvent être dépensées dans un bloc de hauteur spendHeight
+// Les sorties coinbase doivent attendre CoinbaseMaturity blocs, sauf celles du bloc genesis
+func (outs TXOutputs) IsMature(spendHeight int) bool {
+	if !outs.Coinbase || outs.Height == 0 {
+		return true
+	}
+
+	return spendHeight-outs.Height >= CoinbaseMaturity
 }
 
 // NewTXOutput crée une nouvelle sortie de transaction
 func NewTXOutput(value int, address string) *TXOutput {
-	txo := &TXOutput{value, nil}
+	txo := &TXOutput{Value: value}
 	txo.Lock([]byte(address))
 
 	return txo
 }
 
+// NewNullDataOutput crée une sortie sans valeur qui porte des données arbitraires
+// Elle n'est jamais ajoutée au set UTXO
+func NewNullDataOutput(data []byte) *TXOutput {
+	return &TXOutput{0, NullDataScript(data)}
+}
+
+// IsUnspendable indique si la sortie ne pourra jamais être dépensée
+func (out *TXOutput) IsUnspendable() bool {
+	return IsUnspendable(out.ScriptPubKey)
+}
+
 // UsesKey vérifie si l'entrée utilise la clé publique donnée
 func (in *TXInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := wallet.PublicKeyHash(in.PubKey) // Hash of the public key
-	// Compare the locking hash with the provided public key hash
-	return bytes.Compare(lockingHash, pubKeyHash) == 0
+	instructions, err := parseScript(in.ScriptSig)
+	if err != nil || len(instructions) == 0 {
+		return false
+	}
+	pubKey := instructions[len(instructions)-1].Data   // Last push of a P2PKH unlocking script
+	lockingHash := wallet.PublicKeyHash(pubKey)        // Hash of the public key
+	return bytes.Compare(lockingHash, pubKeyHash) == 0 // Compare with the provided public key hash
 }
 
-// Lock verrouille la sortie avec une adresse donnée
+// Lock verrouille la sortie avec une adresse donnée (script P2PKH)
 func (out *TXOutput) Lock(address []byte) {
 	pubKeyHash := wallet.Base58Decode(address)
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
+	out.ScriptPubKey = P2PKHScript(pubKeyHash)
+}
+
+// PubKeyHash retourne le hash de clé publique si la sortie suit le modèle P2PKH
+func (out *TXOutput) PubKeyHash() []byte {
+	return ExtractPubKeyHash(out.ScriptPubKey)
 }
 
 // isLockedWithKey vérifie si la sortie est verrouillée avec la clé publique donnée
 func (out *TXOutput) isLockedWithKey(pubKeyHash []byte) bool {
 	// Compare the output's public key hash with the provided public key hash
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+	return bytes.Compare(out.PubKeyHash(), pubKeyHash) == 0
 }
 
 // SerializeOutputs sérialise une liste de sorties de transaction
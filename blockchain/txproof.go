@@ -0,0 +1,96 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+// TxProof regroupe l'en-tête d'un bloc et la preuve d'inclusion d'une de ses transactions
+// Un client léger peut confirmer un paiement avec ces seules données et sa chaîne d'en-têtes
+type TxProof struct {
+	Header BlockHeader // En-tête du bloc contenant la transaction
+	Proof  MerkleProof // Chemin de Merkle de la transaction jusqu'à la racine de l'en-tête
+}
+
+// GetTxProof construit la preuve d'inclusion d'une transaction de la blockchain
+func (chain *BlockChain) GetTxProof(txID []byte) (TxProof, error) {
+	_, block, err := chain.findTransactionBlock(txID)
+	if err != nil {
+		return TxProof{}, err
+	}
+
+	proof, err := block.TxProof(txID)
+	if err != nil {
+		return TxProof{}, err
+	}
+
+	return TxProof{block.Header(), proof}, nil
+}
+
+// Check vérifie la preuve de travail de l'en-tête selon params et le chemin de Merkle
+func (p *TxProof) Check(params Params) error {
+	if !ValidateHeader(&p.Header, params) {
+		return errors.New("header has an invalid proof of work")
+	}
+	if !p.Proof.Verify(p.Header.MerkleRoot) {
+		return errors.New("merkle path does not lead to the header's merkle root")
+	}
+
+	return nil
+}
+
+// VerifyTxProof vérifie une preuve contre la chaîne principale locale
+// Retourne le nombre de confirmations de la transaction
+func (chain *BlockChain) VerifyTxProof(p *TxProof) (int, error) {
+	if err := p.Check(chain.Params); err != nil {
+		return 0, err
+	}
+
+	bestHeight := chain.GetBestHeight()
+	if p.Header.Height > bestHeight {
+		return 0, fmt.Errorf("block %x is above our best height %d", p.Header.Hash, bestHeight)
+	}
+
+	iter := chain.Iterator()
+	for {
+		block := iter.Next()
+
+		if block.Height == p.Header.Height {
+			if !bytes.Equal(block.Hash, p.Header.Hash) {
+				return 0, fmt.Errorf("block %x is not in the main chain", p.Header.Hash)
+			}
+			break
+		}
+
+		if iter.Done() {
+			return 0, fmt.Errorf("block %x is not in the main chain", p.Header.Hash)
+		}
+	}
+
+	return bestHeight - p.Header.Height + 1, nil
+}
+
+// Serialize sérialise une preuve en bytes
+func (p *TxProof) Serialize() []byte {
+	var encoded bytes.Buffer
+
+	enc := gob.NewEncoder(&encoded)
+	err := enc.Encode(p)
+	Handle(err)
+
+	return encoded.Bytes()
+}
+
+// DeserializeTxProof désérialise une preuve reçue d'un tiers
+func DeserializeTxProof(data []byte) (*TxProof, error) {
+	var proof TxProof
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&proof); err != nil {
+		return nil, err
+	}
+
+	return &proof, nil
+}
@@ -3,7 +3,6 @@ package blockchain
 import (
 	"bytes"
 	"encoding/hex"
-	"log"
 
 	"github.com/dgraph-io/badger"
 )
@@ -18,10 +17,13 @@ type UTXOSet struct {
 }
 
 // FindSpendableOutputs trouve les outputs non dépensés pour une adresse donnée jusqu'à atteindre le montant requis
+// Ignore les récompenses de minage immatures et les outputs déjà dépensés par le mempool
 // Retourne le montant total trouvé et une map des transaction IDs avec leurs output indices
 func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
 	unspentOuts := make(map[string][]int)
 	accumulated := 0
+	spendHeight := u.Blockchain.GetBestHeight() + 1
+	pendingSpends := u.Blockchain.MempoolSpentOutputs()
 
 	db := u.Blockchain.Database
 
@@ -40,7 +42,14 @@ func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[s
 			txID := hex.EncodeToString(k)
 			outs := DeserializeOutputs(v)
 
+			if !outs.IsMature(spendHeight) {
+				continue
+			}
+
 			for outIdx, out := range outs.Outputs {
+				if pendingSpends[outpointKey(txID, outIdx)] {
+					continue
+				}
 				if out.isLockedWithKey(pubKeyHash) && accumulated < amount {
 					accumulated += out.Value
 					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
@@ -78,7 +87,7 @@ func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TXOutput {
 			outs := DeserializeOutputs(v)
 			for _, out := range outs.Outputs {
 				if out.isLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, *out)
+					UTXOs = append(UTXOs, out)
 				}
 			}
 		}
@@ -88,6 +97,64 @@ func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TXOutput {
 	return UTXOs
 }
 
+// Balance détaille le solde d'une adresse
+type Balance struct {
+	Confirmed   int // Outputs confirmés et dépensables
+	Immature    int // Récompenses de minage pas encore mûres
+	Unconfirmed int // Variation attendue par les transactions du mempool
+}
+
+// GetBalance calcule le solde confirmé, immature et non confirmé d'une adresse
+func (u UTXOSet) GetBalance(pubKeyHash []byte) Balance {
+	var balance Balance
+	spendHeight := u.Blockchain.GetBestHeight() + 1
+	pendingSpends := u.Blockchain.MempoolSpentOutputs()
+
+	db := u.Blockchain.Database
+
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+			item := it.Item()
+			k := bytes.TrimPrefix(item.KeyCopy(nil), utxoPrefix)
+			v, err := item.ValueCopy(nil)
+			Handle(err)
+			txID := hex.EncodeToString(k)
+			outs := DeserializeOutputs(v)
+
+			for outIdx, out := range outs.Outputs {
+				if !out.isLockedWithKey(pubKeyHash) {
+					continue
+				}
+				if !outs.IsMature(spendHeight) {
+					balance.Immature += out.Value
+					continue
+				}
+				balance.Confirmed += out.Value
+				if pendingSpends[outpointKey(txID, outIdx)] {
+					balance.Unconfirmed -= out.Value
+				}
+			}
+		}
+		return nil
+	})
+	Handle(err)
+
+	for _, tx := range u.Blockchain.MempoolTransactions() {
+		for _, out := range tx.Outputs {
+			if out.isLockedWithKey(pubKeyHash) {
+				balance.Unconfirmed += out.Value
+			}
+		}
+	}
+
+	return balance
+}
+
 // CountTransactions compte le nombre total de transactions dans le set UTXO
 func (u UTXOSet) CountTransactions() int {
 	db := u.Blockchain.Database
@@ -107,13 +174,19 @@ func (u UTXOSet) CountTransactions() int {
 }
 
 // Reindex reconstruit complètement le set UTXO en parcourant toute la blockchain
-// Supprime tous les anciens UTXOs et les recalcule depuis le début
+// Supprime tous les anciens UTXOs et les recalcule depuis le début, ou depuis le set UTXO de la
+// base d'une chaîne élaguée ou chargée depuis un snapshot
 func (u UTXOSet) Reindex() {
+	u.reindexAt(u.Blockchain.LastHash())
+}
+
+// reindexAt reconstruit le set UTXO tel qu'il est après le bloc hash
+func (u UTXOSet) reindexAt(hash []byte) {
 	db := u.Blockchain.Database
 
 	u.DeleteByPrefix(utxoPrefix)
 
-	UTXO := u.Blockchain.FindUTXO()
+	UTXO := u.Blockchain.findUTXOAt(hash)
 
 	err := db.Update(func(txn *badger.Txn) error {
 		for txId, outs := range UTXO {
@@ -127,7 +200,7 @@ func (u UTXOSet) Reindex() {
 			Handle(err)
 		}
 
-		return nil
+		return txn.Set(utxoTipKey, hash)
 	})
 	Handle(err)
 }
@@ -135,55 +208,131 @@ func (u UTXOSet) Reindex() {
 // Update met à jour le set UTXO avec les transactions d'un nouveau bloc
 // Supprime les outputs dépensés et ajoute les nouveaux outputs créés
 func (u *UTXOSet) Update(block *Block) {
-	db := u.Blockchain.Database
+	err := u.Blockchain.Database.Update(func(txn *badger.Txn) error {
+		return updateUTXO(txn, block)
+	})
+	Handle(err)
+}
 
-	err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if !tx.IsCoinbase() {
-				for _, in := range tx.Inputs {
-					updatedOuts := TXOutputs{}
-					inID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inID)
-					Handle(err)
-					var v []byte
-					err = item.Value(func(val []byte) error {
-						v = append([]byte{}, val...)
-						return nil
-					})
-					Handle(err)
-
-					outs := DeserializeOutputs(v)
-
-					for outIdx, out := range outs.Outputs {
-						if outIdx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
+// updateUTXO applique un bloc au set UTXO dans la transaction Badger en cours
+func updateUTXO(txn *badger.Txn, block *Block) error {
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				inID := append(utxoPrefix, in.ID...)
+				item, err := txn.Get(inID)
+				if err != nil {
+					return err
+				}
+				v, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
 
-					if len(updatedOuts.Outputs) == 0 {
-						if err := txn.Delete(inID); err != nil {
-							log.Panic(err)
-						}
-					} else {
-						if err := txn.Set(inID, updatedOuts.SerializeOutputs()); err != nil {
-							log.Panic(err)
-						}
-					}
+				updatedOuts := DeserializeOutputs(v)
+				delete(updatedOuts.Outputs, in.Out)
+
+				if len(updatedOuts.Outputs) == 0 {
+					err = txn.Delete(inID)
+				} else {
+					err = txn.Set(inID, updatedOuts.SerializeOutputs())
+				}
+				if err != nil {
+					return err
 				}
 			}
-			newOutputs := TXOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, &out)
-			}
+		}
+		newOutputs := NewTXOutputs(tx, block.Height)
+		if len(newOutputs.Outputs) == 0 {
+			continue
+		}
 
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.SerializeOutputs()); err != nil {
-				log.Panic(err)
-			}
+		txID := append(utxoPrefix, tx.ID...)
+		if err := txn.Set(txID, newOutputs.SerializeOutputs()); err != nil {
+			return err
 		}
-		return nil
+	}
+
+	return txn.Set(utxoTipKey, block.Hash)
+}
+
+// GetOutputs retourne les sorties non dépensées d'une transaction
+func (u UTXOSet) GetOutputs(txID []byte) (TXOutputs, error) {
+	var outs TXOutputs
+
+	err := u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(utxoPrefix, txID...))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			outs = DeserializeOutputs(val)
+			return nil
+		})
+	})
+
+	return outs, err
+}
+
+// utxoTip retourne le bloc auquel correspond le set UTXO, ou nil s'il est inconnu
+func (u UTXOSet) utxoTip() []byte {
+	var tip []byte
+
+	err := u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		tip, err = readUTXOTip(txn)
+		return err
 	})
 	Handle(err)
+
+	return tip
+}
+
+// CatchUp applique au set UTXO les blocs de la chaîne principale entre le bloc auquel il
+// correspond et le sommet, sans relire les blocs précédents
+// Un set qui ne correspond à aucun ancêtre du sommet est reconstruit. Retourne le nombre de blocs
+// appliqués, -1 après une reconstruction
+func (u UTXOSet) CatchUp() (int, error) {
+	tip := u.utxoTip()
+
+	var blocks []Block
+	hash := u.Blockchain.LastHash()
+	for len(tip) > 0 && !bytes.Equal(hash, tip) {
+		block, err := u.Blockchain.GetBlock(hash)
+		if err != nil {
+			break
+		}
+		blocks = append(blocks, block)
+		hash = block.PrevHash
+	}
+	if len(tip) == 0 || !bytes.Equal(hash, tip) {
+		u.Reindex()
+		return -1, nil
+	}
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		err := u.Blockchain.Database.Update(func(txn *badger.Txn) error {
+			return updateUTXO(txn, &blocks[i])
+		})
+		if err != nil {
+			return len(blocks) - 1 - i, err
+		}
+	}
+
+	return len(blocks), nil
+}
+
+// readUTXOTip lit dans la transaction Badger en cours le bloc auquel correspond le set UTXO
+func readUTXOTip(txn *badger.Txn) ([]byte, error) {
+	item, err := txn.Get(utxoTipKey)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
 }
 
 // DeleteByPrefix supprime toutes les clés de la base de données qui commencent par le préfixe donné
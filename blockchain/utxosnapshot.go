@@ -0,0 +1,466 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Un snapshot contient, dans l'ordre, l'en-tête (magic, version, paramètres, hash et hauteur du
+// bloc, nombre de transactions), les en-têtes des blocs du genesis au parent du bloc, le bloc
+// lui-même, les sorties non dépensées de chaque transaction triées par ID, puis le commitment
+// Le commitment est un hash roulant : il part du hash des paramètres et du bloc, puis chaque
+// entrée est hashée avec le résultat précédent. Deux nœuds au même bloc obtiennent le même
+const (
+	utxoSnapshotMagic   = "BCGOUTX1"
+	utxoSnapshotVersion = 1
+)
+
+var (
+	baseKey        = []byte("base")   // Key of the block a chain loaded from a snapshot starts at
+	baseUTXOPrefix = []byte("butxo-") // Prefix for the UTXO set of that block
+	utxoTipKey     = []byte("ulh")    // Key of the block the UTXO set corresponds to
+)
+
+// UTXOSnapshotHeader décrit le contenu d'un snapshot du set UTXO
+type UTXOSnapshotHeader struct {
+	Version   int
+	Params    string // Name of the chain parameters
+	BlockHash []byte // Block the UTXO set corresponds to
+	Height    int    // Height of that block
+	Coins     int    // Number of transactions with unspent outputs
+}
+
+// DumpSnapshot écrit dans w un snapshot du set UTXO au sommet de la chaîne
+// Retourne l'en-tête du snapshot et son commitment
+func (u UTXOSet) DumpSnapshot(w io.Writer) (UTXOSnapshotHeader, []byte, error) {
+	chain := u.Blockchain
+
+	var header UTXOSnapshotHeader
+	tip, err := chain.GetBlock(chain.LastHash())
+	if err != nil {
+		return header, nil, err
+	}
+	if !bytes.Equal(u.utxoTip(), tip.Hash) {
+		return header, nil, errors.New("UTXO set is not at the chain tip, run reindexutxo first")
+	}
+	header = UTXOSnapshotHeader{utxoSnapshotVersion, u.Blockchain.Params.Name, tip.Hash, tip.Height, u.CountTransactions()}
+
+	headers := make([]BlockHeader, tip.Height)
+	hash := tip.PrevHash
+	for i := tip.Height - 1; i >= 0; i-- {
+		h, err := chain.GetHeader(hash)
+		if err != nil {
+			return header, nil, err
+		}
+		headers[i] = h
+		hash = h.PrevHash
+	}
+
+	out := bufio.NewWriter(w)
+
+	if err := writeUTXOSnapshotHeader(out, header); err != nil {
+		return header, nil, err
+	}
+	for _, h := range headers {
+		if err := writeChainFileItem(out, h.Serialize()); err != nil {
+			return header, nil, err
+		}
+	}
+	if err := writeChainFileItem(out, tip.Serialize()); err != nil {
+		return header, nil, err
+	}
+
+	commitment := snapshotSeed(header)
+	written := 0
+	err = chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+			item := it.Item()
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			entry := encodeCoins(bytes.TrimPrefix(item.KeyCopy(nil), utxoPrefix), DeserializeOutputs(v))
+			commitment = rollCommitment(commitment, entry)
+			if err := writeChainFileItem(out, entry); err != nil {
+				return err
+			}
+			written++
+		}
+		return nil
+	})
+	if err != nil {
+		return header, nil, err
+	}
+	if written != header.Coins {
+		return header, nil, fmt.Errorf("UTXO set changed while dumping (%d transactions, %d expected)", written, header.Coins)
+	}
+
+	if _, err := out.Write(commitment); err != nil {
+		return header, nil, err
+	}
+
+	return header, commitment, out.Flush()
+}
+
+// writeUTXOSnapshotHeader écrit l'en-tête d'un snapshot
+func writeUTXOSnapshotHeader(w io.Writer, header UTXOSnapshotHeader) error {
+	if _, err := io.WriteString(w, utxoSnapshotMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(header.Version)); err != nil {
+		return err
+	}
+	if err := writeChainFileItem(w, []byte(header.Params)); err != nil {
+		return err
+	}
+	if err := writeChainFileItem(w, header.BlockHash); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint64(header.Height)); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.BigEndian, uint64(header.Coins))
+}
+
+// readUTXOSnapshotHeader lit l'en-tête d'un snapshot
+func readUTXOSnapshotHeader(r io.Reader) (UTXOSnapshotHeader, error) {
+	var header UTXOSnapshotHeader
+
+	magic := make([]byte, len(utxoSnapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return header, err
+	}
+	if string(magic) != utxoSnapshotMagic {
+		return header, errors.New("not a UTXO snapshot")
+	}
+
+	var version uint32
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return header, err
+	}
+	if version != utxoSnapshotVersion {
+		return header, fmt.Errorf("unsupported UTXO snapshot version %d", version)
+	}
+	params, err := readChainFileItem(r)
+	if err != nil {
+		return header, err
+	}
+	blockHash, err := readChainFileItem(r)
+	if err != nil {
+		return header, err
+	}
+	var height, coins uint64
+	if err := binary.Read(r, binary.BigEndian, &height); err != nil {
+		return header, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &coins); err != nil {
+		return header, err
+	}
+
+	return UTXOSnapshotHeader{int(version), string(params), blockHash, int(height), int(coins)}, nil
+}
+
+// snapshotSeed retourne le point de départ du commitment : le hash des paramètres et du bloc
+func snapshotSeed(header UTXOSnapshotHeader) []byte {
+	seed := sha256.New()
+	writeChainFileItem(seed, []byte(header.Params))
+	writeChainFileItem(seed, header.BlockHash)
+	binary.Write(seed, binary.BigEndian, uint64(header.Height))
+
+	return seed.Sum(nil)
+}
+
+// rollCommitment ajoute une entrée au commitment
+func rollCommitment(commitment, entry []byte) []byte {
+	h := sha256.New()
+	h.Write(commitment)
+	h.Write(entry)
+
+	return h.Sum(nil)
+}
+
+// encodeCoins encode les sorties non dépensées d'une transaction sous une forme déterministe :
+// contrairement à gob, l'ordre des sorties ne dépend pas du parcours de la map
+func encodeCoins(txID []byte, outs TXOutputs) []byte {
+	var buff bytes.Buffer
+
+	indexes := make([]int, 0, len(outs.Outputs))
+	for idx := range outs.Outputs {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+
+	writeChainFileItem(&buff, txID)
+	binary.Write(&buff, binary.BigEndian, uint64(outs.Height))
+	coinbase := byte(0)
+	if outs.Coinbase {
+		coinbase = 1
+	}
+	buff.WriteByte(coinbase)
+	binary.Write(&buff, binary.BigEndian, uint32(len(indexes)))
+	for _, idx := range indexes {
+		out := outs.Outputs[idx]
+		binary.Write(&buff, binary.BigEndian, uint32(idx))
+		binary.Write(&buff, binary.BigEndian, int64(out.Value))
+		writeChainFileItem(&buff, out.ScriptPubKey)
+	}
+
+	return buff.Bytes()
+}
+
+// decodeCoins décode une entrée écrite par encodeCoins
+func decodeCoins(entry []byte) ([]byte, TXOutputs, error) {
+	r := bytes.NewReader(entry)
+	outs := TXOutputs{Outputs: make(map[int]TXOutput)}
+
+	txID, err := readChainFileItem(r)
+	if err != nil {
+		return nil, outs, err
+	}
+	var height uint64
+	if err := binary.Read(r, binary.BigEndian, &height); err != nil {
+		return nil, outs, err
+	}
+	coinbase, err := r.ReadByte()
+	if err != nil {
+		return nil, outs, err
+	}
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, outs, err
+	}
+	outs.Height, outs.Coinbase = int(height), coinbase == 1
+
+	for i := uint32(0); i < count; i++ {
+		var idx uint32
+		var value int64
+		if err := binary.Read(r, binary.BigEndian, &idx); err != nil {
+			return nil, outs, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &value); err != nil {
+			return nil, outs, err
+		}
+		script, err := readChainFileItem(r)
+		if err != nil {
+			return nil, outs, err
+		}
+		outs.Outputs[int(idx)] = TXOutput{int(value), script}
+	}
+	if r.Len() != 0 || len(outs.Outputs) == 0 {
+		return nil, outs, errors.New("malformed UTXO snapshot entry")
+	}
+
+	return txID, outs, nil
+}
+
+// LoadUTXOSnapshot crée la chaîne du nœud nodeId à partir d'un snapshot du set UTXO
+// Le commitment du snapshot doit être égal à commitment, obtenu d'une source de confiance : le
+// nœud ne rejoue pas l'historique et croit le set UTXO qu'il charge. La chaîne ne stocke que les
+// en-têtes sous le bloc du snapshot et valide les blocs suivants comme un nœud complet
+func LoadUTXOSnapshot(nodeId, path string, commitment []byte) (*BlockChain, UTXOSnapshotHeader, error) {
+	var header UTXOSnapshotHeader
+	if DBExists(fmt.Sprintf(dbPath, nodeId)) {
+		return nil, header, errors.New("blockchain already exists, a UTXO snapshot can only start a new node")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, header, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, header, err
+	}
+	r := bufio.NewReader(file)
+
+	header, err = readUTXOSnapshotHeader(r)
+	if err != nil {
+		return nil, header, err
+	}
+	// Les en-têtes et les entrées sont alloués d'après l'en-tête du fichier : chacun occupe au moins
+	// sa taille sur 4 octets, un en-tête qui en annonce plus que le fichier n'en contient est faux
+	if header.Height < 0 || header.Coins < 0 || int64(header.Height)+int64(header.Coins) > info.Size()/4 {
+		return nil, header, fmt.Errorf("UTXO snapshot announces %d headers and %d entries, more than its %d bytes hold",
+			header.Height, header.Coins, info.Size())
+	}
+	params, err := ParamsByName(header.Params)
+	if err != nil {
+		return nil, header, err
+	}
+
+	headers, err := readSnapshotHeaders(r, header.Height, params)
+	if err != nil {
+		return nil, header, err
+	}
+	data, err := readChainFileItem(r)
+	if err != nil {
+		return nil, header, err
+	}
+	base, err := deserializeChecked(data)
+	if err != nil {
+		return nil, header, err
+	}
+	if err := validateSnapshotBlock(base, header, headers, params); err != nil {
+		return nil, header, err
+	}
+
+	computed := snapshotSeed(header)
+	coins := make(map[string]TXOutputs, header.Coins)
+	var lastID []byte
+	for i := 0; i < header.Coins; i++ {
+		entry, err := readChainFileItem(r)
+		if err != nil {
+			return nil, header, err
+		}
+		computed = rollCommitment(computed, entry)
+
+		txID, outs, err := decodeCoins(entry)
+		if err != nil {
+			return nil, header, err
+		}
+		if bytes.Compare(txID, lastID) <= 0 {
+			return nil, header, errors.New("UTXO snapshot entries are not sorted")
+		}
+		lastID = txID
+		coins[hex.EncodeToString(txID)] = outs
+	}
+
+	stored := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, stored); err != nil {
+		return nil, header, err
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		return nil, header, errors.New("unexpected data after the UTXO snapshot commitment")
+	}
+	if !bytes.Equal(computed, stored) {
+		return nil, header, errors.New("UTXO snapshot is corrupted, its commitment does not match its contents")
+	}
+	if !bytes.Equal(computed, commitment) {
+		return nil, header, fmt.Errorf("UTXO snapshot commitment %x does not match the expected %x", computed, commitment)
+	}
+
+	chain := newBlockChain(nodeId, base, params)
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		for _, h := range headers {
+			if err := txn.Set(append(headerPrefix, h.Hash...), h.Serialize()); err != nil {
+				return err
+			}
+		}
+		return txn.Set(baseKey, base.Hash)
+	})
+	if err != nil {
+		return chain, header, err
+	}
+	chain.setBase(base.Hash)
+
+	batch := chain.Database.NewWriteBatch()
+	defer batch.Cancel()
+	for txId, outs := range coins {
+		key, _ := hex.DecodeString(txId)
+		if err := batch.Set(append(baseUTXOPrefix, key...), outs.SerializeOutputs()); err != nil {
+			return chain, header, err
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		return chain, header, err
+	}
+
+	UTXOSet{Blockchain: chain}.Reindex()
+
+	return chain, header, nil
+}
+
+// readSnapshotHeaders lit et valide les count en-têtes qui précèdent le bloc d'un snapshot
+func readSnapshotHeaders(r io.Reader, count int, params Params) ([]BlockHeader, error) {
+	headers := make([]BlockHeader, 0, count)
+
+	for i := 0; i < count; i++ {
+		data, err := readChainFileItem(r)
+		if err != nil {
+			return nil, err
+		}
+		h, err := deserializeHeaderChecked(data)
+		if err != nil {
+			return nil, err
+		}
+		if h.Height != i {
+			return nil, fmt.Errorf("header %x has height %d, expected %d", h.Hash, h.Height, i)
+		}
+		if i == 0 && len(h.PrevHash) != 0 {
+			return nil, errors.New("UTXO snapshot does not start with a genesis header")
+		}
+		if i > 0 && !bytes.Equal(h.PrevHash, headers[i-1].Hash) {
+			return nil, fmt.Errorf("header %x does not extend the previous one", h.Hash)
+		}
+		if !ValidateHeader(h, params) {
+			return nil, fmt.Errorf("header %x has an invalid proof of work", h.Hash)
+		}
+		headers = append(headers, *h)
+	}
+
+	return headers, nil
+}
+
+// deserializeHeaderChecked décode un en-tête en retournant une erreur plutôt qu'en paniquant
+func deserializeHeaderChecked(data []byte) (header *BlockHeader, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot decode header: %v", r)
+		}
+	}()
+
+	return DeserializeHeader(data), nil
+}
+
+// validateSnapshotBlock vérifie que le bloc d'un snapshot est celui de son en-tête et prolonge
+// ses en-têtes
+func validateSnapshotBlock(block *Block, header UTXOSnapshotHeader, headers []BlockHeader, params Params) error {
+	if !bytes.Equal(block.Hash, header.BlockHash) || block.Height != header.Height {
+		return errors.New("block of the UTXO snapshot does not match its header")
+	}
+	if !NewProofOfWork(block, params.Difficulty).Validate() {
+		return errors.New("invalid proof of work in the block of the UTXO snapshot")
+	}
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return errors.New("merkle root of the block of the UTXO snapshot does not match its transactions")
+	}
+
+	var prevHash []byte
+	if len(headers) > 0 {
+		prevHash = headers[len(headers)-1].Hash
+	}
+	if !bytes.Equal(block.PrevHash, prevHash) {
+		return errors.New("block of the UTXO snapshot does not extend its headers")
+	}
+
+	return nil
+}
+
+// loadBase lit le bloc de départ d'une chaîne chargée depuis un snapshot UTXO
+// Retourne nil pour une chaîne qui part du genesis
+func loadBase(txn *badger.Txn) ([]byte, error) {
+	item, err := txn.Get(baseKey)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
+}
@@ -0,0 +1,85 @@
+package blockchain
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// TestUTXOSnapshotRoundTrip écrit le snapshot d'une chaîne puis le charge dans un nouveau nœud :
+// seul un fichier intact, au commitment attendu, donne une chaîne au même set UTXO
+func TestUTXOSnapshotRoundTrip(t *testing.T) {
+	chain := newTestChain(t, "source")
+	chain.mine(2, chain.send(5))
+	chain.mine(1, chain.send(3))
+
+	var file bytes.Buffer
+	header, commitment, err := UTXOSet{Blockchain: chain.BlockChain}.DumpSnapshot(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Height != 3 || !bytes.Equal(header.BlockHash, chain.LastHash()) {
+		t.Fatalf("snapshot of block %x at height %d, want the tip", header.BlockHash, header.Height)
+	}
+	want := chain.FindUTXO()
+	hashes := chain.GetBlockHashes()
+	genesis := hashes[len(hashes)-1]
+	data := file.Bytes()
+
+	tests := []struct {
+		name       string
+		data       []byte
+		commitment []byte
+		valid      bool
+	}{
+		{"intact", data, commitment, true},
+		{"other commitment", data, bytes.Repeat([]byte{1}, len(commitment)), false},
+		{"corrupted entry", flipByte(data, len(data)-len(commitment)-2), commitment, false},
+		{"corrupted commitment", flipByte(data, len(data)-1), commitment, false},
+		{"trailing data", append(append([]byte{}, data...), 0), commitment, false},
+		{"truncated", data[:len(data)-len(commitment)-1], commitment, false},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := "tmp/snapshot.dat"
+			if err := os.WriteFile(path, test.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			nodeId := "loaded" + string(rune('a'+i))
+			loaded, _, err := LoadUTXOSnapshot(nodeId, path, test.commitment)
+			if !test.valid {
+				if err == nil {
+					loaded.Database.Close()
+					t.Fatal("snapshot loaded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer loaded.Database.Close()
+
+			if !bytes.Equal(loaded.LastHash(), chain.LastHash()) || !bytes.Equal(loaded.Base(), chain.LastHash()) {
+				t.Fatalf("loaded chain at %x with base %x, want both at %x", loaded.LastHash(), loaded.Base(), chain.LastHash())
+			}
+			(&testChain{loaded, t, chain.wallet}).checkUTXO(want)
+
+			// Les en-têtes sous la base sont connus, pas les corps des blocs
+			if _, err := loaded.GetHeader(genesis); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loaded.GetBlock(genesis); err == nil {
+				t.Fatal("loaded chain has the genesis block body")
+			}
+		})
+	}
+}
+
+// flipByte retourne une copie de data dont l'octet à la position i est modifié
+func flipByte(data []byte, i int) []byte {
+	flipped := append([]byte{}, data...)
+	flipped[i] ^= 0xff
+	return flipped
+}
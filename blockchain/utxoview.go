@@ -0,0 +1,159 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// utxoView est le set UTXO tel qu'il était après un bloc, modifié au fil des transactions validées
+// Les transactions d'un bloc sont vérifiées contre la vue de son parent : une entrée doit désigner
+// une sortie qui existe et que ni un bloc précédent ni une transaction précédente n'a dépensée
+type utxoView struct {
+	chain     *BlockChain
+	persisted bool                 // Coins missing from coins are read from the persisted UTXO set
+	coins     map[string]TXOutputs // Coins changed since the view was taken, by hex transaction ID
+}
+
+// utxoViewAt retourne la vue du set UTXO après le bloc hash
+// Le set persisté sert directement quand il correspond à ce bloc. Sinon, pour un bloc d'une branche
+// concurrente, le set est recalculé en rejouant la branche
+func (chain *BlockChain) utxoViewAt(hash []byte) (*utxoView, error) {
+	view := &utxoView{chain: chain, coins: make(map[string]TXOutputs)}
+
+	if bytes.Equal(hash, UTXOSet{Blockchain: chain}.utxoTip()) {
+		view.persisted = true
+		return view, nil
+	}
+
+	if err := chain.checkReplayable(hash); err != nil {
+		return nil, err
+	}
+	view.coins = chain.findUTXOAt(hash)
+
+	return view, nil
+}
+
+// checkReplayable vérifie que les blocs de la branche qui mène à hash sont tous stockés jusqu'au
+// genesis ou à la base de la chaîne
+func (chain *BlockChain) checkReplayable(hash []byte) error {
+	for len(hash) > 0 && !bytes.Equal(hash, chain.Base()) {
+		block, err := chain.GetBlock(hash)
+		if err != nil {
+			return errors.New("branch forks below the base of the chain")
+		}
+		hash = block.PrevHash
+	}
+
+	return nil
+}
+
+// get retourne les sorties non dépensées d'une transaction dans la vue
+func (v *utxoView) get(txID []byte) (TXOutputs, bool) {
+	if outs, ok := v.coins[hex.EncodeToString(txID)]; ok {
+		return outs, len(outs.Outputs) > 0
+	}
+	if !v.persisted {
+		return TXOutputs{}, false
+	}
+
+	outs, err := UTXOSet{Blockchain: v.chain}.GetOutputs(txID)
+	return outs, err == nil
+}
+
+// spend retire de la vue la sortie dépensée par in et la retourne avec les sorties de sa transaction
+func (v *utxoView) spend(in TXInput) (TXOutput, TXOutputs, error) {
+	outs, ok := v.get(in.ID)
+	out, unspent := outs.Outputs[in.Out]
+	if !ok || !unspent {
+		return out, outs, fmt.Errorf("output %d of %x: %w", in.Out, in.ID, ErrMissingOutput)
+	}
+
+	remaining := TXOutputs{make(map[int]TXOutput), outs.Height, outs.Coinbase}
+	for idx, o := range outs.Outputs {
+		if idx != in.Out {
+			remaining.Outputs[idx] = o
+		}
+	}
+	v.coins[hex.EncodeToString(in.ID)] = remaining
+
+	return out, outs, nil
+}
+
+// add ajoute à la vue les sorties d'une transaction d'un bloc de hauteur height
+func (v *utxoView) add(tx *Transaction, height int) {
+	v.coins[hex.EncodeToString(tx.ID)] = NewTXOutputs(tx, height)
+}
+
+// connectTransaction vérifie une transaction d'un bloc de hauteur height construit sur prevHash
+// contre view, puis y remplace ses entrées par ses sorties
+// Les entrées doivent désigner des sorties non dépensées et mûres, les scripts, les valeurs et les
+// verrous temporels doivent être valides. Retourne les frais de la transaction
+func (chain *BlockChain) connectTransaction(view *utxoView, tx *Transaction, height int, prevHash []byte) (int, error) {
+	fee, spent, err := spendInputs(view, tx)
+	if err != nil {
+		return 0, err
+	}
+
+	prevHeights := make([]int, len(tx.Inputs))
+	for i, outs := range spent {
+		if !outs.IsMature(height) {
+			return 0, fmt.Errorf("transaction %x spends immature coinbase %x (%d confirmations, %d required)",
+				tx.ID, tx.Inputs[i].ID, height-outs.Height, CoinbaseMaturity)
+		}
+		prevHeights[i] = outs.Height
+	}
+	if err := chain.checkTransactionLocks(tx, height, prevHash, prevHeights); err != nil {
+		return 0, err
+	}
+
+	view.add(tx, height)
+
+	return fee, nil
+}
+
+// spendInputs retire de view les sorties dépensées par tx et vérifie ses valeurs et ses scripts
+// Retourne les frais de la transaction et, pour chaque entrée, les sorties de la transaction dépensée
+func spendInputs(view *utxoView, tx *Transaction) (int, []TXOutputs, error) {
+	prevTXs := make(map[string]Transaction)
+	spent := make([]TXOutputs, len(tx.Inputs))
+
+	in := 0
+	for i, input := range tx.Inputs {
+		out, outs, err := view.spend(input)
+		if err != nil {
+			return 0, nil, fmt.Errorf("transaction %x spends an unknown or spent output: %w", tx.ID, err)
+		}
+		spent[i] = outs
+
+		in += out.Value
+		if in > MaxMoney {
+			return 0, nil, fmt.Errorf("inputs of transaction %x are out of range", tx.ID)
+		}
+
+		// Les scripts ne lisent que la sortie dépensée de chaque transaction précédente
+		id := hex.EncodeToString(input.ID)
+		prevTX := prevTXs[id]
+		prevTX.ID = input.ID
+		for len(prevTX.Outputs) <= input.Out {
+			prevTX.Outputs = append(prevTX.Outputs, TXOutput{})
+		}
+		prevTX.Outputs[input.Out] = out
+		prevTXs[id] = prevTX
+	}
+
+	out, err := tx.outputsValue()
+	if err != nil {
+		return 0, nil, err
+	}
+	if out > in {
+		return 0, nil, fmt.Errorf("transaction %x spends %d but its inputs only hold %d", tx.ID, out, in)
+	}
+
+	if !tx.Verify(prevTXs) {
+		return 0, nil, fmt.Errorf("transaction %x has invalid scripts", tx.ID)
+	}
+
+	return in - out, spent, nil
+}
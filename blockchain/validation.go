@@ -0,0 +1,177 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// CoinbaseMaturity est le nombre de blocs qu'une récompense de minage doit attendre avant
+// d'être dépensée, pour qu'une réorganisation ne puisse pas effacer des coins déjà dépensés
+const CoinbaseMaturity = 100
+
+// MaxMoney borne la valeur d'une sortie et toute somme de valeurs, qui ne peut donc pas déborder
+const MaxMoney = 1 << 53
+
+// ValidateBlock vérifie qu'un bloc reçu peut être rattaché à la blockchain
+// Contrôle la preuve de travail, le chaînage, les horodatages et chaque transaction contre le set
+// UTXO du parent du bloc, complété par les sorties des transactions précédentes du bloc
+func (chain *BlockChain) ValidateBlock(block *Block) error {
+	if !NewProofOfWork(block, chain.Params.Difficulty).Validate() {
+		return errors.New("invalid proof of work")
+	}
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return errors.New("merkle root does not match the transactions")
+	}
+
+	parent, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return fmt.Errorf("%w: %x", ErrOrphanBlock, block.PrevHash)
+	}
+	if block.Height != parent.Height+1 {
+		return fmt.Errorf("bad height %d, parent is at %d", block.Height, parent.Height)
+	}
+	if block.Timestamp <= chain.MedianTimePast(parent.Hash) {
+		return errors.New("timestamp is not after median time past")
+	}
+	if err := checkFutureTime(block.Timestamp); err != nil {
+		return err
+	}
+
+	view, err := chain.utxoViewAt(block.PrevHash)
+	if err != nil {
+		return err
+	}
+
+	var coinbase *Transaction
+	coinbases, fees := 0, 0
+	for _, tx := range block.Transactions {
+		if !bytes.Equal(tx.ID, tx.Hash()) {
+			return fmt.Errorf("transaction ID %x does not match its contents", tx.ID)
+		}
+
+		if tx.IsCoinbase() {
+			coinbase = tx
+			coinbases++
+			view.add(tx, block.Height)
+			continue
+		}
+
+		fee, err := chain.connectTransaction(view, tx, block.Height, block.PrevHash)
+		if err != nil {
+			return err
+		}
+		fees += fee
+		if fees > MaxMoney {
+			return errors.New("block fees are out of range")
+		}
+	}
+
+	if coinbases != 1 {
+		return fmt.Errorf("block has %d coinbase transactions", coinbases)
+	}
+
+	reward, err := coinbase.outputsValue()
+	if err != nil {
+		return err
+	}
+	if reward > Subsidy+fees {
+		return fmt.Errorf("coinbase pays %d, more than the subsidy plus %d of fees", reward, fees)
+	}
+
+	return nil
+}
+
+// CheckMempoolTx vérifie une transaction hors bloc contre le set UTXO du sommet de la chaîne
+// Son ID doit être son hash, ses entrées doivent désigner des sorties non dépensées, ses valeurs et
+// ses scripts doivent être valides. La maturité des coinbases et les verrous temporels, qui peuvent
+// se débloquer avec les blocs suivants, ne sont pas vérifiés. Retourne les frais de la transaction
+func (chain *BlockChain) CheckMempoolTx(tx *Transaction) (int, error) {
+	if !bytes.Equal(tx.ID, tx.Hash()) {
+		return 0, fmt.Errorf("transaction ID %x does not match its contents", tx.ID)
+	}
+	if tx.IsCoinbase() {
+		return 0, fmt.Errorf("coinbase transaction %x outside of a block", tx.ID)
+	}
+
+	view, err := chain.utxoViewAt(chain.LastHash())
+	if err != nil {
+		return 0, err
+	}
+	fee, _, err := spendInputs(view, tx)
+
+	return fee, err
+}
+
+// TransactionFee retourne les frais d'une transaction : la valeur de ses entrées moins
+// celle de ses sorties. Une transaction qui crée plus de valeur qu'elle n'en dépense est rejetée
+func (chain *BlockChain) TransactionFee(tx *Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+
+	in := 0
+	for _, input := range tx.Inputs {
+		prevTX, _, err := chain.findSpentTransaction(input)
+		if err != nil {
+			return 0, fmt.Errorf("transaction %x spends unknown transaction %x", tx.ID, input.ID)
+		}
+		if input.Out < 0 || input.Out >= len(prevTX.Outputs) {
+			return 0, fmt.Errorf("transaction %x spends missing output %d of %x", tx.ID, input.Out, input.ID)
+		}
+		in += prevTX.Outputs[input.Out].Value
+		if in > MaxMoney {
+			return 0, fmt.Errorf("inputs of transaction %x are out of range", tx.ID)
+		}
+	}
+
+	out, err := tx.outputsValue()
+	if err != nil {
+		return 0, err
+	}
+
+	if out > in {
+		return 0, fmt.Errorf("transaction %x spends %d but its inputs only hold %d", tx.ID, out, in)
+	}
+
+	return in - out, nil
+}
+
+// CheckCoinbaseMaturity vérifie qu'une transaction ne dépense pas de récompense de minage
+// trop récente pour être incluse dans un bloc de hauteur spendHeight
+func (chain *BlockChain) CheckCoinbaseMaturity(tx *Transaction, spendHeight int) error {
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	for _, in := range tx.Inputs {
+		_, outs, err := chain.findSpentTransaction(in)
+		if err != nil {
+			return fmt.Errorf("transaction %x spends unknown transaction %x", tx.ID, in.ID)
+		}
+
+		if !outs.IsMature(spendHeight) {
+			return fmt.Errorf("transaction %x spends immature coinbase %x (%d confirmations, %d required)",
+				tx.ID, in.ID, spendHeight-outs.Height, CoinbaseMaturity)
+		}
+	}
+
+	return nil
+}
+
+// outputsValue retourne la somme des sorties d'une transaction
+// Une sortie négative créerait de la valeur : elle est rejetée, comme une somme au-delà de MaxMoney
+func (tx *Transaction) outputsValue() (int, error) {
+	total := 0
+	for i, out := range tx.Outputs {
+		if out.Value < 0 || out.Value > MaxMoney {
+			return 0, fmt.Errorf("output %d of transaction %x has an out of range value %d", i, tx.ID, out.Value)
+		}
+		total += out.Value
+		if total > MaxMoney {
+			return 0, fmt.Errorf("outputs of transaction %x are out of range", tx.ID)
+		}
+	}
+
+	return total, nil
+}
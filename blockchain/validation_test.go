@@ -0,0 +1,46 @@
+package blockchain
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestValidateBlockFutureTime vérifie qu'un bloc n'est accepté que si son horodatage ne dépasse
+// pas l'heure locale de plus de MaxFutureBlockTime
+func TestValidateBlockFutureTime(t *testing.T) {
+	chain := newTestChain(t, "future")
+	tip, err := chain.GetBlock(chain.LastHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		valid   bool
+	}{
+		{"a second ahead", time.Second, true},
+		{"within the drift", MaxFutureBlockTime*time.Second - time.Minute, true},
+		{"beyond the drift", MaxFutureBlockTime*time.Second + time.Minute, false},
+		{"a day ahead", 24 * time.Hour, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			txs := []*Transaction{CoinbaseTx(string(chain.wallet.Address()), "", 0)}
+			block := NewBlockTemplate(txs, tip.Hash, tip.Height+1, time.Now().Add(test.advance).Unix())
+			if err := NewMiner().Mine(context.Background(), block, chain.Params.Difficulty); err != nil {
+				t.Fatal(err)
+			}
+
+			err := chain.ValidateBlock(block)
+			if test.valid && err != nil {
+				t.Fatalf("block rejected: %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatal("block accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"blockchain-go/network"
+	"fmt"
+	"log"
+	"time"
+)
+
+// rpcAddressOrDefault retourne rpcAddress, ou l'adresse RPC par défaut du nœud NODE_ID
+func rpcAddressOrDefault(rpcAddress, nodeID string) string {
+	if rpcAddress != "" {
+		return rpcAddress
+	}
+
+	return network.DefaultRPCAddress(nodeID)
+}
+
+// listBanned affiche les adresses bannies par un nœud en cours d'exécution
+func (cli *CommandLine) listBanned(rpcAddress string) {
+	var banned []network.BanInfo
+	if err := network.CallRPC(rpcAddress, "listbanned", nil, &banned); err != nil {
+		log.Panic(err)
+	}
+
+	if len(banned) == 0 {
+		fmt.Println("No banned address")
+		return
+	}
+	for _, ban := range banned {
+		fmt.Printf("%s banned until %s: %s\n", ban.Address, time.Unix(ban.BannedUntil, 0).Format(time.RFC3339), ban.Reason)
+	}
+}
+
+// setBan bannit une adresse pendant duration, ou lève son bannissement si remove est vrai
+func (cli *CommandLine) setBan(rpcAddress, address string, duration time.Duration, remove bool) {
+	params := []interface{}{address, "add", int64(duration / time.Second)}
+	if remove {
+		params = []interface{}{address, "remove"}
+	}
+	if err := network.CallRPC(rpcAddress, "setban", params, nil); err != nil {
+		log.Panic(err)
+	}
+
+	if remove {
+		fmt.Printf("%s is no longer banned\n", address)
+	} else {
+		fmt.Printf("%s banned for %s\n", address, duration)
+	}
+}
+
+// clearBanned lève tous les bannissements d'un nœud
+func (cli *CommandLine) clearBanned(rpcAddress string) {
+	if err := network.CallRPC(rpcAddress, "clearbanned", nil, nil); err != nil {
+		log.Panic(err)
+	}
+	fmt.Println("All bans cleared")
+}
@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"blockchain-go/blockchain"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// progressInterval espace les lignes de progression d'un export ou d'un import
+const progressInterval = time.Second
+
+// exportChain écrit la chaîne du nœud dans un fichier d'export portable
+// Le fichier est écrit à côté puis renommé : un export interrompu ne laisse pas de fichier partiel
+func (cli *CommandLine) exportChain(nodeID, out string) {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Database.Close()
+
+	tmp := out + ".part"
+	file, err := os.Create(tmp)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	total := chain.GetBestHeight() + 1
+	lastReport := time.Now()
+	err = chain.ExportChain(file, func(height int) {
+		if time.Since(lastReport) >= progressInterval {
+			fmt.Printf("Exported %d/%d blocks (%.1f%%)\n", height+1, total, 100*float64(height+1)/float64(total))
+			lastReport = time.Now()
+		}
+	})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Panic(err)
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Exported %d blocks to %s\n", total, out)
+}
+
+// importChain valide et ajoute à la chaîne du nœud les blocs d'un fichier d'export
+// Ctrl-C arrête l'import après le bloc en cours, relancer la commande le reprend
+func (cli *CommandLine) importChain(nodeID, in string) {
+	file, err := blockchain.OpenChainFile(in)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer file.Close()
+	fmt.Printf("Importing %d blocks (%s parameters) from %s\n", file.Header.Blocks, file.Header.Params, in)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	start := time.Now()
+	lastReport := start
+	imported := 0
+	chain, err := blockchain.ImportChain(ctx, nodeID, file, func(height, total int) {
+		imported++
+		if time.Since(lastReport) >= progressInterval {
+			elapsed := time.Since(start).Seconds()
+			fmt.Printf("Imported block %d/%d (%.1f%%, %.0f blocks/s)\n", height, total-1, 100*float64(height+1)/float64(total), float64(imported)/elapsed)
+			lastReport = time.Now()
+		}
+	})
+	if chain != nil {
+		defer chain.Database.Close()
+	}
+	if errors.Is(err, context.Canceled) {
+		fmt.Printf("Import interrupted at height %d, run importchain again to resume\n", chain.GetBestHeight())
+		return
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Imported chain up to height %d in %s\n", chain.GetBestHeight(), time.Since(start).Round(time.Millisecond))
+}
@@ -4,12 +4,16 @@ import (
 	"blockchain-go/blockchain"
 	"blockchain-go/network"
 	"blockchain-go/wallet"
+	"context"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type CommandLine struct{}
@@ -17,14 +21,42 @@ type CommandLine struct{}
 // printUsage affiche l'aide des commandes disponibles
 func (cli *CommandLine) printUsage() {
 	fmt.Println("Usage:")
-	fmt.Println(" getbalance -address ADDRESS - get the balance for an address")
-	fmt.Println(" createblockchain -address ADDRESS creates a blockchain and sends genesis reward to address")
+	fmt.Println(" getbalance -address ADDRESS -spv - get the balance for an address. -spv reads the light wallet instead of the full chain")
+	fmt.Println(" createblockchain -address ADDRESS -regtest creates a blockchain and sends genesis reward to address. -regtest uses a trivial difficulty for tests")
 	fmt.Println(" printchain - Prints the blocks in the chain")
-	fmt.Println(" send -from FROM -to TO -amount AMOUNT -mine - Send amount of coins. Then -mine flag is set, mine off of this node")
+	fmt.Println(" send -from FROM -to TO -amount AMOUNT -fee FEE -locktime LOCKTIME -node HOST:PORT -encrypt -mine - Send amount of coins. Then -mine flag is set, mine off of this node")
+	fmt.Println("     -node is the node the transaction is submitted to, it relays it to its peers. The first seed node by default")
+	fmt.Println("     -encrypt submits it over an encrypted connection signed with the identity key of NODE_ID")
+	fmt.Println("     -fee is left to the miner of the transaction, higher fees are mined first")
+	fmt.Println("     -locktime is a block height (< 500000000) or a Unix timestamp before which the transaction cannot be mined")
+	fmt.Println(" senddata -from FROM -hex DATA -fee FEE -node HOST:PORT -encrypt -mine - Anchor up to 80 bytes of hex data in the chain with an OP_RETURN output")
+	fmt.Println(" gettxproof -txid TXID - Prints the Merkle inclusion proof of a mined transaction")
+	fmt.Println(" verifytxproof -proof PROOF - Checks an inclusion proof against the local chain of headers")
 	fmt.Println(" createwallet - Creates a new Wallet")
 	fmt.Println(" listaddresses - Lists the addresses in our wallet file")
 	fmt.Println(" reindexutxo - Rebuilds the UTXO set")
-	fmt.Println(" startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println(" exportchain -out FILE - Writes the blocks from genesis to tip into a portable chain file")
+	fmt.Println(" importchain -in FILE - Validates and adds the blocks of a chain file, creating the chain if needed. An interrupted import resumes where it stopped")
+	fmt.Println(" dumputxoset -out FILE - Writes a snapshot of the UTXO set at the chain tip and prints its commitment")
+	fmt.Println(" loadutxoset -in FILE -commitment HASH - Starts a new node from a UTXO snapshot whose commitment matches HASH, without replaying the chain")
+	fmt.Println(" startnode -miner ADDRESS -mineinterval DURATION -mineempty -rpcaddr HOST:PORT -maxinbound N -maxoutbound N -outbound N -pool HOST:PORT -sharediff N -listen HOST:PORT -externalip HOST -seeds LIST -connect LIST -addnode LIST -encrypt -trustedpeers LIST -prune TARGET -spv -rescan -genesis HASH -regtest - Start a node with ID specified in NODE_ID env. var. -miner enables mining, -spv runs a light node")
+	fmt.Println("     -rescan tests the light node's stored block filters again against its wallet")
+	fmt.Println("     -genesis HASH pins the genesis of the network a light node follows, required on its first start. -regtest pins a regtest chain")
+	fmt.Println("     -rpcaddr HOST:PORT serves getblocktemplate and submitblock, NODE_ID+1000 on localhost by default")
+	fmt.Println("     -mineinterval DURATION sets the minimum delay between two mined blocks, -mineempty also mines blocks without transactions")
+	fmt.Println("     -maxinbound N and -maxoutbound N limit the peers, -outbound N sets how many outbound peers the node looks for")
+	fmt.Println("     -listen HOST:PORT sets the bind address, localhost:NODE_ID by default, -externalip HOST[:PORT] the address announced to peers")
+	fmt.Println("     -seeds, -connect and -addnode take comma-separated HOST:PORT lists ([::1]:3000 for IPv6): seed nodes, the only nodes to connect to, nodes to always stay connected to")
+	fmt.Println("     -encrypt encrypts every connection with the node identity key, -trustedpeers only accepts the listed identity keys")
+	fmt.Println("     -prune TARGET deletes old block bodies, keeping TARGET blocks (at least 288) or TARGET MB (550MB) below the tip")
+	fmt.Println("     -pool HOST:PORT serves pool workers instead of mining locally, -miner then receives the rounding remainders, -sharediff N sets the share difficulty")
+	fmt.Println(" miner -address ADDRESS -rpc HOST:PORT -workers N -mineempty - Mine blocks for a running node through its RPC server")
+	fmt.Println(" nodekey - Prints the identity key of the node NODE_ID, given to -trustedpeers of other nodes")
+	fmt.Println(" listbanned -rpc HOST:PORT - Lists the addresses banned by a running node")
+	fmt.Println(" setban -address ADDRESS -duration DURATION -remove -rpc HOST:PORT - Bans a peer (HOST:PORT) or a whole host, or lifts the ban with -remove")
+	fmt.Println(" clearbanned -rpc HOST:PORT - Lifts every ban of a running node")
+	fmt.Println(" generate -n N -address ADDRESS -rpc HOST:PORT - Mines N blocks at once on a regtest chain, rewarded to address. -rpc asks a running node, which includes its mempool")
+	fmt.Println(" poolminer -pool HOST:PORT -worker NAME -address ADDRESS -workers N - Mine shares for a pool, rewards are split between workers by shares")
 }
 
 // validateArgs vérifie que des arguments ont été fournis
@@ -37,9 +69,34 @@ func (cli *CommandLine) validateArgs() {
 
 // StartNode démarre un nœud de la blockchain avec l'ID donné
 // Si minerAddress est fourni, active le mode mining pour ce nœud
-func (cli *CommandLine) StartNode(nodeID, minerAddress string) {
+// Si spv est true, démarre un nœud léger qui ne stocke que les en-têtes et les filtres de blocs
+// Si rescan est true, le nœud léger reteste ses filtres enregistrés contre son wallet
+// genesis est le hash du genesis du réseau que suit un nœud léger, nécessaire à son premier lancement,
+// et params les paramètres de sa chaîne
+// policy règle la boucle de minage en arrière-plan d'un nœud mineur
+// rpcAddress est l'adresse du serveur RPC d'un nœud complet, par défaut son port plus 1000
+// config règle les adresses d'écoute et annoncée du nœud et les nœuds auxquels il se connecte
+func (cli *CommandLine) StartNode(nodeID, minerAddress, rpcAddress string, policy network.MiningPolicy, config network.NetConfig, spv, rescan bool, genesis []byte, params blockchain.Params) {
 	fmt.Printf("Starting Node %s\n", nodeID)
 
+	if rescan && !spv {
+		log.Panic("Only a light node can rescan its filters!")
+	}
+	if len(genesis) > 0 && !spv {
+		log.Panic("Only a light node takes a genesis hash!")
+	}
+
+	if spv {
+		if len(minerAddress) > 0 {
+			log.Panic("A light node cannot mine!")
+		}
+		network.StartSPVNode(nodeID, config, rescan, genesis, params)
+		return
+	}
+
+	if len(policy.PoolAddress) > 0 && len(minerAddress) == 0 {
+		log.Panic("A pool needs an operator address, set it with -miner!")
+	}
 	if len(minerAddress) > 0 {
 		if wallet.ValidateAddress(minerAddress) {
 			fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
@@ -47,14 +104,52 @@ func (cli *CommandLine) StartNode(nodeID, minerAddress string) {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	network.StartServer(nodeID, minerAddress)
+	if rpcAddress == "" {
+		rpcAddress = network.DefaultRPCAddress(nodeID)
+	}
+	network.StartServer(nodeID, minerAddress, rpcAddress, policy, config)
+}
+
+// nodeKey affiche la clé publique d'identité du nœud, créée au besoin
+func (cli *CommandLine) nodeKey(nodeID string) {
+	identity, err := network.NodeIdentity(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println(identity)
+}
+
+// newClient crée le nœud, jamais démarré, par lequel la commande envoie ses messages
+// Avec encrypt, ils sont chiffrés et signés avec la clé d'identité du nœud nodeID
+func newClient(nodeID string, encrypt bool) *network.Node {
+	client := network.NewNode(nodeID, network.NetConfig{}, network.TCPTransport{})
+	if encrypt {
+		if err := client.EnableEncryption(nil); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	return client
+}
+
+// parseAddressList lit une liste d'adresses d'une option de cmd, ou affiche l'usage de la
+// commande si une adresse est invalide
+func parseAddressList(cmd *flag.FlagSet, list string) []string {
+	addresses, err := network.ParseAddressList(list)
+	if err != nil {
+		fmt.Println(err)
+		cmd.Usage()
+		runtime.Goexit()
+	}
+
+	return addresses
 }
 
 // reindexUTXO reconstruit le set UTXO depuis la blockchain
 func (cli *CommandLine) reindexUTXO(nodeID string) {
 	chain := blockchain.ContinueBlockChain(nodeID)
 	defer chain.Database.Close()
-	UTXOSet := blockchain.UTXOSet{chain}
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 	UTXOSet.Reindex()
 
 	count := UTXOSet.CountTransactions()
@@ -92,57 +187,116 @@ func (cli *CommandLine) printChain(nodeID string) {
 
 		fmt.Printf("Hash: %x\n", block.Hash)
 		fmt.Printf("Prev. hash: %x\n", block.PrevHash)
-		pow := blockchain.NewProofOfWork(block)
+		fmt.Printf("Merkle root: %x\n", block.MerkleRoot)
+		pow := blockchain.NewProofOfWork(block, chain.Params.Difficulty)
 		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
 		}
 		fmt.Println()
 
-		if len(block.PrevHash) == 0 {
+		if iter.Done() {
 			break
 		}
 	}
 }
 
+// getTxProof affiche la preuve d'inclusion d'une transaction minée, encodée en hexadécimal
+func (cli *CommandLine) getTxProof(txID, nodeID string) {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic("Transaction ID is not valid hex")
+	}
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Database.Close()
+
+	proof, err := chain.GetTxProof(id)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Block: %x (height %d)\n", proof.Header.Hash, proof.Header.Height)
+	fmt.Printf("Proof: %x\n", proof.Serialize())
+}
+
+// verifyTxProof vérifie une preuve d'inclusion avec les seuls en-têtes de la chaîne locale
+func (cli *CommandLine) verifyTxProof(proofHex, nodeID string) {
+	data, err := hex.DecodeString(proofHex)
+	if err != nil {
+		log.Panic("Proof is not valid hex")
+	}
+	proof, err := blockchain.DeserializeTxProof(data)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Database.Close()
+
+	confirmations, err := chain.VerifyTxProof(proof)
+	if err != nil {
+		fmt.Printf("Invalid proof: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Transaction %x is in block %x with %d confirmations\n", proof.Proof.TxID, proof.Header.Hash, confirmations)
+}
+
 // createBlockChain crée une nouvelle blockchain avec l'adresse genesis donnée
-func (cli *CommandLine) createBlockChain(address, nodeID string) {
+// Si regtest est true, la chaîne utilise les paramètres de test et accepte la commande generate
+func (cli *CommandLine) createBlockChain(address, nodeID string, regtest bool) {
 	if !wallet.ValidateAddress(address) {
 		log.Panic("Address is not Valid")
 	}
-	chain := blockchain.CreateBlockChain(address, nodeID)
+	params := blockchain.MainParams
+	if regtest {
+		params = blockchain.RegtestParams
+	}
+	chain := blockchain.CreateBlockChain(address, nodeID, params)
 	defer chain.Database.Close()
 
-	UTXOSet := blockchain.UTXOSet{chain}
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 	UTXOSet.Reindex()
 
 	fmt.Println("Finished!")
 }
 
 // getBalance affiche le solde d'une adresse donnée
-func (cli *CommandLine) getBalance(address, nodeID string) {
+// En mode spv, le solde provient des transactions prouvées du wallet léger
+func (cli *CommandLine) getBalance(address, nodeID string, spv bool) {
 	if !wallet.ValidateAddress(address) {
 		log.Panic("Address is not Valid")
 	}
+	if spv {
+		headers := blockchain.OpenHeaderChain(nodeID)
+		defer headers.Database.Close()
+
+		pubKeyHash := wallet.Base58Decode([]byte(address))
+		pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+		fmt.Printf("Balance of %s: %d (light wallet, %d headers)\n", address, headers.GetBalance(pubKeyHash), headers.BestHeight()+1)
+		return
+	}
 	chain := blockchain.ContinueBlockChain(nodeID)
-	UTXOSet := blockchain.UTXOSet{chain}
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 	defer chain.Database.Close()
 
-	balance := 0
 	pubKeyHash := wallet.Base58Decode([]byte(address))
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUnspentTransactions(pubKeyHash)
-
-	for _, out := range UTXOs {
-		balance += out.Value
-	}
+	balance := UTXOSet.GetBalance(pubKeyHash)
 
-	fmt.Printf("Balance of %s: %d\n", address, balance)
+	fmt.Printf("Balance of %s: %d\n", address, balance.Confirmed)
+	fmt.Printf("  Immature (coinbase < %d confirmations): %d\n", blockchain.CoinbaseMaturity, balance.Immature)
+	fmt.Printf("  Unconfirmed (mempool): %+d\n", balance.Unconfirmed)
 }
 
 // send envoie des coins d'une adresse à une autre
 // Si mineNow est true, mine le bloc localement puis le propage
-func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow bool) {
+// Si lockTime est non nul, la transaction ne peut pas être minée avant cette hauteur ou ce timestamp
+// fee est laissé au mineur qui inclut la transaction
+// Sans mineNow, la transaction est soumise au nœud node, qui la relaie à ses pairs, sur une
+// connexion chiffrée si encrypt est true
+func (cli *CommandLine) send(from, to string, amount, fee int, lockTime int64, nodeID, node string, encrypt, mineNow bool) {
 	if !wallet.ValidateAddress(to) {
 		log.Panic("Address is not Valid")
 	}
@@ -150,7 +304,7 @@ func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow
 		log.Panic("Address is not Valid")
 	}
 	chain := blockchain.ContinueBlockChain(nodeID)
-	UTXOSet := blockchain.UTXOSet{chain}
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 	defer chain.Database.Close()
 
 	wallets, err := wallet.CreateWallets(nodeID)
@@ -159,22 +313,69 @@ func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow
 	}
 	wallet := wallets.GetWallet(from)
 
-	tx := blockchain.NewTransaction(&wallet, to, amount, &UTXOSet)
+	tx := blockchain.NewTransaction(&wallet, to, amount, fee, lockTime, &UTXOSet)
+	cli.submitTx(chain, tx, from, newClient(nodeID, encrypt), node, mineNow)
+}
+
+// sendData ancre des données hexadécimales dans une sortie OP_RETURN
+// La transaction dépense un output de l'adresse from et lui rend la monnaie, hors frais
+func (cli *CommandLine) sendData(from, dataHex string, fee int, nodeID, node string, encrypt, mineNow bool) {
+	if !wallet.ValidateAddress(from) {
+		log.Panic("Address is not Valid")
+	}
+	data, err := hex.DecodeString(dataHex)
+	if err != nil {
+		log.Panic("Data is not valid hex")
+	}
+	if len(data) > blockchain.MaxNullDataSize {
+		log.Panicf("Data is %d bytes, max %d", len(data), blockchain.MaxNullDataSize)
+	}
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Database.Close()
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallet := wallets.GetWallet(from)
+
+	tx := blockchain.NewDataTransaction(&wallet, data, fee, &UTXOSet)
+	cli.submitTx(chain, tx, from, newClient(nodeID, encrypt), node, mineNow)
+}
+
+// submitTx mine la transaction localement ou l'envoie au nœud node par client
+func (cli *CommandLine) submitTx(chain *blockchain.BlockChain, tx *blockchain.Transaction, from string, client *network.Node, node string, mineNow bool) {
 	if mineNow {
+		if err := chain.CheckLocksForNextBlock(tx); err != nil {
+			fmt.Println(err)
+			fmt.Println("The transaction cannot be mined yet, send it to the network instead.")
+			return
+		}
+
+		fee, err := chain.TransactionFee(tx)
+		if err != nil {
+			log.Panic(err)
+		}
+
 		fmt.Println("Mining transaction locally...")
-		cbTx := blockchain.CoinbaseTx(from, "")
+		cbTx := blockchain.CoinbaseTx(from, "", fee)
 		txs := []*blockchain.Transaction{cbTx, tx}
-		block := chain.MineBlock(txs)
-		UTXOSet.Update(block)
+		block, err := chain.MineBlock(context.Background(), txs)
+		if err != nil {
+			log.Panic(err)
+		}
 		fmt.Printf("Transaction mined successfully! Block hash: %x\n", block.Hash)
 	} else {
 		fmt.Println("Sending transaction to network...")
-		err := network.SendTx(network.KnownNodes[0], tx)
+		err := client.SendTx(node, tx)
 		if err != nil {
 			fmt.Printf("Failed to send transaction: %v\n", err)
 			fmt.Println("Network nodes are not available. Use -mine flag to mine locally.")
 			return
 		}
+		chain.SaveMempoolTx(tx)
 		fmt.Println("Transaction sent to network successfully!")
 	}
 
@@ -193,21 +394,96 @@ func (cli *CommandLine) Run() {
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	sendDataCmd := flag.NewFlagSet("senddata", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
+	getTxProofCmd := flag.NewFlagSet("gettxproof", flag.ExitOnError)
+	verifyTxProofCmd := flag.NewFlagSet("verifytxproof", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	minerCmd := flag.NewFlagSet("miner", flag.ExitOnError)
+	poolMinerCmd := flag.NewFlagSet("poolminer", flag.ExitOnError)
+	listBannedCmd := flag.NewFlagSet("listbanned", flag.ExitOnError)
+	setBanCmd := flag.NewFlagSet("setban", flag.ExitOnError)
+	clearBannedCmd := flag.NewFlagSet("clearbanned", flag.ExitOnError)
+	nodeKeyCmd := flag.NewFlagSet("nodekey", flag.ExitOnError)
+	generateCmd := flag.NewFlagSet("generate", flag.ExitOnError)
+	exportChainCmd := flag.NewFlagSet("exportchain", flag.ExitOnError)
+	importChainCmd := flag.NewFlagSet("importchain", flag.ExitOnError)
+	dumpUTXOSetCmd := flag.NewFlagSet("dumputxoset", flag.ExitOnError)
+	loadUTXOSetCmd := flag.NewFlagSet("loadutxoset", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
+	getBalanceSPV := getBalanceCmd.Bool("spv", false, "Read the balance from the light wallet")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
+	createBlockchainRegtest := createBlockchainCmd.Bool("regtest", false, "Use the regtest parameters: trivial difficulty and the generate command")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee left to the miner")
+	sendLockTime := sendCmd.Int64("locktime", 0, "Block height or Unix time before which the transaction cannot be mined")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendNode := sendCmd.String("node", network.KnownNodes[0], "Node the transaction is submitted to")
+	sendEncrypt := sendCmd.Bool("encrypt", false, "Submit the transaction over an encrypted connection")
+	sendDataFrom := sendDataCmd.String("from", "", "Source wallet address paying for the transaction")
+	sendDataHex := sendDataCmd.String("hex", "", "Hex encoded data to embed")
+	sendDataFee := sendDataCmd.Int("fee", 0, "Fee left to the miner")
+	sendDataMine := sendDataCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendDataNode := sendDataCmd.String("node", network.KnownNodes[0], "Node the transaction is submitted to")
+	sendDataEncrypt := sendDataCmd.Bool("encrypt", false, "Submit the transaction over an encrypted connection")
+	getTxProofID := getTxProofCmd.String("txid", "", "ID of the mined transaction")
+	verifyTxProofData := verifyTxProofCmd.String("proof", "", "Hex encoded proof printed by gettxproof")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeMineInterval := startNodeCmd.Duration("mineinterval", 10*time.Second, "Minimum delay between two mined blocks")
+	startNodeMineEmpty := startNodeCmd.Bool("mineempty", false, "Mine blocks even when the mempool is empty")
+	startNodeRPC := startNodeCmd.String("rpcaddr", "", "Address of the RPC server, NODE_ID+1000 on localhost by default")
+	startNodeSPV := startNodeCmd.Bool("spv", false, "Run a light node that only downloads block headers")
+	startNodeRescan := startNodeCmd.Bool("rescan", false, "Test the stored block filters of a light node again")
+	startNodeGenesis := startNodeCmd.String("genesis", "", "Hex genesis hash of the network a light node follows, required on its first start")
+	startNodeRegtest := startNodeCmd.Bool("regtest", false, "The genesis given with -genesis is the one of a regtest chain")
+	startNodeMaxInbound := startNodeCmd.Int("maxinbound", network.DefaultMaxInbound, "Maximum number of inbound peers")
+	startNodeMaxOutbound := startNodeCmd.Int("maxoutbound", network.DefaultMaxOutbound, "Maximum number of outbound peers")
+	startNodeOutbound := startNodeCmd.Int("outbound", network.DefaultTargetOutbound, "Number of outbound peers to look for")
+	startNodePool := startNodeCmd.String("pool", "", "Serve pool workers on HOST:PORT instead of mining locally")
+	startNodeShareDiff := startNodeCmd.Int("sharediff", network.DefaultShareDifficulty, "Leading zero bits of a pool share")
+	startNodeListen := startNodeCmd.String("listen", "", "Address to listen on, localhost:NODE_ID by default")
+	startNodeExternalIP := startNodeCmd.String("externalip", "", "Host or HOST:PORT announced to peers, the listen address by default")
+	startNodeSeeds := startNodeCmd.String("seeds", strings.Join(network.KnownNodes, ","), "Comma-separated seed nodes")
+	startNodeConnect := startNodeCmd.String("connect", "", "Comma-separated nodes, the only ones to connect to")
+	startNodeAddNode := startNodeCmd.String("addnode", "", "Comma-separated nodes to always stay connected to")
+	startNodeEncrypt := startNodeCmd.Bool("encrypt", false, "Encrypt every connection and refuse cleartext ones")
+	startNodeTrusted := startNodeCmd.String("trustedpeers", "", "Comma-separated identity keys of the only peers accepted, with -encrypt")
+	startNodePrune := startNodeCmd.String("prune", "", "Keep only this many blocks, or megabytes such as 550MB, of block bodies below the tip")
+	minerAddress := minerCmd.String("address", "", "Address receiving the block rewards")
+	minerRPC := minerCmd.String("rpc", "", "RPC address of the node, NODE_ID+1000 on localhost by default")
+	minerWorkers := minerCmd.Int("workers", 0, "Number of mining goroutines, one per CPU by default")
+	minerMineEmpty := minerCmd.Bool("mineempty", false, "Mine blocks even when the template has no transactions")
+	poolMinerPool := poolMinerCmd.String("pool", "", "Address of the mining pool")
+	poolMinerWorker := poolMinerCmd.String("worker", "", "Name of the worker, its shares are counted under it")
+	poolMinerAddress := poolMinerCmd.String("address", "", "Address receiving the worker's part of the rewards")
+	listBannedRPC := listBannedCmd.String("rpc", "", "RPC address of the node, NODE_ID+1000 on localhost by default")
+	setBanAddress := setBanCmd.String("address", "", "Peer address (HOST:PORT) or host to ban")
+	setBanDuration := setBanCmd.Duration("duration", network.DefaultBanDuration, "Length of the ban")
+	setBanRemove := setBanCmd.Bool("remove", false, "Lift the ban instead")
+	setBanRPC := setBanCmd.String("rpc", "", "RPC address of the node, NODE_ID+1000 on localhost by default")
+	clearBannedRPC := clearBannedCmd.String("rpc", "", "RPC address of the node, NODE_ID+1000 on localhost by default")
+	poolMinerWorkers := poolMinerCmd.Int("workers", 0, "Number of mining goroutines, one per CPU by default")
+	generateCount := generateCmd.Int("n", 1, "Number of blocks to mine")
+	generateAddress := generateCmd.String("address", "", "Address receiving the block rewards")
+	generateRPC := generateCmd.String("rpc", "", "RPC address of a running node, the blocks are mined locally when empty")
+	exportChainOut := exportChainCmd.String("out", "", "File the chain is exported to")
+	importChainIn := importChainCmd.String("in", "", "Chain file to import")
+	dumpUTXOSetOut := dumpUTXOSetCmd.String("out", "", "File the UTXO snapshot is written to")
+	loadUTXOSetIn := loadUTXOSetCmd.String("in", "", "UTXO snapshot to load")
+	loadUTXOSetCommitment := loadUTXOSetCmd.String("commitment", "", "Expected commitment of the snapshot, printed by dumputxoset on a trusted node")
 
 	switch os.Args[1] {
+	case "nodekey":
+		err := nodeKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "reindexutxo":
 		err := reindexUTXOCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -243,11 +519,76 @@ func (cli *CommandLine) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "gettxproof":
+		err := getTxProofCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "verifytxproof":
+		err := verifyTxProofCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "send":
 		err := sendCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "senddata":
+		err := sendDataCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "miner":
+		err := minerCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "poolminer":
+		err := poolMinerCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "listbanned":
+		err := listBannedCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "setban":
+		err := setBanCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "clearbanned":
+		err := clearBannedCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "generate":
+		err := generateCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "exportchain":
+		err := exportChainCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "importchain":
+		err := importChainCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "dumputxoset":
+		err := dumpUTXOSetCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "loadutxoset":
+		err := loadUTXOSetCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		runtime.Goexit()
@@ -258,7 +599,7 @@ func (cli *CommandLine) Run() {
 			getBalanceCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.getBalance(*getBalanceAddress, nodeID)
+		cli.getBalance(*getBalanceAddress, nodeID, *getBalanceSPV)
 	}
 
 	if createBlockchainCmd.Parsed() {
@@ -266,13 +607,33 @@ func (cli *CommandLine) Run() {
 			createBlockchainCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.createBlockChain(*createBlockchainAddress, nodeID)
+		cli.createBlockChain(*createBlockchainAddress, nodeID, *createBlockchainRegtest)
+	}
+
+	if nodeKeyCmd.Parsed() {
+		cli.nodeKey(nodeID)
 	}
 
 	if printChainCmd.Parsed() {
 		cli.printChain(nodeID)
 	}
 
+	if getTxProofCmd.Parsed() {
+		if *getTxProofID == "" {
+			getTxProofCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getTxProof(*getTxProofID, nodeID)
+	}
+
+	if verifyTxProofCmd.Parsed() {
+		if *verifyTxProofData == "" {
+			verifyTxProofCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.verifyTxProof(*verifyTxProofData, nodeID)
+	}
+
 	if createWalletCmd.Parsed() {
 		cli.createWallet(nodeID)
 	}
@@ -284,12 +645,21 @@ func (cli *CommandLine) Run() {
 	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 || *sendLockTime < 0 {
 			sendCmd.Usage()
 			runtime.Goexit()
 		}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendLockTime, nodeID, *sendNode, *sendEncrypt, *sendMine)
+	}
+
+	if sendDataCmd.Parsed() {
+		if *sendDataFrom == "" || *sendDataHex == "" || *sendDataFee < 0 {
+			sendDataCmd.Usage()
+			runtime.Goexit()
+		}
+
+		cli.sendData(*sendDataFrom, *sendDataHex, *sendDataFee, nodeID, *sendDataNode, *sendDataEncrypt, *sendDataMine)
 	}
 
 	if startNodeCmd.Parsed() {
@@ -298,6 +668,128 @@ func (cli *CommandLine) Run() {
 			startNodeCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.StartNode(nodeID, *startNodeMiner)
+		if *startNodeShareDiff < 1 ||
+			*startNodeMaxInbound < 0 || *startNodeMaxOutbound < 0 || *startNodeOutbound < 0 {
+			startNodeCmd.Usage()
+			runtime.Goexit()
+		}
+		policy := network.MiningPolicy{
+			Interval:        *startNodeMineInterval,
+			MineEmpty:       *startNodeMineEmpty,
+			PoolAddress:     *startNodePool,
+			ShareDifficulty: *startNodeShareDiff,
+		}
+		config := network.DefaultNetConfig(nodeID)
+		if *startNodeListen != "" {
+			config.Listen = *startNodeListen
+		}
+		config.External = *startNodeExternalIP
+		config.Seeds = parseAddressList(startNodeCmd, *startNodeSeeds)
+		config.Connect = parseAddressList(startNodeCmd, *startNodeConnect)
+		config.AddNodes = parseAddressList(startNodeCmd, *startNodeAddNode)
+		config.Encrypt = *startNodeEncrypt
+		if *startNodeTrusted != "" {
+			if !*startNodeEncrypt {
+				startNodeCmd.Usage()
+				runtime.Goexit()
+			}
+			config.Trusted = strings.Split(*startNodeTrusted, ",")
+		}
+		if *startNodePrune != "" {
+			target, err := blockchain.ParsePruneTarget(*startNodePrune)
+			if err != nil || *startNodeSPV {
+				if err != nil {
+					fmt.Println(err)
+				}
+				startNodeCmd.Usage()
+				runtime.Goexit()
+			}
+			config.Prune = target
+		}
+		config.MaxInbound = *startNodeMaxInbound
+		config.MaxOutbound = *startNodeMaxOutbound
+		config.TargetOutbound = *startNodeOutbound
+		genesis, err := hex.DecodeString(*startNodeGenesis)
+		if err != nil || (*startNodeRegtest && len(genesis) == 0) {
+			startNodeCmd.Usage()
+			runtime.Goexit()
+		}
+		params := blockchain.MainParams
+		if *startNodeRegtest {
+			params = blockchain.RegtestParams
+		}
+		cli.StartNode(nodeID, *startNodeMiner, *startNodeRPC, policy, config, *startNodeSPV, *startNodeRescan, genesis, params)
+	}
+
+	if minerCmd.Parsed() {
+		if !wallet.ValidateAddress(*minerAddress) || *minerWorkers < 0 {
+			minerCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.runMiner(*minerAddress, rpcAddressOrDefault(*minerRPC, nodeID), *minerWorkers, *minerMineEmpty)
+	}
+
+	if poolMinerCmd.Parsed() {
+		if *poolMinerPool == "" || *poolMinerWorker == "" || !wallet.ValidateAddress(*poolMinerAddress) || *poolMinerWorkers < 0 {
+			poolMinerCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.runPoolMiner(*poolMinerPool, *poolMinerWorker, *poolMinerAddress, *poolMinerWorkers)
+	}
+
+	if listBannedCmd.Parsed() {
+		cli.listBanned(rpcAddressOrDefault(*listBannedRPC, nodeID))
+	}
+
+	if setBanCmd.Parsed() {
+		if *setBanAddress == "" || *setBanDuration <= 0 {
+			setBanCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.setBan(rpcAddressOrDefault(*setBanRPC, nodeID), *setBanAddress, *setBanDuration, *setBanRemove)
+	}
+
+	if clearBannedCmd.Parsed() {
+		cli.clearBanned(rpcAddressOrDefault(*clearBannedRPC, nodeID))
+	}
+
+	if generateCmd.Parsed() {
+		if *generateCount < 1 || !wallet.ValidateAddress(*generateAddress) {
+			generateCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.generate(*generateCount, *generateAddress, nodeID, *generateRPC)
+	}
+
+	if exportChainCmd.Parsed() {
+		if *exportChainOut == "" {
+			exportChainCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.exportChain(nodeID, *exportChainOut)
+	}
+
+	if importChainCmd.Parsed() {
+		if *importChainIn == "" {
+			importChainCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.importChain(nodeID, *importChainIn)
+	}
+
+	if dumpUTXOSetCmd.Parsed() {
+		if *dumpUTXOSetOut == "" {
+			dumpUTXOSetCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.dumpUTXOSet(nodeID, *dumpUTXOSetOut)
+	}
+
+	if loadUTXOSetCmd.Parsed() {
+		if *loadUTXOSetIn == "" || *loadUTXOSetCommitment == "" {
+			loadUTXOSetCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.loadUTXOSet(nodeID, *loadUTXOSetIn, *loadUTXOSetCommitment)
 	}
 }
@@ -0,0 +1,42 @@
+package cli
+
+import (
+	"blockchain-go/blockchain"
+	"blockchain-go/network"
+	"context"
+	"fmt"
+	"log"
+)
+
+// generate mine count blocs récompensant address sur une chaîne regtest
+// Avec rpcAddress, le nœud en cours d'exécution mine les blocs avec les transactions de son mempool
+// et les annonce à ses pairs. Sinon les blocs sont minés sur la chaîne locale de NODE_ID, qui ne
+// doit pas être ouverte par un nœud
+func (cli *CommandLine) generate(count int, address, nodeID, rpcAddress string) {
+	if rpcAddress != "" {
+		var hashes []string
+		if err := network.CallRPC(rpcAddress, "generate", []interface{}{count, address}, &hashes); err != nil {
+			log.Panic(err)
+		}
+		for _, hash := range hashes {
+			fmt.Println(hash)
+		}
+		return
+	}
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Database.Close()
+	if !chain.Params.IsRegtest() {
+		fmt.Println("generate is only available on a regtest chain, created with createblockchain -regtest")
+		return
+	}
+
+	for i := 0; i < count; i++ {
+		cbTx := blockchain.CoinbaseTx(address, "", 0)
+		block, err := chain.MineBlock(context.Background(), []*blockchain.Transaction{cbTx})
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("%x\n", block.Hash)
+	}
+}
@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"blockchain-go/blockchain"
+	"blockchain-go/network"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+)
+
+// templatePollInterval est la période à laquelle le mineur externe vérifie le sommet du nœud
+const templatePollInterval = 2 * time.Second
+
+// runMiner mine pour un nœud distant : il demande un modèle de bloc en RPC, fait la preuve
+// de travail puis soumet le bloc. Le travail est abandonné dès que le sommet du nœud change
+// Sans mineEmpty, le mineur attend que le modèle contienne des transactions
+func (cli *CommandLine) runMiner(address, rpcAddress string, workers int, mineEmpty bool) {
+	miner := blockchain.NewMiner()
+	if workers > 0 {
+		miner.Workers = workers
+	}
+	fmt.Printf("Mining for %s through %s with %d workers\n", address, rpcAddress, miner.Workers)
+
+	for {
+		var template network.BlockTemplate
+		if err := network.CallRPC(rpcAddress, "getblocktemplate", nil, &template); err != nil {
+			fmt.Printf("Failed to get a block template: %v\n", err)
+			time.Sleep(templatePollInterval)
+			continue
+		}
+		if len(template.Transactions) == 0 && !mineEmpty {
+			time.Sleep(templatePollInterval)
+			continue
+		}
+
+		txs, err := template.DecodeTransactions()
+		if err != nil {
+			log.Panic(err)
+		}
+		txs = append(txs, blockchain.CoinbaseTx(address, "", template.Fees))
+
+		prevHash, err := hex.DecodeString(template.PrevHash)
+		if err != nil {
+			log.Panic(err)
+		}
+		block := blockchain.NewBlockTemplate(txs, prevHash, template.Height, template.MinTime)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go watchTemplate(ctx, cancel, rpcAddress, template.PrevHash)
+		err = miner.Mine(ctx, block, template.Difficulty)
+		cancel()
+		if err != nil {
+			fmt.Println("The node has a new tip, fetching a new template")
+			continue
+		}
+
+		var hash string
+		err = network.CallRPC(rpcAddress, "submitblock", []string{hex.EncodeToString(block.Serialize())}, &hash)
+		if err != nil {
+			fmt.Printf("Block %x rejected: %v\n", block.Hash, err)
+			continue
+		}
+		fmt.Printf("Block %s accepted at height %d\n", hash, block.Height)
+	}
+}
+
+// watchTemplate annule le minage lorsque le sommet du nœud n'est plus prevHash
+func watchTemplate(ctx context.Context, cancel context.CancelFunc, rpcAddress, prevHash string) {
+	ticker := time.NewTicker(templatePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var template network.BlockTemplate
+			err := network.CallRPC(rpcAddress, "getblocktemplate", nil, &template)
+			if err == nil && template.PrevHash != prevHash {
+				cancel()
+				return
+			}
+		}
+	}
+}
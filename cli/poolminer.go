@@ -0,0 +1,123 @@
+package cli
+
+import (
+	"blockchain-go/blockchain"
+	"blockchain-go/network"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+)
+
+// runPoolMiner mine des parts pour un pool : il s'authentifie avec le nom du worker et son
+// adresse de paiement, cherche des nonces à la difficulté des parts et les soumet
+// Chaque nouveau travail annoncé par le pool remplace le travail en cours
+func (cli *CommandLine) runPoolMiner(poolAddress, worker, address string, workers int) {
+	miner := blockchain.NewMiner()
+	if workers > 0 {
+		miner.Workers = workers
+	}
+
+	conn, err := net.Dial("tcp", poolAddress)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer conn.Close()
+	fmt.Printf("Mining for pool %s as %s with %d workers\n", poolAddress, worker, miner.Workers)
+
+	jobs := make(chan network.PoolJob, 1)
+	go readPool(conn, jobs)
+
+	id := 1
+	authorize := network.StratumMessage{ID: &id, Method: "mining.authorize", Params: mustParams(worker, address)}
+	if err := network.WriteStratumMessage(conn, authorize); err != nil {
+		log.Panic(err)
+	}
+
+	job := <-jobs
+	for {
+		header, err := job.Header()
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("New job %s for block %d, share difficulty %d\n", job.JobID, job.Height, job.ShareDifficulty)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func(job network.PoolJob) {
+			defer close(done)
+
+			// Une part est trouvée avant que le mineur ne vérifie l'annulation, d'où le test à chaque tour
+			for nonce := 0; nonce <= blockchain.MaxNonce && ctx.Err() == nil; {
+				found, _, err := miner.SearchNonce(ctx, header, job.Difficulty, nonce, job.ShareDifficulty)
+				if err != nil {
+					return
+				}
+
+				id++
+				submit := network.StratumMessage{ID: &id, Method: "mining.submit", Params: mustParams(worker, job.JobID, found)}
+				if err := network.WriteStratumMessage(conn, submit); err != nil {
+					log.Panic(err)
+				}
+				nonce = found + 1
+			}
+		}(job)
+
+		job = <-jobs
+		cancel()
+		<-done
+	}
+}
+
+// readPool lit les messages du pool : les nouveaux travaux sont transmis sur jobs,
+// les réponses aux parts soumises sont affichées
+func readPool(conn net.Conn, jobs chan network.PoolJob) {
+	accepted, rejected := 0, 0
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var message network.StratumMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			log.Panic(err)
+		}
+
+		switch {
+		case message.Method == "mining.notify":
+			var job network.PoolJob
+			if err := json.Unmarshal(message.Params, &job); err != nil {
+				log.Panic(err)
+			}
+			// Seul le dernier travail compte, un travail non commencé est remplacé
+			select {
+			case <-jobs:
+			default:
+			}
+			jobs <- job
+		case message.ID != nil && *message.ID == 1:
+			if message.Error != "" {
+				log.Panicf("Pool refused the worker: %s", message.Error)
+			}
+			fmt.Println("Worker authorized by the pool")
+		case message.Error != "":
+			rejected++
+			fmt.Printf("Share rejected: %s (%d accepted, %d rejected)\n", message.Error, accepted, rejected)
+		default:
+			accepted++
+			fmt.Printf("Share accepted (%d accepted, %d rejected)\n", accepted, rejected)
+		}
+	}
+
+	log.Panic("Connection to the pool lost")
+}
+
+// mustParams encode les paramètres d'une requête au pool en tableau JSON
+func mustParams(params ...interface{}) json.RawMessage {
+	data, err := json.Marshal(params)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return data
+}
@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"blockchain-go/blockchain"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+)
+
+// dumpUTXOSet écrit un snapshot du set UTXO du nœud et affiche son commitment
+// Comme pour exportchain, le fichier est écrit à côté puis renommé
+func (cli *CommandLine) dumpUTXOSet(nodeID, out string) {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Database.Close()
+
+	tmp := out + ".part"
+	file, err := os.Create(tmp)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	header, commitment, err := blockchain.UTXOSet{Blockchain: chain}.DumpSnapshot(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Panic(err)
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Wrote %d transactions with unspent outputs at block %x (height %d) to %s\n", header.Coins, header.BlockHash, header.Height, out)
+	fmt.Printf("Commitment: %x\n", commitment)
+}
+
+// loadUTXOSet crée la chaîne du nœud à partir d'un snapshot du set UTXO
+// Le commitment attendu vient d'un nœud de confiance : c'est lui qui garantit le set chargé
+func (cli *CommandLine) loadUTXOSet(nodeID, in, commitmentHex string) {
+	commitment, err := hex.DecodeString(commitmentHex)
+	if err != nil {
+		log.Panic("Commitment is not valid hex")
+	}
+
+	chain, header, err := blockchain.LoadUTXOSnapshot(nodeID, in, commitment)
+	if chain != nil {
+		defer chain.Database.Close()
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Loaded %d transactions with unspent outputs at block %x (height %d)\n", header.Coins, header.BlockHash, header.Height)
+	fmt.Println("The node validates new blocks from there, the blocks below are not downloaded")
+}
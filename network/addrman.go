@@ -0,0 +1,506 @@
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"log"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const addrBookFile = "./tmp/peers_%s.data"
+
+const (
+	newBucketCount   = 64 // Buckets of addresses heard of but never connected to
+	triedBucketCount = 16 // Buckets of addresses we successfully connected to
+	bucketSize       = 32
+
+	maxAddrPerMessage  = 1000                // Addresses in an addr message, larger ones are refused
+	getAddrPercent     = 23                  // Share of the book given in answer to getaddr
+	addrHorizon        = 30 * 24 * time.Hour // Addresses not heard of for this long are forgotten
+	addrRelayFreshness = 10 * time.Minute    // Only addresses this recent are relayed
+	addrRelayPeers     = 2                   // Peers a fresh address is relayed to
+	addrRelayMaxSize   = 10                  // Only small addr messages are relayed, not getaddr answers
+	addrGossipInterval = 5 * time.Minute     // Period of our own address announcements
+	addrSaveInterval   = time.Minute
+)
+
+// NetAddress est une adresse annoncée dans un message addr, avec l'heure où elle a été vue active
+type NetAddress struct {
+	Address   string
+	Services  uint64
+	Timestamp int64
+}
+
+// KnownAddress est une entrée du carnet d'adresses
+type KnownAddress struct {
+	Address     string
+	Services    uint64
+	Source      string    // Peer that told us about the address
+	LastSeen    time.Time // Last time the address was announced or connected to
+	LastAttempt time.Time
+	LastSuccess time.Time
+	Attempts    int // Failed attempts since the last success
+	Tried       bool
+}
+
+// isTerrible indique si une adresse ne vaut plus la peine d'être gardée ou partagée
+func (ka *KnownAddress) isTerrible(now time.Time) bool {
+	if now.Sub(ka.LastAttempt) < time.Minute {
+		return false
+	}
+	if ka.LastSeen.After(now.Add(10*time.Minute)) || now.Sub(ka.LastSeen) > addrHorizon {
+		return true
+	}
+	if ka.LastSuccess.IsZero() && ka.Attempts >= 3 {
+		return true
+	}
+
+	return now.Sub(ka.LastSuccess) > 7*24*time.Hour && ka.Attempts >= 10
+}
+
+// chance est la probabilité relative de choisir l'adresse pour une connexion sortante
+// Elle baisse après une tentative récente et avec les échecs
+func (ka *KnownAddress) chance(now time.Time) float64 {
+	chance := 1.0
+	if now.Sub(ka.LastAttempt) < 10*time.Minute {
+		chance *= 0.01
+	}
+	for i := 0; i < ka.Attempts && i < 8; i++ {
+		chance *= 0.66
+	}
+
+	return chance
+}
+
+// nextAttempt retourne l'heure à partir de laquelle l'adresse peut être retentée
+// Le délai double à chaque échec consécutif, jusqu'à reconnectMaxDelay
+func (ka *KnownAddress) nextAttempt() time.Time {
+	if ka.Attempts == 0 {
+		return ka.LastAttempt
+	}
+
+	delay := reconnectMaxDelay
+	if ka.Attempts <= 10 {
+		delay = reconnectBaseDelay << uint(ka.Attempts-1)
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+
+	return ka.LastAttempt.Add(delay)
+}
+
+// AddrManager est le carnet d'adresses du nœud
+// Les adresses entendues sont rangées dans les seaux "new", celles auxquelles le nœud s'est
+// connecté dans les seaux "tried". Le seau d'une adresse dépend d'une clé secrète et du groupe
+// réseau de l'adresse et de sa source : un seul pair ne peut pas remplir tout le carnet
+type AddrManager struct {
+	mutex      sync.Mutex
+	nodeID     string
+	local      string // Advertised address of the node, never added to its own book
+	key        [32]byte
+	addresses  map[string]*KnownAddress
+	newTable   [newBucketCount]map[string]bool
+	triedTable [triedBucketCount]map[string]bool
+	dirty      bool
+}
+
+// addrBookFileData est le contenu sauvegardé du carnet, les seaux sont recalculés au chargement
+type addrBookFileData struct {
+	Key       [32]byte
+	Addresses []KnownAddress
+}
+
+// NewAddrManager crée un carnet vide avec une nouvelle clé secrète
+// Avec un nodeID, le carnet est sauvegardé dans le fichier du nœud
+func NewAddrManager(nodeID string) *AddrManager {
+	am := &AddrManager{nodeID: nodeID, addresses: make(map[string]*KnownAddress)}
+	if _, err := rand.Read(am.key[:]); err != nil {
+		log.Panic(err)
+	}
+	for i := range am.newTable {
+		am.newTable[i] = make(map[string]bool)
+	}
+	for i := range am.triedTable {
+		am.triedTable[i] = make(map[string]bool)
+	}
+
+	return am
+}
+
+// LoadAddrManager charge le carnet d'adresses d'un nœud, ou en crée un vide
+func LoadAddrManager(nodeID string) *AddrManager {
+	am := NewAddrManager(nodeID)
+
+	data, err := os.ReadFile(fmt.Sprintf(addrBookFile, nodeID))
+	if os.IsNotExist(err) {
+		return am
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var content addrBookFileData
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&content); err != nil {
+		log.Panic(err)
+	}
+	am.key = content.Key
+	now := time.Now()
+	for i := range content.Addresses {
+		ka := content.Addresses[i]
+		if ka.isTerrible(now) {
+			continue
+		}
+		am.addresses[ka.Address] = &ka
+		if ka.Tried {
+			am.triedTable[am.triedBucket(ka.Address)][ka.Address] = true
+		} else {
+			am.newTable[am.newBucket(ka.Address, ka.Source)][ka.Address] = true
+		}
+	}
+
+	return am
+}
+
+// Save écrit le carnet dans le fichier du nœud s'il a changé
+func (am *AddrManager) Save() {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	if am.nodeID == "" || !am.dirty {
+		return
+	}
+
+	content := addrBookFileData{Key: am.key}
+	for _, ka := range am.addresses {
+		content.Addresses = append(content.Addresses, *ka)
+	}
+
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(content); err != nil {
+		log.Panic(err)
+	}
+	if err := os.WriteFile(fmt.Sprintf(addrBookFile, am.nodeID), buff.Bytes(), 0644); err != nil {
+		log.Panic(err)
+	}
+	am.dirty = false
+}
+
+// addressGroup retourne le groupe réseau d'une adresse : le /16 d'une IPv4, le /32 d'une IPv6,
+// ou le nom d'hôte
+func addressGroup(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d", ip4[0], ip4[1])
+	}
+	return fmt.Sprintf("%x", []byte(ip[:4]))
+}
+
+// bucketIndex hashe des données avec la clé secrète du carnet et retourne un seau parmi count
+func (am *AddrManager) bucketIndex(count int, parts ...string) int {
+	h := sha256.New()
+	h.Write(am.key[:])
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+
+	return int(binary.BigEndian.Uint64(h.Sum(nil)[:8]) % uint64(count))
+}
+
+func (am *AddrManager) newBucket(address, source string) int {
+	return am.bucketIndex(newBucketCount, addressGroup(address), addressGroup(source))
+}
+
+func (am *AddrManager) triedBucket(address string) int {
+	return am.bucketIndex(triedBucketCount, addressGroup(address), address)
+}
+
+// Add ajoute une adresse annoncée par source, ou rafraîchit son horodatage
+// Retourne true si l'adresse était inconnue ou si elle a été vue plus récemment
+func (am *AddrManager) Add(address string, services uint64, timestamp time.Time, source string) bool {
+	if address == "" || address == am.local {
+		return false
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return false
+	}
+
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	now := time.Now()
+	if timestamp.After(now.Add(10 * time.Minute)) {
+		timestamp = now.Add(-5 * 24 * time.Hour)
+	}
+
+	if ka, ok := am.addresses[address]; ok {
+		ka.Services |= services
+		if !timestamp.After(ka.LastSeen) {
+			return false
+		}
+		ka.LastSeen = timestamp
+		am.dirty = true
+		return true
+	}
+
+	ka := &KnownAddress{Address: address, Services: services, Source: source, LastSeen: timestamp}
+	bucket := am.newTable[am.newBucket(address, source)]
+	if len(bucket) >= bucketSize {
+		am.evict(bucket, now)
+	}
+	bucket[address] = true
+	am.addresses[address] = ka
+	am.dirty = true
+
+	return true
+}
+
+// evict fait de la place dans un seau "new" plein : la plus mauvaise adresse, sinon la plus ancienne,
+// est oubliée. Le verrou doit être tenu
+func (am *AddrManager) evict(bucket map[string]bool, now time.Time) {
+	var worst *KnownAddress
+	for address := range bucket {
+		ka := am.addresses[address]
+		if ka.isTerrible(now) {
+			worst = ka
+			break
+		}
+		if worst == nil || ka.LastSeen.Before(worst.LastSeen) {
+			worst = ka
+		}
+	}
+
+	delete(bucket, worst.Address)
+	delete(am.addresses, worst.Address)
+}
+
+// Attempt note une tentative de connexion vers une adresse
+func (am *AddrManager) Attempt(address string) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	if ka, ok := am.addresses[address]; ok {
+		ka.LastAttempt = time.Now()
+		am.dirty = true
+	}
+}
+
+// Failed note l'échec d'une connexion et retourne le délai avant la prochaine tentative
+func (am *AddrManager) Failed(address string) (time.Duration, bool) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	ka, ok := am.addresses[address]
+	if !ok {
+		return 0, false
+	}
+	ka.Attempts++
+	ka.LastAttempt = time.Now()
+	am.dirty = true
+
+	return time.Until(ka.nextAttempt()).Round(time.Second), true
+}
+
+// Good note une connexion réussie : l'adresse passe dans les seaux "tried"
+// Si son seau est plein, l'adresse la plus ancienne du seau retourne dans les seaux "new"
+func (am *AddrManager) Good(address string) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	ka, ok := am.addresses[address]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	ka.Attempts = 0
+	ka.LastSuccess = now
+	ka.LastSeen = now
+	am.dirty = true
+	if ka.Tried {
+		return
+	}
+
+	delete(am.newTable[am.newBucket(address, ka.Source)], address)
+	bucket := am.triedTable[am.triedBucket(address)]
+	if len(bucket) >= bucketSize {
+		var oldest *KnownAddress
+		for other := range bucket {
+			if oldest == nil || am.addresses[other].LastSuccess.Before(oldest.LastSuccess) {
+				oldest = am.addresses[other]
+			}
+		}
+		delete(bucket, oldest.Address)
+		oldest.Tried = false
+		newBucket := am.newTable[am.newBucket(oldest.Address, oldest.Source)]
+		if len(newBucket) >= bucketSize {
+			am.evict(newBucket, now)
+		}
+		newBucket[oldest.Address] = true
+	}
+	bucket[address] = true
+	ka.Tried = true
+}
+
+// Retryable indique si une adresse peut être tentée, son délai après un échec étant écoulé
+func (am *AddrManager) Retryable(address string) bool {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	ka, ok := am.addresses[address]
+	return !ok || !time.Now().Before(ka.nextAttempt())
+}
+
+// Select choisit une adresse pour une connexion sortante, dans les seaux "tried" ou "new" à parts
+// égales, en favorisant les adresses sans échec récent. skip écarte les pairs déjà connectés ou bannis
+// Retourne "" si aucune adresse n'est disponible
+func (am *AddrManager) Select(skip func(address string) bool) string {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	now := time.Now()
+	var tried, fresh []*KnownAddress
+	for _, ka := range am.addresses {
+		if now.Before(ka.nextAttempt()) || skip(ka.Address) {
+			continue
+		}
+		if ka.Tried {
+			tried = append(tried, ka)
+		} else {
+			fresh = append(fresh, ka)
+		}
+	}
+
+	candidates := fresh
+	if len(tried) > 0 && (len(fresh) == 0 || mrand.Intn(2) == 0) {
+		candidates = tried
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	// Le facteur grandit à chaque tirage refusé : la boucle finit toujours
+	for factor := 1.0; ; factor *= 1.2 {
+		ka := candidates[mrand.Intn(len(candidates))]
+		if mrand.Float64() < factor*ka.chance(now) {
+			return ka.Address
+		}
+	}
+}
+
+// GetAddresses retourne un échantillon aléatoire du carnet pour répondre à getaddr
+func (am *AddrManager) GetAddresses() []NetAddress {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	now := time.Now()
+	var list []NetAddress
+	for _, ka := range am.addresses {
+		if !ka.isTerrible(now) {
+			list = append(list, NetAddress{ka.Address, ka.Services, ka.LastSeen.Unix()})
+		}
+	}
+
+	mrand.Shuffle(len(list), func(i, j int) { list[i], list[j] = list[j], list[i] })
+	// Un petit carnet est donné en entier, sinon le nœud qui le demande n'apprendrait presque rien
+	count := len(list) * getAddrPercent / 100
+	if count < addrRelayMaxSize {
+		count = addrRelayMaxSize
+	}
+	if count > len(list) {
+		count = len(list)
+	}
+	if count > maxAddrPerMessage {
+		count = maxAddrPerMessage
+	}
+
+	return list[:count]
+}
+
+// IsKnown indique si une adresse est dans le carnet
+func (am *AddrManager) IsKnown(address string) bool {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	_, ok := am.addresses[address]
+	return ok
+}
+
+// Addresses retourne les entrées du carnet, triées par adresse
+func (am *AddrManager) Addresses() []KnownAddress {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	var list []KnownAddress
+	for _, ka := range am.addresses {
+		list = append(list, *ka)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+
+	return list
+}
+
+// Counts retourne le nombre d'adresses des seaux "new" et "tried"
+func (am *AddrManager) Counts() (fresh, tried int) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	for _, ka := range am.addresses {
+		if ka.Tried {
+			tried++
+		} else {
+			fresh++
+		}
+	}
+
+	return fresh, tried
+}
+
+// StartAddrGossip sauvegarde périodiquement le carnet, annonce notre adresse aux pairs et
+// demande de nouvelles adresses à l'un d'eux
+// La boucle s'arrête avec le nœud
+func (n *Node) StartAddrGossip() {
+	ticker := time.NewTicker(addrSaveInterval)
+	defer ticker.Stop()
+
+	lastGossip := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.quit:
+			return
+		}
+		n.addrBook.Save()
+
+		if time.Since(lastGossip) < addrGossipInterval {
+			continue
+		}
+		lastGossip = time.Now()
+		connected := n.peers.PeerAddresses()
+		if len(connected) == 0 {
+			continue
+		}
+		self := []NetAddress{{n.Address, n.services, time.Now().Unix()}}
+		for _, peer := range connected {
+			n.SendAddr(peer, self)
+		}
+		n.SendGetAddr(connected[mrand.Intn(len(connected))])
+	}
+}
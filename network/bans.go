@@ -0,0 +1,253 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+const banListFile = "./tmp/banlist_%s.data"
+
+const (
+	BanThreshold       = 100 // Score at which a peer is banned
+	DefaultBanDuration = 24 * time.Hour
+
+	// Points ajoutés au score d'un pair selon sa faute
+	scoreMalformed    = 20  // Message that cannot be decoded
+	scoreInvalidBlock = 100 // Block breaking the consensus rules
+	scoreInvalidTx    = 10  // Transaction breaking the consensus rules or with invalid scripts
+	scoreUnsolicited  = 10  // Data we never asked for
+)
+
+// Ban est une adresse bannie jusqu'à une date
+// L'adresse est soit celle d'un nœud (hôte:port), soit un hôte seul dont tous les ports sont bannis
+type Ban struct {
+	Address string
+	Until   time.Time
+	Reason  string
+}
+
+// BanList tient les scores de mauvaise conduite des pairs et les bannissements en cours
+// Les bannissements sont sauvegardés dans un fichier par nœud et survivent au redémarrage
+type BanList struct {
+	mutex      sync.Mutex
+	nodeID     string
+	scores     map[string]int
+	bans       map[string]Ban
+	disconnect func(address string) // Drops the session with a banned peer
+}
+
+// NewBanList crée une liste de bannissements vide
+// Avec un nodeID, les bannissements sont sauvegardés dans le fichier du nœud
+func NewBanList(nodeID string) *BanList {
+	return &BanList{nodeID: nodeID, scores: make(map[string]int), bans: make(map[string]Ban)}
+}
+
+// LoadBanList charge les bannissements enregistrés d'un nœud, en oubliant ceux qui ont expiré
+func LoadBanList(nodeID string) *BanList {
+	list := NewBanList(nodeID)
+
+	data, err := os.ReadFile(fmt.Sprintf(banListFile, nodeID))
+	if os.IsNotExist(err) {
+		return list
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&list.bans); err != nil {
+		log.Panic(err)
+	}
+	list.mutex.Lock()
+	list.expire()
+	list.mutex.Unlock()
+
+	return list
+}
+
+// save écrit les bannissements dans le fichier du nœud, le verrou doit être tenu
+func (bl *BanList) save() {
+	if bl.nodeID == "" {
+		return
+	}
+
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(bl.bans); err != nil {
+		log.Panic(err)
+	}
+	if err := os.WriteFile(fmt.Sprintf(banListFile, bl.nodeID), content.Bytes(), 0644); err != nil {
+		log.Panic(err)
+	}
+}
+
+// expire retire les bannissements arrivés à échéance, le verrou doit être tenu
+func (bl *BanList) expire() {
+	now := time.Now()
+	changed := false
+	for address, ban := range bl.bans {
+		if !now.Before(ban.Until) {
+			delete(bl.bans, address)
+			changed = true
+		}
+	}
+	if changed {
+		bl.save()
+	}
+}
+
+// Misbehaving ajoute score au score de mauvaise conduite d'un pair
+// Le pair est banni pour DefaultBanDuration quand son score atteint BanThreshold
+func (bl *BanList) Misbehaving(address string, score int, reason string) {
+	if address == "" {
+		return
+	}
+
+	bl.mutex.Lock()
+	bl.scores[address] += score
+	total := bl.scores[address]
+	bl.mutex.Unlock()
+
+	fmt.Printf("Peer %s misbehaving (+%d, score %d): %s\n", address, score, total, reason)
+	if total >= BanThreshold {
+		bl.Ban(address, DefaultBanDuration, reason)
+	}
+}
+
+// Ban bannit une adresse pour duration et déconnecte le pair correspondant
+func (bl *BanList) Ban(address string, duration time.Duration, reason string) {
+	bl.mutex.Lock()
+	bl.bans[address] = Ban{address, time.Now().Add(duration), reason}
+	delete(bl.scores, address)
+	bl.save()
+	bl.mutex.Unlock()
+
+	fmt.Printf("Banned %s for %s: %s\n", address, duration, reason)
+	if bl.disconnect != nil {
+		bl.disconnect(address)
+	}
+}
+
+// Unban lève le bannissement d'une adresse
+// Retourne false si l'adresse n'était pas bannie
+func (bl *BanList) Unban(address string) bool {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	if _, ok := bl.bans[address]; !ok {
+		return false
+	}
+	delete(bl.bans, address)
+	bl.save()
+
+	return true
+}
+
+// Clear lève tous les bannissements et remet les scores à zéro
+func (bl *BanList) Clear() {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	bl.bans = make(map[string]Ban)
+	bl.scores = make(map[string]int)
+	bl.save()
+}
+
+// List retourne les bannissements en cours, triés par adresse
+func (bl *BanList) List() []Ban {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	bl.expire()
+	var list []Ban
+	for _, ban := range bl.bans {
+		list = append(list, ban)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+
+	return list
+}
+
+// IsBanned indique si une adresse est bannie, elle-même ou par son hôte
+func (bl *BanList) IsBanned(address string) bool {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	now := time.Now()
+	if ban, ok := bl.bans[address]; ok && now.Before(ban.Until) {
+		return true
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		if ban, ok := bl.bans[host]; ok && now.Before(ban.Until) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remoteHost retourne l'hôte à l'origine d'une connexion entrante
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+
+	return host
+}
+
+// isLoopback indique si origin est l'hôte local
+func isLoopback(origin string) bool {
+	ip := net.ParseIP(origin)
+	return origin == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// malformedError est la panique d'un gestionnaire qui n'a pas pu décoder le message d'un pair
+type malformedError struct {
+	err error
+}
+
+// invalidTxError est le rejet d'une transaction par les règles de consensus ou ses scripts
+// Les rejets de politique, les conflits avec le mempool et les entrées déjà dépensées par un bloc
+// peuvent venir d'un pair honnête : ils ne lui sont pas reprochés
+type invalidTxError struct {
+	err error
+}
+
+func (e invalidTxError) Error() string { return e.err.Error() }
+func (e invalidTxError) Unwrap() error { return e.err }
+
+// decodePeerData décode des données reçues d'un pair avec decode, qui panique sur des données
+// invalides : la panique devient celle d'un message malformé
+func decodePeerData[T any](decode func([]byte) T, data []byte) T {
+	defer func() {
+		if r := recover(); r != nil {
+			panic(malformedError{fmt.Errorf("%v", r)})
+		}
+	}()
+
+	return decode(data)
+}
+
+// recoverMalformed transforme la panique d'un décodeur en faute de l'origine du message : l'hôte
+// de la connexion qui l'a apporté, ou l'identité vérifiée de son expéditeur une fois connue
+// Appelée avec defer dans les gestionnaires de connexion, elle empêche un message invalide
+// d'arrêter le nœud. Les autres paniques viennent du nœud lui-même : elles sont affichées avec leur
+// pile sans être reprochées au pair
+func (n *Node) recoverMalformed(origin, command *string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if malformed, ok := r.(malformedError); ok {
+		n.bans.Misbehaving(*origin, scoreMalformed, fmt.Sprintf("malformed %s message: %v", *command, malformed.err))
+		return
+	}
+
+	fmt.Printf("Internal error while handling a %s message: %v\n%s", *command, r, debug.Stack())
+}
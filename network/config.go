@@ -0,0 +1,133 @@
+package network
+
+import (
+	"blockchain-go/blockchain"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// NetConfig règle les adresses réseau d'un nœud
+// L'adresse d'écoute et l'adresse annoncée aux pairs sont distinctes : un nœud peut écouter sur
+// toutes ses interfaces ([::]:3000) et s'annoncer sous son adresse publique
+type NetConfig struct {
+	Listen   string   // Bind address, localhost:NODE_ID by default
+	External string   // Advertised host or HOST:PORT, the listen address by default
+	Seeds    []string // Seed nodes added to the address book at startup
+	Connect  []string // When set, the only nodes the node connects to
+	AddNodes []string // Nodes the node always tries to stay connected to
+	Encrypt  bool     // Encrypt every connection and refuse cleartext ones
+	Trusted  []string // Identity keys of the only peers accepted on encrypted connections
+
+	Prune blockchain.PruneTarget // Block bodies kept below the tip, all of them when unset
+
+	MaxInbound     int // Peers that connected to us
+	MaxOutbound    int // Peers we connected to
+	TargetOutbound int // Outbound peers the node keeps trying to reach
+}
+
+// DefaultNetConfig retourne la configuration d'un nœud local : écoute sur localhost:NODE_ID avec
+// les nœuds d'amorçage et les limites de pairs par défaut
+func DefaultNetConfig(nodeID string) NetConfig {
+	return NetConfig{
+		Listen:         net.JoinHostPort("localhost", nodeID),
+		Seeds:          KnownNodes,
+		MaxInbound:     DefaultMaxInbound,
+		MaxOutbound:    DefaultMaxOutbound,
+		TargetOutbound: DefaultTargetOutbound,
+	}
+}
+
+// ParseAddressList découpe une liste d'adresses HÔTE:PORT séparées par des virgules
+// Les adresses IPv6 s'écrivent entre crochets : [::1]:3000
+func ParseAddressList(list string) ([]string, error) {
+	var addresses []string
+	for _, address := range strings.Split(list, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", address, err)
+		}
+		addresses = append(addresses, address)
+	}
+
+	return addresses, nil
+}
+
+// advertisedAddress retourne l'adresse annoncée aux pairs
+// Sans adresse externe, c'est l'adresse d'écoute, ou localhost si le nœud écoute sur toutes ses
+// interfaces. Une adresse externe sans port prend le port d'écoute
+func (c NetConfig) advertisedAddress() (string, error) {
+	host, port, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %w", c.Listen, err)
+	}
+
+	if c.External != "" {
+		if _, _, err := net.SplitHostPort(c.External); err == nil {
+			return c.External, nil
+		}
+		return net.JoinHostPort(strings.Trim(c.External, "[]"), port), nil
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// enableEncryption active le chiffrement des connexions du nœud si la configuration le demande
+func (c NetConfig) enableEncryption(n *Node) error {
+	if !c.Encrypt {
+		return nil
+	}
+	if err := n.EnableEncryption(c.Trusted); err != nil {
+		return err
+	}
+	identity, err := NodeIdentity(n.ID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Encrypted transport on, node identity %s\n", identity)
+	if len(c.Trusted) > 0 {
+		fmt.Printf("Only %d trusted peers are accepted\n", len(c.Trusted))
+	}
+
+	return nil
+}
+
+// seedAddressBook ajoute au carnet d'adresses les nœuds d'amorçage et les nœuds imposés
+// Avec -connect, les nœuds d'amorçage sont ignorés
+func (c NetConfig) seedAddressBook(book *AddrManager) {
+	seeds := c.Seeds
+	if len(c.Connect) > 0 {
+		seeds = nil
+	}
+	for _, group := range [][]string{seeds, c.Connect, c.AddNodes} {
+		for _, node := range group {
+			book.Add(node, ServiceNetwork, time.Now(), node)
+		}
+	}
+}
+
+// fixedPeers retourne les nœuds auxquels le nœud se connecte quoi qu'il arrive
+func (c NetConfig) fixedPeers() []string {
+	return append(append([]string{}, c.Connect...), c.AddNodes...)
+}
+
+// spvServer retourne le nœud complet que suit un nœud léger : le premier nœud de -connect, sinon
+// le premier nœud d'amorçage
+func (c NetConfig) spvServer() string {
+	if len(c.Connect) > 0 {
+		return c.Connect[0]
+	}
+	if len(c.Seeds) > 0 {
+		return c.Seeds[0]
+	}
+
+	return ""
+}
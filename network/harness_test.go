@@ -0,0 +1,276 @@
+package network
+
+import (
+	"blockchain-go/blockchain"
+	"blockchain-go/wallet"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// blocksPath est le chemin de la base d'un nœud, comme dans le paquet blockchain
+const blocksPath = "./tmp/blocks_%s"
+
+// testNetwork est un réseau de nœuds complets lancés dans le processus du test, sur TCP ou sur un
+// réseau en mémoire. Les données des nœuds vivent dans un répertoire temporaire propre au test
+type testNetwork struct {
+	t         *testing.T
+	nodes     []*Node
+	wallets   *wallet.Wallets        // Wallets of the test, kept in memory
+	genesis   string                 // Address rewarded by the genesis block
+	transport func(string) Transport // Transport of a node, by listen address
+}
+
+// newTestNetwork crée count nœuds qui partagent le même bloc genesis et se connectent tous entre eux,
+// chacun sur un port TCP libre
+// Les nœuds sont arrêtés et leurs chaînes fermées à la fin du test
+func newTestNetwork(t *testing.T, count int) *testNetwork {
+	t.Helper()
+
+	ids := make([]string, count)
+	listens := make([]string, count)
+	for i := range ids {
+		ids[i] = freePort(t)
+		listens[i] = net.JoinHostPort("127.0.0.1", ids[i])
+	}
+
+	return buildTestNetwork(t, ids, listens, func(string) Transport { return TCPTransport{} })
+}
+
+// newMemoryTestNetwork crée count nœuds reliés par le réseau en mémoire mn, sans ouvrir de port
+// Le nœud i écoute sur 10.0.0.i:3000 : chaque nœud a son propre hôte, comme sur un vrai réseau
+func newMemoryTestNetwork(t *testing.T, count int, mn *MemoryNetwork) *testNetwork {
+	t.Helper()
+
+	ids := make([]string, count)
+	listens := make([]string, count)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i + 1)
+		listens[i] = net.JoinHostPort("10.0.0."+ids[i], "3000")
+	}
+
+	return buildTestNetwork(t, ids, listens, mn.Transport)
+}
+
+// buildTestNetwork crée les nœuds ids, à l'écoute sur listens, avec le transport donné
+func buildTestNetwork(t *testing.T, ids, listens []string, transport func(string) Transport) *testNetwork {
+	t.Helper()
+
+	// Les chemins des données sont relatifs (./tmp/...), le test travaille donc dans son propre
+	// répertoire
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir("tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tn := &testNetwork{t: t, wallets: &wallet.Wallets{Wallets: make(map[string]*wallet.Wallet)}, transport: transport}
+	tn.genesis = tn.NewAddress()
+
+	// Le genesis est horodaté : chaque nœud reçoit une copie de la chaîne du premier
+	chain := blockchain.CreateBlockChain(tn.genesis, ids[0], blockchain.RegtestParams)
+	blockchain.UTXOSet{Blockchain: chain}.Reindex()
+	chain.Database.Close()
+	for _, id := range ids[1:] {
+		copyDir(t, fmt.Sprintf(blocksPath, ids[0]), fmt.Sprintf(blocksPath, id))
+	}
+
+	// Chaque nœud n'amorce que sur les nœuds démarrés avant lui, qui écoutent déjà : chaque paire
+	// de nœuds est ainsi reliée par une seule connexion sortante
+	var started []string
+	for i, id := range ids {
+		config := DefaultNetConfig(id)
+		config.Listen = listens[i]
+		config.Seeds = append([]string{}, started...)
+		started = append(started, config.Listen)
+		tn.nodes = append(tn.nodes, NewNode(id, config, transport(config.Listen)))
+	}
+
+	t.Cleanup(tn.stop)
+
+	return tn
+}
+
+// Start démarre les nœuds, le nœud miner mine au profit de minerAddress
+func (tn *testNetwork) Start(miner int, minerAddress string) {
+	tn.t.Helper()
+
+	for i, n := range tn.nodes {
+		if i == miner {
+			n.SetMining(minerAddress, MiningPolicy{Interval: 100 * time.Millisecond})
+		}
+		if err := n.Start(blockchain.ContinueBlockChain(n.ID)); err != nil {
+			tn.t.Fatal(err)
+		}
+	}
+}
+
+// stop arrête les nœuds et ferme leurs chaînes
+func (tn *testNetwork) stop() {
+	for _, n := range tn.nodes {
+		n.Stop()
+	}
+	// Laisse les gestionnaires de connexion en cours finir avant de fermer les bases
+	time.Sleep(200 * time.Millisecond)
+	for _, n := range tn.nodes {
+		if n.Chain != nil {
+			n.Chain.Database.Close()
+		}
+	}
+}
+
+// NewAddress crée un wallet de test et retourne son adresse
+func (tn *testNetwork) NewAddress() string {
+	return tn.wallets.AddWallet()
+}
+
+// Send crée une transaction de from vers to avec l'UTXO set du nœud via, et la soumet à ce nœud
+// comme le fait la commande send
+func (tn *testNetwork) Send(via int, from, to string, amount, fee int) *blockchain.Transaction {
+	tn.t.Helper()
+
+	n := tn.nodes[via]
+	w := tn.wallets.GetWallet(from)
+	tx := blockchain.NewTransaction(&w, to, amount, fee, 0, &blockchain.UTXOSet{Blockchain: n.Chain})
+
+	client := NewNode("", NetConfig{}, tn.transport("client"))
+	if err := client.SendTx(n.Address, tx); err != nil {
+		tn.t.Fatal(err)
+	}
+
+	return tx
+}
+
+// WaitForPeers attend que chaque nœud ait terminé sa poignée de main avec tous les autres
+func (tn *testNetwork) WaitForPeers(timeout time.Duration) {
+	tn.t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for _, n := range tn.nodes {
+		for handshakes(n) < len(tn.nodes)-1 {
+			if time.Now().After(deadline) {
+				tn.t.Fatalf("node %s has %d of %d peers after %s", n.ID, handshakes(n), len(tn.nodes)-1, timeout)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+// handshakes compte les pairs d'un nœud dont la poignée de main est terminée
+func handshakes(n *Node) int {
+	count := 0
+	for _, peer := range n.Peers() {
+		if peer.Established() {
+			count++
+		}
+	}
+
+	return count
+}
+
+// WaitForMempool attend que la transaction soit dans le mempool de tous les nœuds
+func (tn *testNetwork) WaitForMempool(tx *blockchain.Transaction, timeout time.Duration) {
+	tn.t.Helper()
+
+	id := hex.EncodeToString(tx.ID)
+	deadline := time.Now().Add(timeout)
+	for _, n := range tn.nodes {
+		for !n.inMempool(id) {
+			if time.Now().After(deadline) {
+				tn.t.Fatalf("transaction %s did not reach node %s within %s", id, n.ID, timeout)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+// inMempool indique si une transaction est dans le mempool du nœud
+func (n *Node) inMempool(id string) bool {
+	n.poolMutex.Lock()
+	defer n.poolMutex.Unlock()
+
+	_, ok := n.memoryPool[id]
+	return ok
+}
+
+// WaitForHeight attend que tous les nœuds aient le même sommet, à la hauteur height au moins
+func (tn *testNetwork) WaitForHeight(height int, timeout time.Duration) {
+	tn.t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if tn.converged(height) {
+			return
+		}
+		if time.Now().After(deadline) {
+			for _, n := range tn.nodes {
+				tn.t.Logf("node %s: height %d, tip %x", n.ID, n.Chain.GetBestHeight(), n.Chain.LastHash())
+			}
+			tn.t.Fatalf("nodes did not converge to height %d within %s", height, timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// converged indique si tous les nœuds ont le même sommet, à la hauteur height au moins
+func (tn *testNetwork) converged(height int) bool {
+	first := tn.nodes[0].Chain
+	if first.GetBestHeight() < height {
+		return false
+	}
+	for _, n := range tn.nodes[1:] {
+		if !bytes.Equal(n.Chain.LastHash(), first.LastHash()) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Balance retourne le solde d'une adresse vu par le nœud node
+func (tn *testNetwork) Balance(node int, address string) blockchain.Balance {
+	pubKeyHash := wallet.Base58Decode([]byte(address))
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+
+	return blockchain.UTXOSet{Blockchain: tn.nodes[node].Chain}.GetBalance(pubKeyHash)
+}
+
+// freePort retourne un port TCP libre de la machine
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// copyDir copie les fichiers du répertoire src dans dst
+func copyDir(t *testing.T, src, dst string) {
+	t.Helper()
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dst, entry.Name()), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
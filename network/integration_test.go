@@ -0,0 +1,436 @@
+package network
+
+import (
+	"blockchain-go/blockchain"
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestNodesConverge lance trois nœuds, mine des transactions soumises à différents nœuds et
+// vérifie que tous finissent sur le même sommet avec les mêmes soldes
+func TestNodesConverge(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	alice := tn.genesis
+	bob := tn.NewAddress()
+	carol := tn.NewAddress()
+	miner := tn.NewAddress()
+
+	tn.Start(1, miner)
+	tn.WaitForPeers(10 * time.Second)
+
+	// La transaction est soumise à un nœud qui ne mine pas et doit être relayée au mineur
+	tn.Send(0, alice, bob, 5, 1)
+	tn.WaitForHeight(1, 30*time.Second)
+	tn.checkBalances(map[string]blockchain.Balance{
+		alice: {Confirmed: blockchain.Subsidy - 6},
+		bob:   {Confirmed: 5},
+		miner: {Immature: blockchain.Subsidy + 1},
+	})
+
+	// Bob dépense une sortie confirmée, soumise au dernier nœud
+	tn.Send(2, bob, carol, 3, 1)
+	tn.WaitForHeight(2, 30*time.Second)
+	tn.checkBalances(map[string]blockchain.Balance{
+		alice: {Confirmed: blockchain.Subsidy - 6},
+		bob:   {Confirmed: 1},
+		carol: {Confirmed: 3},
+		miner: {Immature: 2*blockchain.Subsidy + 2},
+	})
+}
+
+// checkBalances vérifie que chaque nœud voit les soldes attendus
+func (tn *testNetwork) checkBalances(expected map[string]blockchain.Balance) {
+	tn.t.Helper()
+
+	for i, n := range tn.nodes {
+		for address, balance := range expected {
+			if got := tn.Balance(i, address); got != balance {
+				tn.t.Errorf("node %s: balance of %s is %+v, want %+v", n.ID, address, got, balance)
+			}
+		}
+	}
+}
+
+// TestGenerateMaturesCoinbase produit assez de blocs avec Generate pour que la récompense du
+// premier devienne dépensable, et vérifie que les autres nœuds suivent
+func TestGenerateMaturesCoinbase(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	miner := tn.NewAddress()
+	bob := tn.NewAddress()
+
+	tn.Start(-1, "")
+	tn.WaitForPeers(10 * time.Second)
+
+	// Le bloc suivant aura la hauteur CoinbaseMaturity+1 : seule la récompense du bloc 1 est mûre
+	if _, err := tn.nodes[0].Generate(blockchain.CoinbaseMaturity, miner); err != nil {
+		t.Fatal(err)
+	}
+	tn.WaitForHeight(blockchain.CoinbaseMaturity, time.Minute)
+	tn.checkBalances(map[string]blockchain.Balance{
+		miner: {Confirmed: blockchain.Subsidy, Immature: (blockchain.CoinbaseMaturity - 1) * blockchain.Subsidy},
+	})
+
+	tx := tn.Send(1, miner, bob, 7, 1)
+	tn.WaitForMempool(tx, 10*time.Second)
+	if _, err := tn.nodes[1].Generate(1, miner); err != nil {
+		t.Fatal(err)
+	}
+	tn.WaitForHeight(blockchain.CoinbaseMaturity+1, 30*time.Second)
+	tn.checkBalances(map[string]blockchain.Balance{
+		bob: {Confirmed: 7},
+	})
+}
+
+// TestMempoolRejectsInvalidTxs vérifie que le mempool refuse une transaction dont l'ID ne
+// correspond pas au contenu, une transaction aux scripts invalides et une double dépense
+func TestMempoolRejectsInvalidTxs(t *testing.T) {
+	tn := newMemoryTestNetwork(t, 1, NewMemoryNetwork(4))
+	alice := tn.genesis
+	bob := tn.NewAddress()
+	carol := tn.NewAddress()
+
+	tn.Start(-1, "")
+	n := tn.nodes[0]
+	w := tn.wallets.GetWallet(alice)
+	utxo := &blockchain.UTXOSet{Blockchain: n.Chain}
+
+	// Les deux transactions sont créées avant que le mempool ne retienne la première : elles
+	// dépensent la même sortie
+	tx := blockchain.NewTransaction(&w, bob, 5, 1, 0, utxo)
+	double := blockchain.NewTransaction(&w, carol, 5, 1, 0, utxo)
+
+	forged := *tx
+	forged.Outputs = append([]blockchain.TXOutput{}, tx.Outputs...)
+	forged.Outputs[0].Value++
+	if err := n.AddToMempool(forged); err == nil {
+		t.Error("transaction with an ID that does not match its contents was accepted")
+	}
+	forged.ID = forged.Hash()
+	if err := n.AddToMempool(forged); err == nil {
+		t.Error("transaction with outputs changed after signing was accepted")
+	}
+
+	if err := n.AddToMempool(*tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.AddToMempool(*double); err == nil {
+		t.Error("transaction spending an output already spent in the mempool was accepted")
+	}
+	if !n.inMempool(hex.EncodeToString(tx.ID)) || n.inMempool(hex.EncodeToString(double.ID)) {
+		t.Error("mempool does not hold only the first transaction")
+	}
+}
+
+// TestMempoolEvictsDoubleSpends vérifie qu'une transaction du mempool dont la sortie est dépensée
+// par un bloc reçu d'un pair quitte le mempool et n'empêche pas le nœud de miner
+func TestMempoolEvictsDoubleSpends(t *testing.T) {
+	tn := newMemoryTestNetwork(t, 2, NewMemoryNetwork(6))
+	alice := tn.genesis
+	bob := tn.NewAddress()
+	carol := tn.NewAddress()
+	miner := tn.NewAddress()
+
+	tn.Start(-1, "")
+	tn.WaitForPeers(10 * time.Second)
+	w := tn.wallets.GetWallet(alice)
+	utxo := &blockchain.UTXOSet{Blockchain: tn.nodes[0].Chain}
+	tx := blockchain.NewTransaction(&w, bob, 5, 1, 0, utxo)
+	double := blockchain.NewTransaction(&w, carol, 5, 1, 0, utxo)
+
+	// AddToMempool ne relaie pas : chaque nœud ne connaît que sa transaction
+	if err := tn.nodes[1].AddToMempool(*tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tn.nodes[0].AddToMempool(*double); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tn.nodes[0].Generate(1, miner); err != nil {
+		t.Fatal(err)
+	}
+	tn.WaitForHeight(1, 30*time.Second)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for tn.nodes[1].inMempool(hex.EncodeToString(tx.ID)) {
+		if time.Now().After(deadline) {
+			t.Fatal("transaction double-spent by a block is still in the mempool")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if _, err := tn.nodes[1].Generate(1, miner); err != nil {
+		t.Fatal(err)
+	}
+	tn.WaitForHeight(2, 30*time.Second)
+	tn.checkBalances(map[string]blockchain.Balance{
+		bob:   {},
+		carol: {Confirmed: 5},
+		miner: {Immature: 2*blockchain.Subsidy + 1},
+	})
+}
+
+// TestMisbehaviorScoresConnectionHost vérifie que les fautes d'un message sont reprochées à l'hôte
+// de la connexion qui l'apporte, pas à l'adresse AddrFrom qu'il annonce
+func TestMisbehaviorScoresConnectionHost(t *testing.T) {
+	tn := newMemoryTestNetwork(t, 2, NewMemoryNetwork(5))
+	tn.Start(-1, "")
+	tn.WaitForPeers(10 * time.Second)
+	n, victim := tn.nodes[0], tn.nodes[1].Address
+
+	attacker := NewNode("", NetConfig{}, tn.transport("10.0.0.99:3000"))
+	malformed := append(CmdToBytes("tx"), []byte("not a gob payload")...)
+	invalid := append(CmdToBytes("tx"), GobEncode(Tx{victim, []byte("not a transaction")})...)
+	for _, request := range [][]byte{malformed, invalid} {
+		if err := attacker.SendData(n.Address, request); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for n.bans.score("10.0.0.99") < 2*scoreMalformed && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := n.bans.score("10.0.0.99"); got != 2*scoreMalformed {
+		t.Errorf("score of the sending host is %d, want %d", got, 2*scoreMalformed)
+	}
+	if got := n.bans.score(victim); got != 0 {
+		t.Errorf("score of the address claimed by the messages is %d, want 0", got)
+	}
+}
+
+// TestTxRejectionScores vérifie que seules les transactions invalides par consensus ou par leurs
+// scripts sont reprochées, et qu'une transaction non demandée n'est reprochée que si la connexion
+// vient d'un pair, quelle que soit l'adresse AddrFrom annoncée
+func TestTxRejectionScores(t *testing.T) {
+	tn := newMemoryTestNetwork(t, 2, NewMemoryNetwork(8))
+	alice := tn.genesis
+	bob := tn.NewAddress()
+	carol := tn.NewAddress()
+
+	tn.Start(-1, "")
+	tn.WaitForPeers(10 * time.Second)
+	n, peer := tn.nodes[0], tn.nodes[1].Address
+	peerHost, _, _ := net.SplitHostPort(peer)
+	w := tn.wallets.GetWallet(alice)
+	utxo := &blockchain.UTXOSet{Blockchain: n.Chain}
+
+	tx := blockchain.NewTransaction(&w, bob, 5, 1, 0, utxo)
+	double := blockchain.NewTransaction(&w, carol, 5, 1, 0, utxo)
+
+	nonstandard := *tx
+	nonstandard.Outputs = append(append([]blockchain.TXOutput{}, tx.Outputs...),
+		blockchain.TXOutput{ScriptPubKey: blockchain.NullDataScript(make([]byte, blockchain.MaxNullDataSize+1))})
+	nonstandard.ID = nonstandard.Hash()
+
+	stale := *tx
+	stale.Inputs = append([]blockchain.TXInput{}, tx.Inputs...)
+	stale.Inputs[0].ID = bytes.Repeat([]byte{0xab}, len(tx.ID))
+	stale.ID = stale.Hash()
+
+	forged := *tx
+	forged.Outputs = append([]blockchain.TXOutput{}, tx.Outputs...)
+	forged.Outputs[0].Value++
+	forged.ID = forged.Hash()
+
+	tests := []struct {
+		name   string
+		tx     *blockchain.Transaction
+		origin string
+		score  int // Score of the origin once the transaction is handled
+	}{
+		{"valid", tx, "10.0.0.98", 0},
+		{"mempool conflict", double, "10.0.0.98", 0},
+		{"nonstandard", &nonstandard, "10.0.0.98", 0},
+		{"unknown or spent output", &stale, "10.0.0.98", 0},
+		{"invalid scripts", &forged, "10.0.0.98", scoreInvalidTx},
+		{"unsolicited from a peer", double, peerHost, scoreUnsolicited},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Chaque message annonce l'adresse du pair : seule l'origine de la connexion compte
+			request := append(CmdToBytes("tx"), GobEncode(Tx{peer, test.tx.Serialize()})...)
+			n.HandleTx(request, test.origin)
+
+			if got := n.bans.score(test.origin); got != test.score {
+				t.Errorf("score of %s is %d, want %d", test.origin, got, test.score)
+			}
+		})
+	}
+	if !n.inMempool(hex.EncodeToString(tx.ID)) {
+		t.Error("valid transaction is not in the mempool")
+	}
+	if got := n.bans.score(peer); got != 0 {
+		t.Errorf("score of the address claimed by the messages is %d, want 0", got)
+	}
+}
+
+// score retourne le score de mauvaise conduite d'une origine
+func (bl *BanList) score(origin string) int {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	return bl.scores[origin]
+}
+
+// TestEncryptedPeersUseIdentity vérifie que les pairs d'un réseau chiffré sont liés à leur identité
+// vérifiée et que les fautes sont reprochées à l'identité de l'expéditeur
+func TestEncryptedPeersUseIdentity(t *testing.T) {
+	tn := newMemoryTestNetwork(t, 2, NewMemoryNetwork(6))
+	for _, n := range tn.nodes {
+		n.Config.Encrypt = true
+	}
+	tn.Start(-1, "")
+	tn.WaitForPeers(10 * time.Second)
+	n := tn.nodes[0]
+
+	want, err := NodeIdentity(tn.nodes[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := n.peers.Identity(tn.nodes[1].Address); got != want {
+		t.Errorf("identity of the peer is %q, want %q", got, want)
+	}
+
+	attacker := NewNode("attacker", NetConfig{}, tn.transport("10.0.0.99:3000"))
+	if err := attacker.EnableEncryption(nil); err != nil {
+		t.Fatal(err)
+	}
+	attackerIdentity, err := NodeIdentity("attacker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := append(CmdToBytes("tx"), []byte("not a gob payload")...)
+	if err := attacker.SendData(n.Address, request); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for n.bans.score(attackerIdentity) == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := n.bans.score(attackerIdentity); got != scoreMalformed {
+		t.Errorf("score of the sender identity is %d, want %d", got, scoreMalformed)
+	}
+	if got := n.bans.score("10.0.0.99"); got != 0 {
+		t.Errorf("score of the sending host is %d, want 0", got)
+	}
+
+	// Un autre nœud qui prend l'adresse d'un pair n'ouvre pas de session à sa place
+	version := Version{AddrFrom: tn.nodes[1].Address, Nonce: 1}
+	if accepted, _ := n.peers.HandleVersion(version, attackerIdentity); accepted {
+		t.Error("version of a known address from another identity was accepted")
+	}
+}
+
+// TestLightNodePinnedGenesis vérifie qu'un nœud léger ne suit que la chaîne de son genesis fixé
+func TestLightNodePinnedGenesis(t *testing.T) {
+	mn := NewMemoryNetwork(7)
+	tn := newMemoryTestNetwork(t, 1, mn)
+	tn.Start(-1, "")
+	full := tn.nodes[0]
+	if _, err := full.Generate(3, tn.NewAddress()); err != nil {
+		t.Fatal(err)
+	}
+	genesis := full.Chain.GetHeadersAfter(nil)[0].Hash
+
+	startLight := func(id string, pinned []byte) (*blockchain.HeaderChain, error) {
+		config := NetConfig{Listen: "10.0.0." + id + ":3000", Connect: []string{full.Address}}
+		light := NewNode(id, config, mn.Transport(config.Listen))
+		headers := blockchain.OpenHeaderChain(id)
+		t.Cleanup(func() {
+			light.Stop()
+			time.Sleep(100 * time.Millisecond)
+			headers.Database.Close()
+		})
+		if len(pinned) > 0 {
+			if err := headers.PinGenesis(pinned, blockchain.RegtestParams); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return headers, light.StartSPV(headers, false)
+	}
+
+	if _, err := startLight("50", nil); err == nil {
+		t.Error("light node without a pinned genesis was started")
+	}
+
+	other := bytes.Repeat([]byte{1}, len(genesis))
+	stranger, err := startLight("51", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower, err := startLight("52", genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for follower.BestHeight() < 3 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := follower.BestHeight(); got != 3 {
+		t.Errorf("light node with the network genesis is at height %d, want 3", got)
+	}
+	if got := stranger.BestHeight(); got != -1 {
+		t.Errorf("light node with another genesis accepted headers up to height %d", got)
+	}
+	if err := follower.PinGenesis(other, blockchain.RegtestParams); err == nil {
+		t.Error("header chain accepted a second genesis")
+	}
+	if err := follower.PinGenesis(genesis, blockchain.MainParams); err == nil {
+		t.Error("header chain accepted other parameters")
+	}
+
+	// Les paramètres fixés avec le genesis sont rechargés à la réouverture
+	pinned := blockchain.OpenHeaderChain("53")
+	if err := pinned.PinGenesis(genesis, blockchain.RegtestParams); err != nil {
+		t.Fatal(err)
+	}
+	pinned.Database.Close()
+	reopened := blockchain.OpenHeaderChain("53")
+	defer reopened.Database.Close()
+	if reopened.Params != blockchain.RegtestParams || !bytes.Equal(reopened.Genesis, genesis) {
+		t.Errorf("reopened header chain follows %x with %s parameters", reopened.Genesis, reopened.Params.Name)
+	}
+}
+
+// TestPoolStopsWithNode vérifie que l'arrêt du nœud ferme l'écoute du pool
+func TestPoolStopsWithNode(t *testing.T) {
+	tn := newMemoryTestNetwork(t, 1, NewMemoryNetwork(9))
+	tn.Start(-1, "")
+	n := tn.nodes[0]
+	address := net.JoinHostPort("127.0.0.1", freePort(t))
+
+	done := make(chan struct{})
+	go func() {
+		n.StartPool(address, &Pool{Operator: tn.genesis, ShareDifficulty: DefaultShareDifficulty})
+		close(done)
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool is not listening: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	n.Stop()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("pool still accepts workers after the node stopped")
+	}
+	if conn, err := net.Dial("tcp", address); err == nil {
+		conn.Close()
+		t.Fatal("pool still listens after the node stopped")
+	}
+}
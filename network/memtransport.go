@@ -0,0 +1,272 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// MemoryNetwork relie des nœuds d'un même processus sans ouvrir de port
+// Il simule la latence, la perte de messages et les partitions du réseau, ce qui permet de tester
+// la synchronisation, le relais et les forks entre plusieurs nœuds. Les tirages de la latence et
+// des pertes viennent d'une graine : un même scénario tire toujours les mêmes valeurs
+type MemoryNetwork struct {
+	mutex     sync.Mutex
+	rand      *mrand.Rand
+	listeners map[string]*memoryListener
+	latency   time.Duration
+	jitter    time.Duration
+	loss      float64
+	groups    map[string]int // Partition of each address, addresses not listed are in group 0
+}
+
+// NewMemoryNetwork crée un réseau en mémoire sans latence ni perte
+func NewMemoryNetwork(seed int64) *MemoryNetwork {
+	return &MemoryNetwork{rand: mrand.New(mrand.NewSource(seed)), listeners: make(map[string]*memoryListener)}
+}
+
+// SetLatency fait arriver chaque connexion après latency, plus un délai aléatoire jusqu'à jitter
+// Avec du jitter, deux messages successifs vers un même nœud peuvent arriver dans le désordre
+func (mn *MemoryNetwork) SetLatency(latency, jitter time.Duration) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+
+	mn.latency = latency
+	mn.jitter = jitter
+}
+
+// SetLoss perd la proportion rate des messages, entre 0 et 1
+func (mn *MemoryNetwork) SetLoss(rate float64) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+
+	mn.loss = rate
+}
+
+// Partition coupe le réseau en groupes d'adresses : les messages entre deux groupes sont perdus
+// Les adresses absentes des groupes forment ensemble un groupe de plus
+func (mn *MemoryNetwork) Partition(groups ...[]string) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+
+	mn.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, address := range group {
+			mn.groups[address] = i + 1
+		}
+	}
+}
+
+// Heal lève les partitions
+func (mn *MemoryNetwork) Heal() {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+
+	mn.groups = nil
+}
+
+// Transport retourne le transport d'un nœud du réseau, identifié par son adresse
+func (mn *MemoryNetwork) Transport(address string) Transport {
+	return &memoryTransport{mn, address}
+}
+
+// deliver décide du sort d'un message de from vers to
+// Retourne false si le message est perdu, sinon le délai avant son arrivée
+func (mn *MemoryNetwork) deliver(from, to string) (time.Duration, bool) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+
+	if mn.groups[from] != mn.groups[to] {
+		return 0, false
+	}
+	if mn.loss > 0 && mn.rand.Float64() < mn.loss {
+		return 0, false
+	}
+	delay := mn.latency
+	if mn.jitter > 0 {
+		delay += time.Duration(mn.rand.Int63n(int64(mn.jitter)))
+	}
+
+	return delay, true
+}
+
+// memoryTransport est le point d'accès d'un nœud au réseau en mémoire
+type memoryTransport struct {
+	network *MemoryNetwork
+	address string
+}
+
+// Listen réserve une adresse du réseau en mémoire
+func (t *memoryTransport) Listen(address string) (net.Listener, error) {
+	mn := t.network
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+
+	if _, ok := mn.listeners[address]; ok {
+		return nil, fmt.Errorf("address %s already in use", address)
+	}
+	ln := &memoryListener{network: mn, address: address, conns: make(chan net.Conn, 64), closed: make(chan struct{})}
+	mn.listeners[address] = ln
+
+	return ln, nil
+}
+
+// Dial ouvre une connexion vers un nœud du réseau en mémoire
+// Comme sur TCP, une adresse sans nœud à l'écoute refuse la connexion. Un message perdu ou
+// coupé par une partition s'écrit sans erreur mais n'arrive jamais, et toute lecture échoue
+func (t *memoryTransport) Dial(address string) (net.Conn, error) {
+	mn := t.network
+	mn.mutex.Lock()
+	ln, ok := mn.listeners[address]
+	mn.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial %s: connection refused", address)
+	}
+
+	local, remote := memoryAddr(t.address), memoryAddr(address)
+	delay, delivered := mn.deliver(t.address, address)
+	if !delivered {
+		sink := newMemoryBuffer()
+		sink.discard = true
+		closed := newMemoryBuffer()
+		closed.close()
+		return &memoryConn{in: closed, out: sink, local: local, remote: remote}, nil
+	}
+
+	toServer, toClient := newMemoryBuffer(), newMemoryBuffer()
+	client := &memoryConn{in: toClient, out: toServer, local: local, remote: remote}
+	server := &memoryConn{in: toServer, out: toClient, local: remote, remote: local}
+	time.AfterFunc(delay, func() { ln.deliver(server) })
+
+	return client, nil
+}
+
+// memoryListener reçoit les connexions adressées à un nœud du réseau en mémoire
+type memoryListener struct {
+	network *MemoryNetwork
+	address string
+	conns   chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// deliver remet une connexion au nœud, ou la ferme s'il n'écoute plus
+func (ln *memoryListener) deliver(conn net.Conn) {
+	select {
+	case <-ln.closed:
+		conn.Close()
+	case ln.conns <- conn:
+	}
+}
+
+func (ln *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case <-ln.closed:
+		return nil, net.ErrClosed
+	case conn := <-ln.conns:
+		return conn, nil
+	}
+}
+
+func (ln *memoryListener) Close() error {
+	ln.once.Do(func() {
+		ln.network.mutex.Lock()
+		delete(ln.network.listeners, ln.address)
+		ln.network.mutex.Unlock()
+		close(ln.closed)
+	})
+
+	return nil
+}
+
+func (ln *memoryListener) Addr() net.Addr {
+	return memoryAddr(ln.address)
+}
+
+// memoryAddr est l'adresse d'un nœud du réseau en mémoire
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
+
+// memoryBuffer est un sens d'une connexion en mémoire
+// Les écritures ne bloquent jamais : l'expéditeur n'attend pas que le destinataire lise
+type memoryBuffer struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	data    []byte
+	closed  bool
+	discard bool // Writes are accepted and dropped
+}
+
+func newMemoryBuffer() *memoryBuffer {
+	b := &memoryBuffer{}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+func (b *memoryBuffer) write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if !b.discard {
+		b.data = append(b.data, p...)
+		b.cond.Broadcast()
+	}
+
+	return len(p), nil
+}
+
+func (b *memoryBuffer) read(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for len(b.data) == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if len(b.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+
+	return n, nil
+}
+
+func (b *memoryBuffer) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+// memoryConn est une connexion du réseau en mémoire
+// Les délais de net.Conn sont acceptés sans effet : un nœud en mémoire lit toujours ses connexions
+// jusqu'au bout et un message perdu échoue dès sa première lecture
+type memoryConn struct {
+	in, out       *memoryBuffer
+	local, remote memoryAddr
+}
+
+func (c *memoryConn) Read(p []byte) (int, error)  { return c.in.read(p) }
+func (c *memoryConn) Write(p []byte) (int, error) { return c.out.write(p) }
+
+// Close termine les deux sens : le pair lit la fin du message puis EOF
+func (c *memoryConn) Close() error {
+	c.out.close()
+	c.in.close()
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr                { return c.local }
+func (c *memoryConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *memoryConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memoryConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memoryConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,121 @@
+package network
+
+import (
+	"blockchain-go/blockchain"
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestMemorySync vérifie que des nœuds reliés avec de la latence suivent les blocs d'un autre nœud
+func TestMemorySync(t *testing.T) {
+	mn := NewMemoryNetwork(1)
+	mn.SetLatency(20*time.Millisecond, 30*time.Millisecond)
+	tn := newMemoryTestNetwork(t, 3, mn)
+	miner := tn.NewAddress()
+
+	tn.Start(-1, "")
+	tn.WaitForPeers(10 * time.Second)
+
+	if _, err := tn.nodes[0].Generate(5, miner); err != nil {
+		t.Fatal(err)
+	}
+	tn.WaitForHeight(5, 30*time.Second)
+	tn.checkBalances(map[string]blockchain.Balance{
+		miner: {Immature: 5 * blockchain.Subsidy},
+	})
+}
+
+// TestMemoryRelay soumet une transaction à un nœud qui ne mine pas et vérifie qu'elle atteint les
+// autres nœuds malgré des messages perdus, puis qu'elle est confirmée partout
+func TestMemoryRelay(t *testing.T) {
+	mn := NewMemoryNetwork(2)
+	mn.SetLatency(10*time.Millisecond, 20*time.Millisecond)
+	tn := newMemoryTestNetwork(t, 3, mn)
+	alice := tn.genesis
+	bob := tn.NewAddress()
+	miner := tn.NewAddress()
+
+	tn.Start(-1, "")
+	tn.WaitForPeers(10 * time.Second)
+
+	mn.SetLoss(0.1)
+	tx := tn.Send(2, alice, bob, 5, 1)
+	tn.WaitForMempool(tx, 30*time.Second)
+	mn.SetLoss(0)
+
+	if _, err := tn.nodes[0].Generate(1, miner); err != nil {
+		t.Fatal(err)
+	}
+	tn.WaitForHeight(1, 30*time.Second)
+	tn.checkBalances(map[string]blockchain.Balance{
+		alice: {Confirmed: blockchain.Subsidy - 6},
+		bob:   {Confirmed: 5},
+		miner: {Immature: blockchain.Subsidy + 1},
+	})
+}
+
+// TestMemoryPartitionReorg sépare le réseau en deux moitiés qui minent chacune leur branche, puis
+// lève la partition : tous les nœuds doivent rejoindre la branche la plus longue et oublier les
+// récompenses de l'autre
+func TestMemoryPartitionReorg(t *testing.T) {
+	mn := NewMemoryNetwork(3)
+	mn.SetLatency(10*time.Millisecond, 10*time.Millisecond)
+	tn := newMemoryTestNetwork(t, 4, mn)
+	long := tn.NewAddress()
+	short := tn.NewAddress()
+
+	tn.Start(-1, "")
+	tn.WaitForPeers(10 * time.Second)
+
+	left, right := tn.nodes[:2], tn.nodes[2:]
+	mn.Partition(
+		[]string{left[0].Config.Listen, left[1].Config.Listen},
+		[]string{right[0].Config.Listen, right[1].Config.Listen},
+	)
+
+	if _, err := left[0].Generate(3, long); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := right[0].Generate(2, short); err != nil {
+		t.Fatal(err)
+	}
+	waitForTip(t, left, 3, 30*time.Second)
+	waitForTip(t, right, 2, 30*time.Second)
+	if bytes.Equal(left[0].Chain.LastHash(), right[0].Chain.LastHash()) {
+		t.Fatal("both sides of the partition have the same tip")
+	}
+
+	mn.Heal()
+	// Le bloc suivant est annoncé à tous les pairs : l'autre moitié découvre la branche la plus longue
+	if _, err := left[0].Generate(1, long); err != nil {
+		t.Fatal(err)
+	}
+	tn.WaitForHeight(4, time.Minute)
+	tn.checkBalances(map[string]blockchain.Balance{
+		long:  {Immature: 4 * blockchain.Subsidy},
+		short: {},
+	})
+}
+
+// waitForTip attend que les nœuds nodes aient le même sommet, à la hauteur height
+func waitForTip(t *testing.T, nodes []*Node, height int, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		same := true
+		for _, n := range nodes {
+			if n.Chain.GetBestHeight() != height || !bytes.Equal(n.Chain.LastHash(), nodes[0].Chain.LastHash()) {
+				same = false
+			}
+		}
+		if same {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nodes did not reach the same tip at height %d within %s", height, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,228 @@
+package network
+
+import (
+	"blockchain-go/blockchain"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// maxTemplateTxs limite le nombre de transactions d'un bloc miné par le nœud
+const maxTemplateTxs = 500
+
+// MiningPolicy règle la boucle de minage en arrière-plan
+type MiningPolicy struct {
+	Interval  time.Duration // Minimum delay between two blocks mined by this node
+	MineEmpty bool          // Mine blocks holding only the coinbase when the mempool is empty
+
+	PoolAddress     string // Serves pool workers on this address instead of mining locally
+	ShareDifficulty int    // Leading zero bits of the pool shares
+}
+
+// mempoolEntry associe une transaction du mempool à ses frais
+type mempoolEntry struct {
+	tx  blockchain.Transaction
+	fee int
+}
+
+// StartMiner lance la boucle de minage : elle construit sans cesse un bloc à partir du mempool,
+// et recommence sur un nouveau sommet ou à l'arrivée d'une transaction mieux rémunérée
+// La boucle s'arrête avec le nœud
+func (n *Node) StartMiner() {
+	for !n.stopped() {
+		txs, fees, minFee := n.blockTemplateTxs()
+		if len(txs) == 0 && !n.miningPolicy.MineEmpty {
+			select {
+			case <-n.minerWake:
+			case <-n.quit:
+			}
+			continue
+		}
+
+		cbTx := blockchain.CoinbaseTx(n.mineAddress, "", fees)
+		txs = append(txs, cbTx)
+
+		fmt.Printf("Mining a block with %d transactions and %d of fees\n", len(txs)-1, fees)
+		ctx, done := n.startMining(minFee, len(txs)-1 >= maxTemplateTxs)
+		newBlock, err := n.Chain.MineBlock(ctx, txs)
+		done()
+		if err != nil {
+			fmt.Printf("Mining aborted: %v\n", err)
+			continue
+		}
+
+		fmt.Println("New Block mined")
+		n.connectMinedBlock(newBlock)
+
+		select {
+		case <-time.After(n.miningPolicy.Interval):
+		case <-n.quit:
+		}
+	}
+}
+
+// Generate mine immédiatement count blocs récompensant address avec les transactions du mempool
+// Réservé aux chaînes regtest, dont la difficulté triviale rend chaque bloc instantané
+// Retourne les hashes des blocs minés
+func (n *Node) Generate(count int, address string) ([][]byte, error) {
+	if !n.Chain.Params.IsRegtest() {
+		return nil, errors.New("generate is only available on a regtest chain")
+	}
+
+	var hashes [][]byte
+	for len(hashes) < count {
+		txs, fees, _ := n.blockTemplateTxs()
+		cbTx := blockchain.CoinbaseTx(address, "", fees)
+		txs = append(txs, cbTx)
+
+		n.cancelMining("generating blocks")
+		newBlock, err := n.Chain.MineBlock(context.Background(), txs)
+		if err == blockchain.ErrTipChanged {
+			continue
+		}
+		if err != nil {
+			return hashes, err
+		}
+
+		fmt.Printf("Generated block %x with %d transactions\n", newBlock.Hash, len(txs)-1)
+		n.connectMinedBlock(newBlock)
+		hashes = append(hashes, newBlock.Hash)
+	}
+
+	return hashes, nil
+}
+
+// connectMinedBlock met à jour le mempool après un bloc miné par ce nœud ou soumis par un
+// mineur externe, puis annonce le bloc aux pairs. L'ajout du bloc a déjà mis à jour l'UTXO set
+func (n *Node) connectMinedBlock(block *blockchain.Block) {
+	n.pruneChain()
+	n.updateMempool(block)
+
+	for _, node := range n.peers.PeerAddresses() {
+		n.SendInv(node, "block", [][]byte{block.Hash})
+	}
+	n.refreshPoolJobs()
+}
+
+// blockTemplateTxs choisit les transactions minables du mempool, les mieux rémunérées d'abord
+// Retourne les transactions, le total de leurs frais et les frais les plus bas retenus
+func (n *Node) blockTemplateTxs() ([]*blockchain.Transaction, int, int) {
+	n.poolMutex.Lock()
+	var candidates []mempoolEntry
+	for _, tx := range n.memoryPool {
+		candidates = append(candidates, mempoolEntry{tx: tx})
+	}
+	n.poolMutex.Unlock()
+
+	var entries []mempoolEntry
+	for _, entry := range candidates {
+		tx := entry.tx
+		// Vérifiée contre le set UTXO du sommet : une sortie dépensée depuis par un bloc est refusée
+		fee, err := n.Chain.CheckMempoolTx(&tx)
+		if err == nil {
+			err = checkReadyForNextBlock(n.Chain, &tx)
+		}
+		if err != nil {
+			fmt.Printf("Dropping transaction %x from the block template: %v\n", tx.ID, err)
+			n.RemoveFromMempool(tx.ID)
+			continue
+		}
+		entries = append(entries, mempoolEntry{tx, fee})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].fee > entries[j].fee })
+
+	var txs []*blockchain.Transaction
+	spent := make(map[string]bool)
+	fees, minFee := 0, 0
+	for i := range entries {
+		if len(txs) == maxTemplateTxs {
+			break
+		}
+
+		// Deux transactions du mempool peuvent dépenser la même sortie : seule la première est retenue
+		var outpoints []string
+		conflict := false
+		for _, in := range entries[i].tx.Inputs {
+			outpoint := fmt.Sprintf("%s:%d", hex.EncodeToString(in.ID), in.Out)
+			conflict = conflict || spent[outpoint]
+			outpoints = append(outpoints, outpoint)
+		}
+		if conflict {
+			continue
+		}
+		for _, outpoint := range outpoints {
+			spent[outpoint] = true
+		}
+
+		txs = append(txs, &entries[i].tx)
+		fees += entries[i].fee
+		minFee = entries[i].fee
+	}
+
+	return txs, fees, minFee
+}
+
+// notifyMiner réveille le mineur au repos et relance le bloc en cours si la transaction
+// rapporte plus que la moins rémunérée de ce bloc, ou si le bloc a encore de la place
+func (n *Node) notifyMiner(tx *blockchain.Transaction) {
+	if len(n.mineAddress) == 0 {
+		return
+	}
+	n.wakeMiner()
+
+	fee, err := n.Chain.TransactionFee(tx)
+	if err != nil || fee == 0 {
+		return
+	}
+
+	n.miningMutex.Lock()
+	restart := n.miningCancel != nil && (!n.templateFull || fee > n.templateMinFee)
+	n.miningMutex.Unlock()
+
+	if restart {
+		n.cancelMining(fmt.Sprintf("transaction %x pays %d of fees", tx.ID, fee))
+	}
+}
+
+// wakeMiner signale au mineur au repos que le mempool a changé
+func (n *Node) wakeMiner() {
+	select {
+	case n.minerWake <- struct{}{}:
+	default:
+	}
+}
+
+// startMining prépare l'annulation du bloc en cours de minage
+// Le contexte retourné est annulé par cancelMining
+func (n *Node) startMining(minFee int, full bool) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	n.miningMutex.Lock()
+	n.miningCancel = cancel
+	n.templateMinFee = minFee
+	n.templateFull = full
+	n.miningMutex.Unlock()
+
+	return ctx, func() {
+		n.miningMutex.Lock()
+		n.miningCancel = nil
+		n.miningMutex.Unlock()
+		cancel()
+	}
+}
+
+// cancelMining interrompt le minage en cours pour reconstruire le bloc
+func (n *Node) cancelMining(reason string) {
+	n.miningMutex.Lock()
+	defer n.miningMutex.Unlock()
+
+	if n.miningCancel != nil {
+		fmt.Printf("Restarting the block being mined: %s\n", reason)
+		n.miningCancel()
+		n.miningCancel = nil
+	}
+}
@@ -5,10 +5,11 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	mrand "math/rand"
 	"net"
 	"os"
 	"os/signal"
@@ -22,16 +23,27 @@ const (
 	commandLength = 12
 )
 
-var (
-	nodeAddress     string
-	mineAddress     string
-	KnownNodes      = []string{"localhost:3000"}
-	blocksInTransit = [][]byte{}
-	memoryPool      = make(map[string]blockchain.Transaction)
-)
+// KnownNodes sont les nœuds d'amorçage par défaut, remplacés par -seeds
+var KnownNodes = []string{"localhost:3000"}
+
+// requestTimeout est la durée pendant laquelle une donnée demandée est attendue
+const requestTimeout = 2 * time.Minute
 
+// dataRequest compte les getdata envoyés pour une donnée, qui peut être demandée plusieurs fois
+type dataRequest struct {
+	count int
+	at    time.Time
+}
+
+// Addr annonce des adresses de nœuds, avec l'heure où chacune a été vue active
 type Addr struct {
-	AddrList []string
+	AddrFrom  string
+	Addresses []NetAddress
+}
+
+// GetAddr demande à un pair une partie de son carnet d'adresses
+type GetAddr struct {
+	AddrFrom string
 }
 
 type Block struct {
@@ -43,10 +55,18 @@ type GetBlocks struct {
 	AddrFrom string
 }
 
+// GetData demande des données annoncées par un pair, toutes du même type
 type GetData struct {
 	AddrFrom string
 	Type     string
-	ID       []byte
+	Items    [][]byte
+}
+
+// NotFound répond à un getdata pour les données que le nœud n'a pas ou plus
+type NotFound struct {
+	AddrFrom string
+	Type     string
+	Items    [][]byte
 }
 
 type Inv struct {
@@ -55,6 +75,13 @@ type Inv struct {
 	Items    [][]byte
 }
 
+// MerkleBlock transporte une transaction avec l'en-tête de son bloc et sa preuve d'inclusion
+type MerkleBlock struct {
+	AddrFrom    string
+	Proof       []byte
+	Transaction []byte
+}
+
 type Tx struct {
 	AddrFrom    string
 	Transaction []byte
@@ -64,6 +91,25 @@ type Version struct {
 	Version    int
 	BestHeight int
 	AddrFrom   string
+	Services   uint64 // ServiceNetwork, ServiceCFilters...
+	Nonce      uint64 // Random per process, detects connections to ourselves and peer restarts
+}
+
+// Verack accuse réception d'une version et termine la poignée de main
+type Verack struct {
+	AddrFrom string
+}
+
+// Ping vérifie qu'un pair est toujours joignable, il répond par un pong avec le même nonce
+type Ping struct {
+	AddrFrom string
+	Nonce    uint64
+}
+
+// Pong répond à un ping
+type Pong struct {
+	AddrFrom string
+	Nonce    uint64
 }
 
 func CmdToBytes(cmd string) []byte {
@@ -92,50 +138,55 @@ func ExtractCmd(req []byte) []byte {
 	return req[:commandLength]
 }
 
-func RequestBlocks() {
-	for _, node := range KnownNodes {
-		SendGetBlocks(node)
+func (n *Node) RequestBlocks() {
+	for _, node := range n.peers.PeerAddresses() {
+		n.SendGetBlocks(node)
 	}
 }
 
-func SendAddr(address string) {
-	nodes := Addr{KnownNodes}
-	nodes.AddrList = append(nodes.AddrList, nodeAddress)
-	payload := GobEncode(nodes)
+// SendAddr envoie des adresses à un pair
+func (n *Node) SendAddr(address string, addresses []NetAddress) {
+	payload := GobEncode(Addr{n.Address, addresses})
 	request := append(CmdToBytes("addr"), payload...)
 
-	SendData(address, request) // Ignore error for addr messages
+	n.SendData(address, request) // Ignore error for addr messages
+}
+
+// SendGetAddr demande des adresses à un pair
+func (n *Node) SendGetAddr(address string) {
+	payload := GobEncode(GetAddr{n.Address})
+	request := append(CmdToBytes("getaddr"), payload...)
+
+	n.SendData(address, request) // Ignore error for getaddr messages
 }
 
-func SendBlock(addr string, b *blockchain.Block) {
-	data := Block{nodeAddress, b.Serialize()}
+func (n *Node) SendBlock(addr string, b *blockchain.Block) {
+	data := Block{n.Address, b.Serialize()}
 	payload := GobEncode(data)
 	request := append(CmdToBytes("block"), payload...)
 
-	SendData(addr, request) // Ignore error for block messages
+	n.SendData(addr, request) // Ignore error for block messages
 }
 
-func SendData(addr string, data []byte) error {
-	// Ajouter un timeout de 5 secondes pour éviter les blocages
-	conn, err := net.DialTimeout(protocol, addr, 5*time.Second)
+// SendData envoie un message à un pair sur une nouvelle connexion du transport du nœud
+func (n *Node) SendData(addr string, data []byte) error {
+	conn, err := n.Transport.Dial(addr)
 
 	if err != nil {
-		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
-
-		for _, node := range KnownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
-		}
-
-		KnownNodes = updatedNodes
+		n.peers.Failed(addr)
 
 		return fmt.Errorf("node %s is not available", addr)
 	}
 
 	defer conn.Close()
 
+	if n.secure != nil {
+		if err := n.secure.send(conn, data, n.peers.Identity(addr)); err != nil {
+			return fmt.Errorf("failed to send data: %v", err)
+		}
+		return nil
+	}
+
 	_, err = io.Copy(conn, bytes.NewReader(data))
 	if err != nil {
 		return fmt.Errorf("failed to send data: %v", err)
@@ -144,47 +195,119 @@ func SendData(addr string, data []byte) error {
 	return nil
 }
 
-func SendInv(address, kind string, items [][]byte) {
-	inventory := Inv{nodeAddress, kind, items}
+func (n *Node) SendInv(address, kind string, items [][]byte) {
+	inventory := Inv{n.Address, kind, items}
 	payload := GobEncode(inventory)
 	request := append(CmdToBytes("inv"), payload...)
 
-	SendData(address, request) // Ignore error for inv messages
+	n.SendData(address, request) // Ignore error for inv messages
 }
 
-func SendGetBlocks(address string) {
-	payload := GobEncode(GetBlocks{nodeAddress})
+func (n *Node) SendGetBlocks(address string) {
+	payload := GobEncode(GetBlocks{n.Address})
 	request := append(CmdToBytes("getblocks"), payload...)
 
-	SendData(address, request) // Ignore error for getblocks messages
+	n.SendData(address, request) // Ignore error for getblocks messages
 }
 
-func SendGetData(address, kind string, id []byte) {
-	payload := GobEncode(GetData{nodeAddress, kind, id})
+// SendGetData demande des données à un pair en un seul message
+func (n *Node) SendGetData(address, kind string, ids [][]byte) {
+	for _, id := range ids {
+		n.markRequested(kind, id)
+	}
+	payload := GobEncode(GetData{n.Address, kind, ids})
 	request := append(CmdToBytes("getdata"), payload...)
 
-	SendData(address, request) // Ignore error for getdata messages
+	n.SendData(address, request) // Ignore error for getdata messages
 }
 
-func SendTx(addr string, tnx *blockchain.Transaction) error {
-	data := Tx{nodeAddress, tnx.Serialize()}
+// SendNotFound signale à un pair les données demandées que le nœud n'a pas
+func (n *Node) SendNotFound(address, kind string, ids [][]byte) {
+	payload := GobEncode(NotFound{n.Address, kind, ids})
+	request := append(CmdToBytes("notfound"), payload...)
+
+	n.SendData(address, request) // Ignore error for notfound messages
+}
+
+// markRequested retient qu'une donnée a été demandée avec getdata
+func (n *Node) markRequested(kind string, id []byte) {
+	n.requestedMutex.Lock()
+	defer n.requestedMutex.Unlock()
+
+	now := time.Now()
+	for key, request := range n.requestedData {
+		if now.Sub(request.at) > requestTimeout {
+			delete(n.requestedData, key)
+		}
+	}
+
+	key := kind + hex.EncodeToString(id)
+	request, ok := n.requestedData[key]
+	if !ok {
+		request = &dataRequest{}
+		n.requestedData[key] = request
+	}
+	request.count++
+	request.at = now
+}
+
+// takeRequested indique si une donnée reçue avait été demandée, et décompte la demande
+func (n *Node) takeRequested(kind string, id []byte) bool {
+	n.requestedMutex.Lock()
+	defer n.requestedMutex.Unlock()
+
+	key := kind + hex.EncodeToString(id)
+	request, ok := n.requestedData[key]
+	if !ok {
+		return false
+	}
+	request.count--
+	if request.count == 0 {
+		delete(n.requestedData, key)
+	}
+
+	return time.Since(request.at) <= requestTimeout
+}
+
+// SendMerkleBlock envoie une transaction minée accompagnée de sa preuve d'inclusion
+func (n *Node) SendMerkleBlock(addr string, proof *blockchain.TxProof, tnx *blockchain.Transaction) {
+	data := MerkleBlock{n.Address, proof.Serialize(), tnx.Serialize()}
+	payload := GobEncode(data)
+	request := append(CmdToBytes("merkleblock"), payload...)
+
+	n.SendData(addr, request) // Ignore error for merkleblock messages
+}
+
+func (n *Node) SendTx(addr string, tnx *blockchain.Transaction) error {
+	data := Tx{n.Address, tnx.Serialize()}
 	payload := GobEncode(data)
 	request := append(CmdToBytes("tx"), payload...)
 
 	fmt.Printf("Sending transaction %x to %s\n", tnx.ID, addr)
-	return SendData(addr, request)
+	return n.SendData(addr, request)
+}
+
+func (n *Node) SendVersion(addr string) {
+	n.sendVersionWithHeight(addr, n.Chain.GetBestHeight())
 }
 
-func SendVersion(addr string, chain *blockchain.BlockChain) {
-	bestHeight := chain.GetBestHeight()
-	payload := GobEncode(Version{version, bestHeight, nodeAddress})
+func (n *Node) sendVersionWithHeight(addr string, bestHeight int) {
+	payload := GobEncode(Version{version, bestHeight, n.Address, n.services, n.nonce})
 
 	request := append(CmdToBytes("version"), payload...)
 
-	SendData(addr, request) // Ignore error for version messages
+	n.SendData(addr, request) // Ignore error for version messages
 }
 
-func HandleAddr(request []byte) {
+// SendVerack répond à la version d'un pair accepté
+func (n *Node) SendVerack(addr string) {
+	payload := GobEncode(Verack{n.Address})
+	request := append(CmdToBytes("verack"), payload...)
+
+	n.SendData(addr, request) // Ignore error for verack messages
+}
+
+func (n *Node) HandleAddr(request []byte, origin string) {
 	var buff bytes.Buffer
 	var payload Addr
 
@@ -192,16 +315,71 @@ func HandleAddr(request []byte) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		panic(malformedError{err})
+	}
 
+	if n.bans.IsBanned(payload.AddrFrom) {
+		return
 	}
+	if len(payload.Addresses) > maxAddrPerMessage {
+		n.bans.Misbehaving(origin, scoreMalformed, fmt.Sprintf("addr message with %d addresses", len(payload.Addresses)))
+		return
+	}
+	n.peers.Seen(payload.AddrFrom)
+
+	now := time.Now()
+	var relay []NetAddress
+	for _, address := range payload.Addresses {
+		timestamp := time.Unix(address.Timestamp, 0)
+		if !n.addrBook.Add(address.Address, address.Services, timestamp, payload.AddrFrom) {
+			continue
+		}
+		if now.Sub(timestamp) < addrRelayFreshness {
+			relay = append(relay, address)
+		}
+	}
+	fresh, tried := n.addrBook.Counts()
+	fmt.Printf("there are %d known nodes (%d new, %d tried)\n", fresh+tried, fresh, tried)
 
-	KnownNodes = append(KnownNodes, payload.AddrList...)
-	fmt.Printf("there are %d known nodes\n", len(KnownNodes))
-	RequestBlocks()
+	// Les petites annonces récentes sont relayées à quelques pairs, les réponses à getaddr ne le sont pas
+	if len(relay) == 0 || len(payload.Addresses) > addrRelayMaxSize {
+		return
+	}
+	targets := n.peers.PeerAddresses()
+	mrand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+	sent := 0
+	for _, node := range targets {
+		if sent >= addrRelayPeers {
+			break
+		}
+		if node != payload.AddrFrom {
+			n.SendAddr(node, relay)
+			sent++
+		}
+	}
 }
 
-func HandleBlock(request []byte, chain *blockchain.BlockChain) {
+// HandleGetAddr répond à un pair avec un échantillon du carnet d'adresses, au plus une fois par
+// addrGossipInterval
+func (n *Node) HandleGetAddr(request []byte) {
+	var buff bytes.Buffer
+	var payload GetAddr
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		panic(malformedError{err})
+	}
+
+	if !n.peers.MarkAddrAnswered(payload.AddrFrom) {
+		return
+	}
+
+	n.SendAddr(payload.AddrFrom, n.addrBook.GetAddresses())
+}
+
+func (n *Node) HandleBlock(request []byte, origin string) {
 	var buff bytes.Buffer
 	var payload Block
 
@@ -209,29 +387,52 @@ func HandleBlock(request []byte, chain *blockchain.BlockChain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		panic(malformedError{err})
+	}
+
+	if n.bans.IsBanned(payload.AddrFrom) {
+		return
 	}
 
 	blockData := payload.Block
-	block := blockchain.Deserialize(blockData)
+	block := decodePeerData(blockchain.Deserialize, blockData)
+	n.peers.Seen(payload.AddrFrom)
+
+	if !n.takeRequested("block", block.Hash) {
+		n.bans.Misbehaving(origin, scoreUnsolicited, fmt.Sprintf("unsolicited block %x", block.Hash))
+		return
+	}
 
 	fmt.Println("Recevied a new block!")
-	chain.AddBlock(block)
+	if err := n.Chain.AddBlock(block); err != nil {
+		fmt.Println(err)
+		if errors.Is(err, blockchain.ErrOrphanBlock) {
+			n.SendGetBlocks(payload.AddrFrom)
+		} else {
+			n.bans.Misbehaving(origin, scoreInvalidBlock, err.Error())
+		}
+		return
+	}
+	n.peers.UpdateHeight(payload.AddrFrom, block.Height)
 
 	fmt.Printf("Added block %x\n", block.Hash)
+	if bytes.Equal(n.Chain.LastHash(), block.Hash) {
+		n.cancelMining("new tip connected")
+	}
+	n.updateMempool(block)
+	n.wakeMiner()
+	if bytes.Equal(n.Chain.LastHash(), block.Hash) {
+		n.refreshPoolJobs()
+	}
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
-
-		blocksInTransit = blocksInTransit[1:]
+	if blockHash, ok := n.nextBlockInTransit(); ok {
+		n.SendGetData(payload.AddrFrom, "block", [][]byte{blockHash})
 	} else {
-		UTXOSet := blockchain.UTXOSet{chain}
-		UTXOSet.Reindex()
+		n.pruneChain()
 	}
 }
 
-func HandleInv(request []byte, chain *blockchain.BlockChain) {
+func (n *Node) HandleInv(request []byte, origin string) {
 	var buff bytes.Buffer
 	var payload Inv
 
@@ -239,36 +440,86 @@ func HandleInv(request []byte, chain *blockchain.BlockChain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		panic(malformedError{err})
+	}
+
+	if n.bans.IsBanned(payload.AddrFrom) {
+		return
+	}
+	// Un inv de blocs répond à getblocks avec toute la chaîne et n'est pas limité
+	if payload.Type != "block" && len(payload.Items) > maxInvPerMessage {
+		n.bans.Misbehaving(origin, scoreMalformed, fmt.Sprintf("inv message with %d items", len(payload.Items)))
+		return
 	}
 
 	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
+	n.peers.Seen(payload.AddrFrom)
 
 	if payload.Type == "block" {
-		blocksInTransit = payload.Items
+		// Les hashes arrivent du plus récent au plus ancien : on demande d'abord les
+		// plus anciens manquants pour que chaque bloc reçu trouve son parent
+		// Les blocs sont demandés un par un, chaque message arrivant sur sa propre connexion : demandés
+		// ensemble, ils seraient traités dans le désordre
+		// Seuls les blocs qui suivent le plus récent bloc connu manquent : une chaîne élaguée ou
+		// chargée depuis un snapshot n'a pas ceux sous sa base et ne doit pas les demander
+		var missing [][]byte
+		known := false
+		for _, hash := range payload.Items {
+			if _, err := n.Chain.GetHeader(hash); err == nil {
+				known = true
+				break
+			}
+			missing = append([][]byte{hash}, missing...)
+		}
+		// Un pair élagué n'a pas les blocs qui relient sa chaîne à la nôtre
+		if !known && len(payload.Items) > 1 && n.peers.ServesOnlyRecentBlocks(payload.AddrFrom) {
+			fmt.Printf("%s is pruned and cannot serve the blocks we miss\n", payload.AddrFrom)
+			return
+		}
+		n.transitMutex.Lock()
+		n.blocksInTransit = missing
+		n.transitMutex.Unlock()
 
-		blockHash := payload.Items[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
+		if blockHash, ok := n.nextBlockInTransit(); ok {
+			n.SendGetData(payload.AddrFrom, "block", [][]byte{blockHash})
+		}
+	}
 
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+	if payload.Type == "tx" {
+		var missing [][]byte
+		for _, txID := range payload.Items {
+			id := hex.EncodeToString(txID)
+			n.poolMutex.Lock()
+			_, inPool := n.memoryPool[id]
+			_, pending := n.pendingPool[id]
+			n.poolMutex.Unlock()
+
+			if !inPool && !pending && !n.recentTxs.Contains(txID) {
+				missing = append(missing, txID)
 			}
 		}
-		blocksInTransit = newInTransit
+		if len(missing) > 0 {
+			n.SendGetData(payload.AddrFrom, "tx", missing)
+		}
 	}
+}
 
-	if payload.Type == "tx" {
-		txID := payload.Items[0]
+// nextBlockInTransit retire et retourne le prochain bloc à demander
+// Retourne false quand tous les blocs annoncés ont été demandés
+func (n *Node) nextBlockInTransit() ([]byte, bool) {
+	n.transitMutex.Lock()
+	defer n.transitMutex.Unlock()
 
-		if memoryPool[hex.EncodeToString(txID)].ID == nil {
-			SendGetData(payload.AddrFrom, "tx", txID)
-		}
+	if len(n.blocksInTransit) == 0 {
+		return nil, false
 	}
+	blockHash := n.blocksInTransit[0]
+	n.blocksInTransit = n.blocksInTransit[1:]
+
+	return blockHash, true
 }
 
-func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) {
+func (n *Node) HandleGetBlocks(request []byte) {
 	var buff bytes.Buffer
 	var payload GetBlocks
 
@@ -276,14 +527,17 @@ func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		panic(malformedError{err})
 	}
 
-	blocks := chain.GetBlockHashes()
-	SendInv(payload.AddrFrom, "block", blocks)
+	n.peers.Seen(payload.AddrFrom)
+	blocks := n.Chain.GetBlockHashes()
+	n.SendInv(payload.AddrFrom, "block", blocks)
 }
 
-func HandleGetData(request []byte, chain *blockchain.BlockChain) {
+// HandleGetData envoie les données demandées par un pair, puis un notfound pour celles que le
+// nœud n'a pas
+func (n *Node) HandleGetData(request []byte, origin string) {
 	var buff bytes.Buffer
 	var payload GetData
 
@@ -291,27 +545,117 @@ func HandleGetData(request []byte, chain *blockchain.BlockChain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		panic(malformedError{err})
 	}
 
-	if payload.Type == "block" {
-		block, err := chain.GetBlock([]byte(payload.ID))
+	if len(payload.Items) > maxInvPerMessage {
+		n.bans.Misbehaving(origin, scoreMalformed, fmt.Sprintf("getdata message with %d items", len(payload.Items)))
+		return
+	}
+
+	var notFound [][]byte
+	for _, id := range payload.Items {
+		if !n.sendRequestedData(payload.AddrFrom, payload.Type, id) {
+			notFound = append(notFound, id)
+		}
+	}
+	if len(notFound) > 0 {
+		n.SendNotFound(payload.AddrFrom, payload.Type, notFound)
+	}
+}
+
+// sendRequestedData envoie une donnée demandée par getdata
+// Retourne false si le nœud ne l'a pas
+func (n *Node) sendRequestedData(address, kind string, id []byte) bool {
+	switch kind {
+	case "block":
+		block, err := n.Chain.GetBlock(id)
 		if err != nil {
-			return
+			if _, err := n.Chain.GetHeader(id); err == nil {
+				fmt.Printf("Block %x requested by %s is pruned\n", id, address)
+			}
+			return false
+		}
+		n.SendBlock(address, &block)
+
+	case "tx":
+		n.poolMutex.Lock()
+		tx, ok := n.memoryPool[hex.EncodeToString(id)]
+		n.poolMutex.Unlock()
+		if !ok {
+			return false
+		}
+		n.SendTx(address, &tx) // Ignore error for tx response
+
+	case "merkleblock":
+		tx, err := n.Chain.FindTransaction(id)
+		if err != nil {
+			return false
 		}
+		proof, err := n.Chain.GetTxProof(id)
+		if err != nil {
+			return false
+		}
+		n.SendMerkleBlock(address, &proof, &tx)
 
-		SendBlock(payload.AddrFrom, &block)
+	default:
+		return false
 	}
 
-	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := memoryPool[txID]
+	return true
+}
+
+// HandleNotFound oublie les demandes auxquelles un pair n'a pas pu répondre
+func (n *Node) HandleNotFound(request []byte) {
+	var buff bytes.Buffer
+	var payload NotFound
 
-		SendTx(payload.AddrFrom, &tx) // Ignore error for tx response
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		panic(malformedError{err})
+	}
+
+	for _, id := range payload.Items {
+		n.takeRequested(payload.Type, id)
 	}
+	fmt.Printf("%s does not have %d requested %s\n", payload.AddrFrom, len(payload.Items), payload.Type)
 }
 
-func HandleTx(request []byte, chain *blockchain.BlockChain) {
+// HandleMerkleBlock vérifie une preuve d'inclusion reçue contre notre chaîne
+func (n *Node) HandleMerkleBlock(request []byte) {
+	var buff bytes.Buffer
+	var payload MerkleBlock
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		panic(malformedError{err})
+	}
+
+	proof, err := blockchain.DeserializeTxProof(payload.Proof)
+	if err != nil {
+		fmt.Printf("Invalid merkleblock from %s: %v\n", payload.AddrFrom, err)
+		return
+	}
+	tx := decodePeerData(blockchain.DeserializeTransaction, payload.Transaction)
+	if !bytes.Equal(tx.Hash(), proof.Proof.TxID) {
+		fmt.Printf("Merkleblock from %s does not match its transaction\n", payload.AddrFrom)
+		return
+	}
+
+	confirmations, err := n.Chain.VerifyTxProof(proof)
+	if err != nil {
+		fmt.Printf("Proof for transaction %x rejected: %v\n", tx.ID, err)
+		return
+	}
+
+	fmt.Printf("Transaction %x confirmed in block %x (%d confirmations)\n", tx.ID, proof.Header.Hash, confirmations)
+}
+
+func (n *Node) HandleTx(request []byte, origin string) {
 	var buff bytes.Buffer
 	var payload Tx
 
@@ -319,78 +663,198 @@ func HandleTx(request []byte, chain *blockchain.BlockChain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		panic(malformedError{err})
+	}
+
+	if n.bans.IsBanned(payload.AddrFrom) {
+		return
 	}
 
 	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
-	memoryPool[hex.EncodeToString(tx.ID)] = tx
+	tx := decodePeerData(blockchain.DeserializeTransaction, txData)
+	n.peers.Seen(payload.AddrFrom)
 
-	fmt.Printf("%s, %d", nodeAddress, len(memoryPool))
+	// Les wallets soumettent leurs transactions sans qu'on les demande, pas les pairs. Un wallet local
+	// partage l'hôte des pairs de la même machine : seul un pair distant se voit reprocher l'envoi
+	if !n.takeRequested("tx", tx.ID) && n.peers.IsPeerOrigin(origin) && !isLoopback(origin) {
+		n.bans.Misbehaving(origin, scoreUnsolicited, fmt.Sprintf("unsolicited transaction %x", tx.ID))
+		return
+	}
 
-	if nodeAddress == KnownNodes[0] {
-		for _, node := range KnownNodes {
-			if node != nodeAddress && node != payload.AddrFrom {
-				SendInv(node, "tx", [][]byte{tx.ID})
-			}
-		}
-	} else {
-		if len(memoryPool) >= 1 && len(mineAddress) > 0 {
-			fmt.Printf("Mining triggered with %d transactions in pool\n", len(memoryPool))
-			MineTx(chain)
+	// Une transaction déjà acceptée n'est ni revalidée ni relayée. Son ID n'est retenu qu'une fois
+	// la transaction validée : un pair ne peut pas faire ignorer une transaction en annonçant son ID
+	if n.recentTxs.Contains(tx.ID) {
+		return
+	}
+	if err := n.AddToMempool(tx); err != nil {
+		var invalid invalidTxError
+		if errors.As(err, &invalid) {
+			n.bans.Misbehaving(origin, scoreInvalidTx, err.Error())
 		}
+		return
+	}
+	n.recentTxs.Add(tx.ID)
+	n.poolMutex.Lock()
+	_, ok := n.memoryPool[hex.EncodeToString(tx.ID)]
+	poolSize := len(n.memoryPool)
+	n.poolMutex.Unlock()
+	if !ok {
+		return
 	}
-}
 
-func MineTx(chain *blockchain.BlockChain) {
-	var txs []*blockchain.Transaction
+	fmt.Printf("%s, %d\n", n.Address, poolSize)
 
-	// Forcer la mise à jour des UTXOs avant validation
-	fmt.Println("Updating UTXO set before transaction validation...")
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
+	n.relayTx(tx.ID, payload.AddrFrom)
+	n.notifyMiner(&tx)
+}
 
-	for id := range memoryPool {
-		fmt.Printf("tx: %s\n", memoryPool[id].ID)
-		tx := memoryPool[id]
-		if chain.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
-			fmt.Printf("Transaction %x is valid\n", tx.ID)
-		} else {
-			fmt.Printf("Transaction %x is invalid\n", tx.ID)
+// AddToMempool accepte une transaction standard et valide dans le mempool et la persiste
+// La transaction est vérifiée contre le set UTXO du sommet, scripts compris, et ne doit dépenser
+// aucune sortie déjà dépensée par une transaction du mempool. Les transactions pas encore minables
+// (locktime, coinbase immature) sont mises en attente
+// Retourne une erreur si la transaction est rejetée, de type invalidTxError si elle enfreint les
+// règles de consensus ou si ses scripts sont invalides
+func (n *Node) AddToMempool(tx blockchain.Transaction) error {
+	id := hex.EncodeToString(tx.ID)
+	if err := tx.CheckStandard(); err != nil {
+		fmt.Printf("Rejecting transaction %x: %v\n", tx.ID, err)
+		return err
+	}
+	if _, err := n.Chain.CheckMempoolTx(&tx); err != nil {
+		fmt.Printf("Rejecting transaction %x: %v\n", tx.ID, err)
+		if errors.Is(err, blockchain.ErrMissingOutput) {
+			return err
 		}
+		return invalidTxError{err}
 	}
 
-	if len(txs) == 0 {
-		fmt.Println("All Transactions are invalid")
-		return
+	n.poolMutex.Lock()
+	defer n.poolMutex.Unlock()
+
+	if _, ok := n.memoryPool[id]; ok {
+		return nil
+	}
+	if _, ok := n.pendingPool[id]; ok {
+		return nil
 	}
+	if err := n.checkMempoolConflicts(&tx); err != nil {
+		fmt.Printf("Rejecting transaction %x: %v\n", tx.ID, err)
+		return err
+	}
+	n.Chain.SaveMempoolTx(&tx)
 
-	cbTx := blockchain.CoinbaseTx(mineAddress, "")
-	txs = append(txs, cbTx)
+	if err := checkReadyForNextBlock(n.Chain, &tx); err != nil {
+		fmt.Printf("Holding transaction %x until it can be mined: %v\n", tx.ID, err)
+		n.pendingPool[id] = tx
+		return nil
+	}
+	n.memoryPool[id] = tx
 
-	newBlock := chain.MineBlock(txs)
-	UTXOSet.Reindex()
+	return nil
+}
 
-	fmt.Println("New Block mined")
+// checkMempoolConflicts vérifie qu'aucune transaction des deux pools ne dépense une sortie que tx
+// dépense aussi. Appelée avec poolMutex
+func (n *Node) checkMempoolConflicts(tx *blockchain.Transaction) error {
+	spends := make(map[string]bool)
+	for _, in := range tx.Inputs {
+		spends[fmt.Sprintf("%x:%d", in.ID, in.Out)] = true
+	}
 
-	for _, tx := range txs {
-		txID := hex.EncodeToString(tx.ID)
-		delete(memoryPool, txID)
+	for _, pool := range []map[string]blockchain.Transaction{n.memoryPool, n.pendingPool} {
+		for id, other := range pool {
+			for _, in := range other.Inputs {
+				if spends[fmt.Sprintf("%x:%d", in.ID, in.Out)] {
+					return fmt.Errorf("transaction %x spends output %d of %x, already spent by mempool transaction %s",
+						tx.ID, in.Out, in.ID, id)
+				}
+			}
+		}
 	}
 
-	for _, node := range KnownNodes {
-		if node != nodeAddress {
-			SendInv(node, "block", [][]byte{newBlock.Hash})
+	return nil
+}
+
+// RemoveFromMempool retire une transaction minée ou invalide des deux pools
+func (n *Node) RemoveFromMempool(txID []byte) {
+	id := hex.EncodeToString(txID)
+
+	n.poolMutex.Lock()
+	delete(n.memoryPool, id)
+	delete(n.pendingPool, id)
+	n.poolMutex.Unlock()
+
+	n.Chain.DeleteMempoolTx(txID)
+}
+
+// LoadMempool recharge les transactions non confirmées persistées lors d'une exécution précédente
+func (n *Node) LoadMempool() {
+	for _, tx := range n.Chain.MempoolTransactions() {
+		// Une transaction confirmée ou devenue invalide depuis n'est pas gardée
+		if err := n.AddToMempool(tx); err != nil {
+			n.Chain.DeleteMempoolTx(tx.ID)
+		}
+	}
+}
+
+// updateMempool met à jour les deux pools après l'ajout d'un bloc : ses transactions en sortent,
+// comme celles qui ne sont plus valides au sommet, puis les transactions en attente devenues
+// minables sont promues
+func (n *Node) updateMempool(block *blockchain.Block) {
+	for _, tx := range block.Transactions {
+		n.RemoveFromMempool(tx.ID)
+	}
+	n.evictInvalidTxs()
+	n.PromotePendingTxs()
+}
+
+// evictInvalidTxs retire des deux pools les transactions refusées contre le set UTXO du sommet,
+// par exemple parce qu'un bloc reçu d'un pair dépense la même sortie qu'elles
+func (n *Node) evictInvalidTxs() {
+	var txs []blockchain.Transaction
+	n.poolMutex.Lock()
+	for _, pool := range []map[string]blockchain.Transaction{n.memoryPool, n.pendingPool} {
+		for _, tx := range pool {
+			txs = append(txs, tx)
 		}
 	}
+	n.poolMutex.Unlock()
 
-	if len(memoryPool) > 0 {
-		MineTx(chain)
+	for i := range txs {
+		if _, err := n.Chain.CheckMempoolTx(&txs[i]); err != nil {
+			fmt.Printf("Evicting transaction %x from the mempool: %v\n", txs[i].ID, err)
+			n.RemoveFromMempool(txs[i].ID)
+		}
 	}
 }
 
-func HandleVersion(request []byte, chain *blockchain.BlockChain) {
+// PromotePendingTxs déplace vers le mempool les transactions devenues minables
+// après l'ajout d'un nouveau bloc
+func (n *Node) PromotePendingTxs() {
+	n.poolMutex.Lock()
+	defer n.poolMutex.Unlock()
+
+	for id, tx := range n.pendingPool {
+		if err := checkReadyForNextBlock(n.Chain, &tx); err != nil {
+			continue
+		}
+
+		fmt.Printf("Transaction %x can now be mined\n", tx.ID)
+		delete(n.pendingPool, id)
+		n.memoryPool[id] = tx
+	}
+}
+
+// checkReadyForNextBlock vérifie les verrous temporels et la maturité des coinbases dépensées
+func checkReadyForNextBlock(chain *blockchain.BlockChain, tx *blockchain.Transaction) error {
+	if err := chain.CheckLocksForNextBlock(tx); err != nil {
+		return err
+	}
+
+	return chain.CheckCoinbaseMaturity(tx, chain.GetBestHeight()+1)
+}
+
+func (n *Node) HandleVersion(request []byte, identity string) {
 	var buff bytes.Buffer
 	var payload Version
 
@@ -398,78 +862,182 @@ func HandleVersion(request []byte, chain *blockchain.BlockChain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		panic(malformedError{err})
 	}
 
-	bestHeight := chain.GetBestHeight()
+	accepted, sendVersion := n.peers.HandleVersion(payload, identity)
+	if !accepted {
+		return
+	}
+
+	bestHeight := n.Chain.GetBestHeight()
 	otherHeight := payload.BestHeight
 
+	if sendVersion || bestHeight > otherHeight {
+		n.SendVersion(payload.AddrFrom)
+	}
+	n.SendVerack(payload.AddrFrom)
+	n.peerReady(payload.AddrFrom)
+
 	if bestHeight < otherHeight {
-		SendGetBlocks(payload.AddrFrom)
-	} else if bestHeight > otherHeight {
-		SendVersion(payload.AddrFrom, chain)
+		n.SendGetBlocks(payload.AddrFrom)
 	}
+}
+
+// SendPing envoie un ping à un pair
+func (n *Node) SendPing(addr string, nonce uint64) {
+	payload := GobEncode(Ping{n.Address, nonce})
+	request := append(CmdToBytes("ping"), payload...)
+
+	n.SendData(addr, request) // A failed dial already drops the peer
+}
 
-	if !NodeIsKnown(payload.AddrFrom) {
-		KnownNodes = append(KnownNodes, payload.AddrFrom)
+// SendPong répond au ping d'un pair
+func (n *Node) SendPong(addr string, nonce uint64) {
+	payload := GobEncode(Pong{n.Address, nonce})
+	request := append(CmdToBytes("pong"), payload...)
+
+	n.SendData(addr, request) // Ignore error for pong messages
+}
+
+// HandlePing répond au ping d'un pair avec le même nonce
+func (n *Node) HandlePing(request []byte) {
+	var buff bytes.Buffer
+	var payload Ping
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		panic(malformedError{err})
+	}
+
+	if n.bans.IsBanned(payload.AddrFrom) {
+		return
+	}
+	n.peers.Seen(payload.AddrFrom)
+	n.SendPong(payload.AddrFrom, payload.Nonce)
+}
+
+// HandlePong enregistre le temps de réponse d'un pair à notre ping
+func (n *Node) HandlePong(request []byte) {
+	var buff bytes.Buffer
+	var payload Pong
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		panic(malformedError{err})
 	}
+
+	n.peers.HandlePong(payload.AddrFrom, payload.Nonce)
 }
 
-func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
-	req, err := ioutil.ReadAll(conn)
+// HandleVerack termine la poignée de main avec un pair
+func (n *Node) HandleVerack(request []byte) {
+	var buff bytes.Buffer
+	var payload Verack
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		panic(malformedError{err})
+	}
+
+	n.peers.HandleVerack(payload.AddrFrom)
+	n.peerReady(payload.AddrFrom)
+}
+
+// peerReady demande des adresses à un pair sortant dès que la session avec lui est établie
+func (n *Node) peerReady(address string) {
+	if n.peers.Ready(address) {
+		n.SendGetAddr(address)
+	}
+}
+
+func (n *Node) HandleConnection(conn net.Conn) {
 	defer conn.Close()
 
+	// Les fautes sont reprochées à l'identité vérifiée de l'expéditeur sur une connexion chiffrée,
+	// sinon à l'hôte de la connexion : l'adresse AddrFrom d'un message est choisie par son expéditeur
+	origin := remoteHost(conn)
+	if n.bans.IsBanned(origin) {
+		return
+	}
+
+	command := "unknown"
+	defer n.recoverMalformed(&origin, &command)
+
+	req, identity, err := n.receiveMessage(conn)
 	if err != nil {
-		log.Panic(err)
+		fmt.Printf("Failed to read from %s: %v\n", origin, err)
+		return
+	}
+	if identity != "" {
+		origin = identity
+		if n.bans.IsBanned(origin) {
+			return
+		}
+	}
+	if len(req) < commandLength {
+		panic(malformedError{fmt.Errorf("%d bytes", len(req))})
 	}
-	command := BytesToCmd(req[:commandLength])
+	command = BytesToCmd(req[:commandLength])
 	fmt.Printf("Received %s command\n", command)
 
 	switch command {
 	case "addr":
-		HandleAddr(req)
+		n.HandleAddr(req, origin)
+	case "getaddr":
+		n.HandleGetAddr(req)
 	case "block":
-		HandleBlock(req, chain)
+		n.HandleBlock(req, origin)
 	case "inv":
-		HandleInv(req, chain)
+		n.HandleInv(req, origin)
 	case "getblocks":
-		HandleGetBlocks(req, chain)
+		n.HandleGetBlocks(req)
 	case "getdata":
-		HandleGetData(req, chain)
+		n.HandleGetData(req, origin)
+	case "notfound":
+		n.HandleNotFound(req)
+	case "merkleblock":
+		n.HandleMerkleBlock(req)
+	case "getcfilters":
+		n.HandleGetCFilters(req)
+	case "getheaders":
+		n.HandleGetHeaders(req)
 	case "tx":
-		HandleTx(req, chain)
+		n.HandleTx(req, origin)
 	case "version":
-		HandleVersion(req, chain)
+		n.HandleVersion(req, identity)
+	case "verack":
+		n.HandleVerack(req)
+	case "ping":
+		n.HandlePing(req)
+	case "pong":
+		n.HandlePong(req)
 	default:
 		fmt.Println("Unknown command")
 	}
 
 }
 
-func StartServer(nodeID, minerAddress string) {
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
-	mineAddress = minerAddress
-	ln, err := net.Listen(protocol, nodeAddress)
-	if err != nil {
-		log.Panic(err)
-	}
-	defer ln.Close()
+// StartServer démarre un nœud complet sur TCP et le fait tourner jusqu'à son interruption
+func StartServer(nodeID, minerAddress, rpcAddress string, policy MiningPolicy, config NetConfig) {
+	n := NewNode(nodeID, config, TCPTransport{})
+	n.SetMining(minerAddress, policy)
 
 	chain := blockchain.ContinueBlockChain(nodeID)
 	defer chain.Database.Close()
-	go CloseDB(chain)
-
-	if nodeAddress != KnownNodes[0] {
-		SendVersion(KnownNodes[0], chain)
+	if err := n.Start(chain); err != nil {
+		log.Panic(err)
 	}
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Panic(err)
-		}
-		go HandleConnection(conn, chain)
+	n.closeOnInterrupt(chain.Database)
+	go n.StartRPCServer(rpcAddress)
 
-	}
+	select {}
 }
 
 func GobEncode(data interface{}) []byte {
@@ -484,24 +1052,17 @@ func GobEncode(data interface{}) []byte {
 	return buff.Bytes()
 }
 
-func NodeIsKnown(addr string) bool {
-	for _, node := range KnownNodes {
-		if node == addr {
-			return true
-		}
-	}
-
-	return false
-}
-
-func CloseDB(chain *blockchain.BlockChain) {
+// closeOnInterrupt arrête le nœud et ferme proprement sa base de données à la réception de SIGINT
+// ou SIGTERM
+func (n *Node) closeOnInterrupt(db io.Closer) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
 		<-c
 		fmt.Println("\nGracefully shutting down...")
-		chain.Database.Close()
+		n.Stop()
+		db.Close()
 		os.Exit(1)
 	}()
 }
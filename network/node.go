@@ -0,0 +1,235 @@
+package network
+
+import (
+	"blockchain-go/blockchain"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Node est un nœud du réseau pair-à-pair : sa chaîne, son mempool, ses pairs et son carnet
+// d'adresses. Toutes ses connexions passent par son Transport, plusieurs nœuds peuvent donc vivre
+// dans un même processus, reliés par un MemoryNetwork
+type Node struct {
+	ID        string
+	Address   string // Address advertised to peers, set by Start
+	Config    NetConfig
+	Transport Transport
+	Chain     *blockchain.BlockChain // Full chain, nil for a light node
+
+	mineAddress  string
+	miningPolicy MiningPolicy
+	nonce        uint64     // Identifies this node in its versions
+	services     uint64     // Services announced by this node
+	pruneMutex   sync.Mutex // Prunes one at a time
+
+	peers     *PeerManager
+	bans      *BanList
+	addrBook  *AddrManager
+	secure    *secureTransport // Encrypted transport, nil when connections are in cleartext
+	recentTxs *recentFilter
+
+	blocksInTransit [][]byte   // Blocks still to request, oldest first
+	transitMutex    sync.Mutex // Guards blocksInTransit
+	memoryPool      map[string]blockchain.Transaction
+	pendingPool     map[string]blockchain.Transaction // Transactions not final yet
+	poolMutex       sync.Mutex                        // Guards memoryPool and pendingPool
+
+	requestedData  map[string]*dataRequest // Blocks and transactions asked with getdata
+	requestedMutex sync.Mutex
+
+	invMutex  sync.Mutex
+	invQueues map[string]*invQueue
+
+	minerWake      chan struct{} // Wakes the idle miner up when new transactions can be mined
+	miningMutex    sync.Mutex
+	miningCancel   context.CancelFunc // Stops the block being mined, nil when idle
+	templateMinFee int                // Lowest fee in the block being mined
+	templateFull   bool               // Whether the block being mined holds maxTemplateTxs transactions
+	pool           *Pool              // Pool served by this node, nil when pool mode is off
+
+	headerChain *blockchain.HeaderChain // Header chain of a light node
+	spvKeys     [][]byte                // Public key hashes watched by a light node
+	spvAddrs    []string                // Addresses matching spvKeys
+	spvFetched  map[string]bool         // Blocks already requested by a light node
+	filterPeers map[string]bool         // Peers of a light node that serve compact filters
+	spvMutex    sync.Mutex              // Guards spvFetched and filterPeers
+
+	listener net.Listener
+	quit     chan struct{} // Closed by Stop, ends the background loops
+	stopOnce sync.Once
+}
+
+// NewNode crée un nœud qui passe par transport, sans le démarrer
+// Un nœud jamais démarré sert à envoyer des messages, par exemple une transaction depuis la ligne
+// de commande
+func NewNode(nodeID string, config NetConfig, transport Transport) *Node {
+	n := &Node{
+		ID:          nodeID,
+		Config:      config,
+		Transport:   transport,
+		nonce:       randomNonce(),
+		services:    ServiceNetwork | ServiceCFilters,
+		bans:        NewBanList(""),
+		addrBook:    NewAddrManager(""),
+		recentTxs:   newRecentFilter(recentlySeenSize),
+		memoryPool:  make(map[string]blockchain.Transaction),
+		pendingPool: make(map[string]blockchain.Transaction),
+
+		requestedData: make(map[string]*dataRequest),
+		invQueues:     make(map[string]*invQueue),
+		minerWake:     make(chan struct{}, 1),
+		spvFetched:    make(map[string]bool),
+		filterPeers:   make(map[string]bool),
+		quit:          make(chan struct{}),
+	}
+	n.peers = newPeerManager(n)
+	n.bans.disconnect = n.peers.Disconnect
+
+	return n
+}
+
+// SetMining fait miner le nœud au profit de minerAddress selon policy, ou servir un pool si
+// policy en désigne l'adresse. À appeler avant Start
+func (n *Node) SetMining(minerAddress string, policy MiningPolicy) {
+	n.mineAddress = minerAddress
+	n.miningPolicy = policy
+}
+
+// Start démarre un nœud complet sur chain : il écoute ses pairs, s'y connecte et mine si
+// SetMining l'a demandé. Le nœud tourne en arrière-plan jusqu'à Stop
+func (n *Node) Start(chain *blockchain.BlockChain) error {
+	// Une part plus difficile qu'un bloc ne serait jamais trouvée avant le bloc lui-même
+	if len(n.miningPolicy.PoolAddress) > 0 && n.miningPolicy.ShareDifficulty > chain.Params.Difficulty {
+		return fmt.Errorf("share difficulty %d is above the %d bits of the chain", n.miningPolicy.ShareDifficulty, chain.Params.Difficulty)
+	}
+	if err := n.listen(); err != nil {
+		return err
+	}
+	n.Chain = chain
+	if n.Config.Prune.Enabled() || len(chain.Base()) > 0 {
+		// Sans les anciens blocs, le nœud ne sert que ceux de la fenêtre de réorganisation
+		n.services = n.services&^ServiceNetwork | ServiceNetworkLimited
+	}
+	if !chain.HasCFilterHistory() {
+		// Une chaîne chargée depuis un snapshot n'a pas les filtres des blocs sous sa base
+		n.services &^= ServiceCFilters
+	}
+	n.pruneChain()
+	n.LoadMempool()
+
+	n.loadPeerState()
+	fmt.Printf("Listening on %s, advertised as %s\n", n.Config.Listen, n.Address)
+	go n.StartAddrGossip()
+	go n.StartInvTrickle()
+	n.peers.Start(chain.GetBestHeight)
+	if len(n.miningPolicy.PoolAddress) > 0 {
+		go n.StartPool(n.miningPolicy.PoolAddress, &Pool{Operator: n.mineAddress, ShareDifficulty: n.miningPolicy.ShareDifficulty})
+	} else if len(n.mineAddress) > 0 {
+		go n.StartMiner()
+	}
+
+	go n.serve(n.HandleConnection)
+	return nil
+}
+
+// pruneChain élague la chaîne jusqu'à la hauteur que permet la cible d'élagage du nœud
+func (n *Node) pruneChain() {
+	if !n.Config.Prune.Enabled() {
+		return
+	}
+	n.pruneMutex.Lock()
+	defer n.pruneMutex.Unlock()
+
+	height := n.Chain.PruneHeight(n.Config.Prune)
+	pruned, err := n.Chain.Prune(height)
+	if err != nil {
+		fmt.Printf("Cannot prune the chain: %v\n", err)
+		return
+	}
+	if pruned > 0 {
+		fmt.Printf("Pruned %d blocks, block bodies are kept from height %d\n", pruned, height)
+	}
+}
+
+// Stop arrête le nœud : il n'écoute plus, ses boucles s'arrêtent et son carnet d'adresses est
+// sauvegardé. La chaîne reste ouverte, elle appartient à l'appelant
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.quit)
+		if n.listener != nil {
+			n.listener.Close()
+		}
+		n.cancelMining("node stopped")
+		n.addrBook.Save()
+	})
+}
+
+// Peers retourne l'état des pairs du nœud
+func (n *Node) Peers() []Peer {
+	return n.peers.Peers()
+}
+
+// Connect ouvre une session avec un nœud sans attendre la maintenance des pairs
+func (n *Node) Connect(address string) {
+	n.peers.Connect(address)
+}
+
+// stopped indique si Stop a été appelé
+func (n *Node) stopped() bool {
+	select {
+	case <-n.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// listen fixe l'adresse annoncée du nœud, active le chiffrement demandé par sa configuration et
+// ouvre son écoute
+func (n *Node) listen() error {
+	address, err := n.Config.advertisedAddress()
+	if err != nil {
+		return err
+	}
+	n.Address = address
+	n.addrBook.local = address
+	if err := n.Config.enableEncryption(n); err != nil {
+		return err
+	}
+
+	ln, err := n.Transport.Listen(n.Config.Listen)
+	if err != nil {
+		return err
+	}
+	n.listener = ln
+
+	return nil
+}
+
+// loadPeerState charge les bannissements et le carnet d'adresses du nœud, puis y ajoute ses
+// nœuds d'amorçage
+func (n *Node) loadPeerState() {
+	n.bans = LoadBanList(n.ID)
+	n.bans.disconnect = n.peers.Disconnect
+	n.addrBook = LoadAddrManager(n.ID)
+	n.addrBook.local = n.Address
+	n.Config.seedAddressBook(n.addrBook)
+}
+
+// serve passe chaque connexion entrante à handle jusqu'à l'arrêt du nœud
+func (n *Node) serve(handle func(net.Conn)) {
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			if n.stopped() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Printf("Failed to accept a connection: %v\n", err)
+			continue
+		}
+		go handle(conn)
+	}
+}
@@ -0,0 +1,499 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Services annoncés par un nœud dans son message version
+const (
+	ServiceNetwork        uint64 = 1 << 0 // Serves full blocks and transactions
+	ServiceCFilters       uint64 = 1 << 1 // Serves compact block filters to light nodes
+	ServiceNetworkLimited uint64 = 1 << 2 // Serves transactions and only the blocks of the reorganization window
+)
+
+const (
+	DefaultMaxInbound     = 32 // Peers that connected to us
+	DefaultMaxOutbound    = 8  // Peers we connected to
+	DefaultTargetOutbound = 4  // Outbound peers the node keeps trying to reach
+
+	peerMaintenanceInterval = 10 * time.Second
+	handshakeTimeout        = 30 * time.Second // Delay for a peer to answer our version
+	reconnectBaseDelay      = 5 * time.Second  // Backoff after a first failure, doubled at each new one
+	reconnectMaxDelay       = 10 * time.Minute
+	pingInterval            = 2 * time.Minute // Delay between two pings to an established peer
+	pingTimeout             = time.Minute     // Delay for a peer to answer a ping before it is dropped
+)
+
+// Peer est l'état d'un pair connu de ce nœud
+// Les messages voyagent chacun sur leur propre connexion TCP : un pair est une session
+// ouverte par l'échange version/verack, identifiée par l'adresse d'écoute du pair
+type Peer struct {
+	Address     string
+	Identity    string // Verified identity key on encrypted connections, empty in cleartext
+	Inbound     bool   // The peer sent the first version
+	Version     int
+	Services    uint64
+	BestHeight  int
+	Latency     time.Duration // Round trip of the last version/verack or ping/pong
+	ConnectedAt time.Time
+	LastSeen    time.Time
+
+	nonce        uint64    // Nonce of the peer's version, a new one means the peer restarted
+	versionSent  time.Time // When our version was sent to the peer
+	versionRecv  bool
+	verackRecv   bool
+	announced    bool      // The established session was reported by Ready
+	addrAnswered time.Time // Last getaddr of the peer that was answered
+	pingNonce    uint64    // Nonce of the ping waiting for its pong, 0 if none
+	pingSent     time.Time // When the last ping was sent
+}
+
+// PingWait retourne depuis combien de temps le pair n'a pas répondu à notre ping, 0 si aucun
+// ping n'est en attente
+func (p *Peer) PingWait() time.Duration {
+	if p.pingNonce == 0 {
+		return 0
+	}
+
+	return time.Since(p.pingSent)
+}
+
+// Established indique si la poignée de main avec le pair est terminée dans les deux sens
+func (p *Peer) Established() bool {
+	return p.versionRecv && p.verackRecv
+}
+
+// PeerManager tient la liste des pairs
+// Il applique les limites de pairs entrants et sortants et choisit ses pairs sortants dans le
+// carnet d'adresses, qui espace les tentatives vers les adresses injoignables
+type PeerManager struct {
+	MaxInbound     int
+	MaxOutbound    int
+	TargetOutbound int
+
+	node       *Node
+	mutex      sync.Mutex
+	peers      map[string]*Peer
+	bestHeight func() int // Height announced in our versions
+}
+
+// newPeerManager crée le gestionnaire des pairs d'un nœud, avec les limites de sa configuration
+func newPeerManager(n *Node) *PeerManager {
+	return &PeerManager{
+		MaxInbound:     n.Config.MaxInbound,
+		MaxOutbound:    n.Config.MaxOutbound,
+		TargetOutbound: n.Config.TargetOutbound,
+		node:           n,
+		peers:          make(map[string]*Peer),
+		bestHeight:     func() int { return 0 },
+	}
+}
+
+// randomNonce tire un nonce aléatoire de 64 bits
+func randomNonce() uint64 {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		log.Panic(err)
+	}
+
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// Start ouvre les connexions sortantes puis les maintient en arrière-plan jusqu'à l'arrêt du nœud
+func (pm *PeerManager) Start(bestHeight func() int) {
+	pm.mutex.Lock()
+	pm.bestHeight = bestHeight
+	pm.mutex.Unlock()
+
+	go func() {
+		for {
+			pm.maintain()
+
+			select {
+			case <-time.After(peerMaintenanceInterval):
+			case <-pm.node.quit:
+				return
+			}
+		}
+	}()
+}
+
+// IsKnown indique si une adresse est connue, comme pair ou dans le carnet d'adresses
+func (pm *PeerManager) IsKnown(address string) bool {
+	pm.mutex.Lock()
+	_, isPeer := pm.peers[address]
+	pm.mutex.Unlock()
+
+	return isPeer || pm.node.addrBook.IsKnown(address)
+}
+
+// Connect ouvre une session sortante avec address en lui envoyant notre version
+func (pm *PeerManager) Connect(address string) {
+	if pm.node.bans.IsBanned(address) {
+		return
+	}
+
+	pm.mutex.Lock()
+	if _, ok := pm.peers[address]; ok || address == pm.node.Address {
+		pm.mutex.Unlock()
+		return
+	}
+	if _, outbound := pm.counts(); outbound >= pm.MaxOutbound {
+		pm.mutex.Unlock()
+		return
+	}
+
+	now := time.Now()
+	pm.peers[address] = &Peer{Address: address, ConnectedAt: now, LastSeen: now, versionSent: now}
+	height := pm.bestHeight()
+	pm.mutex.Unlock()
+
+	pm.node.addrBook.Attempt(address)
+
+	fmt.Printf("Connecting to %s\n", address)
+	pm.node.sendVersionWithHeight(address, height)
+}
+
+// HandleVersion enregistre la version d'un pair et l'identité vérifiée de la connexion qui l'a
+// apportée, vide en clair
+// Retourne false si le pair est refusé, et true dans sendVersion s'il faut lui répondre avec
+// notre propre version avant le verack
+func (pm *PeerManager) HandleVersion(v Version, identity string) (accepted, sendVersion bool) {
+	if pm.node.bans.IsBanned(v.AddrFrom) {
+		return false, false
+	}
+
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if v.Nonce == pm.node.nonce || v.AddrFrom == pm.node.Address {
+		return false, false
+	}
+
+	now := time.Now()
+	peer, ok := pm.peers[v.AddrFrom]
+	// Une session chiffrée reste liée à l'identité qui l'a ouverte, même si le pair redémarre
+	if ok && peer.Identity != "" && peer.Identity != identity {
+		fmt.Printf("Refusing version from %s: %v\n", v.AddrFrom, ErrIdentityMismatch)
+		return false, false
+	}
+	if ok && peer.versionRecv && peer.nonce != v.Nonce {
+		// Le pair a redémarré : la poignée de main recommence
+		ok = false
+		delete(pm.peers, v.AddrFrom)
+	}
+	if !ok {
+		if inbound, _ := pm.counts(); inbound >= pm.MaxInbound {
+			fmt.Printf("Refusing %s: %d inbound peers already\n", v.AddrFrom, inbound)
+			return false, false
+		}
+		peer = &Peer{Address: v.AddrFrom, Inbound: true, ConnectedAt: now}
+		pm.peers[v.AddrFrom] = peer
+	}
+	if v.Services&(ServiceNetwork|ServiceNetworkLimited) != 0 {
+		pm.node.addrBook.Add(v.AddrFrom, v.Services, now, v.AddrFrom)
+	}
+
+	peer.Identity = identity
+	peer.Version = v.Version
+	peer.Services = v.Services
+	peer.BestHeight = v.BestHeight
+	peer.LastSeen = now
+	peer.nonce = v.Nonce
+	peer.versionRecv = true
+
+	if peer.versionSent.IsZero() {
+		peer.versionSent = now
+		return true, true
+	}
+	return true, false
+}
+
+// HandleVerack termine la poignée de main avec un pair et mesure son temps de réponse
+func (pm *PeerManager) HandleVerack(address string) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	peer, ok := pm.peers[address]
+	if !ok || peer.verackRecv {
+		return
+	}
+
+	now := time.Now()
+	peer.verackRecv = true
+	peer.LastSeen = now
+	peer.Latency = now.Sub(peer.versionSent)
+}
+
+// Ready signale une seule fois qu'une session vient de s'établir, la version et le verack du
+// pair pouvant arriver dans n'importe quel ordre
+// Retourne true pour un pair sortant : son adresse est alors marquée comme éprouvée dans le carnet
+func (pm *PeerManager) Ready(address string) bool {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	peer, ok := pm.peers[address]
+	if !ok || !peer.Established() || peer.announced {
+		return false
+	}
+	peer.announced = true
+
+	direction := "outbound"
+	if peer.Inbound {
+		direction = "inbound"
+	}
+	fmt.Printf("Connected to %s peer %s at height %d\n", direction, address, peer.BestHeight)
+	if peer.Inbound {
+		return false
+	}
+	pm.node.addrBook.Good(address)
+
+	return true
+}
+
+// HandlePong mesure le temps de réponse d'un pair qui répond à notre dernier ping
+// Un pong dont le nonce ne correspond pas au ping en attente est ignoré
+func (pm *PeerManager) HandlePong(address string, nonce uint64) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	peer, ok := pm.peers[address]
+	if !ok || peer.pingNonce == 0 || peer.pingNonce != nonce {
+		return
+	}
+
+	now := time.Now()
+	peer.Latency = now.Sub(peer.pingSent)
+	peer.LastSeen = now
+	peer.pingNonce = 0
+}
+
+// IsPeer indique si la poignée de main avec address est terminée
+func (pm *PeerManager) IsPeer(address string) bool {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	peer, ok := pm.peers[address]
+	return ok && peer.Established()
+}
+
+// IsPeerOrigin indique si origin, l'hôte d'une connexion ou l'identité vérifiée de son expéditeur,
+// est celle d'un pair dont la poignée de main est terminée
+func (pm *PeerManager) IsPeerOrigin(origin string) bool {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	for address, peer := range pm.peers {
+		host, _, err := net.SplitHostPort(address)
+		if peer.Established() && (address == origin || (err == nil && host == origin) || peer.Identity == origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MarkAddrAnswered note que le getaddr d'un pair a reçu sa réponse
+// Retourne false si le pair n'a pas envoyé sa version ou a déjà reçu une réponse depuis moins
+// de addrGossipInterval
+func (pm *PeerManager) MarkAddrAnswered(address string) bool {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	peer, ok := pm.peers[address]
+	if !ok || !peer.versionRecv || time.Since(peer.addrAnswered) < addrGossipInterval {
+		return false
+	}
+	peer.addrAnswered = time.Now()
+
+	return true
+}
+
+// Disconnect oublie la session avec un pair, par exemple après son bannissement
+// address est l'adresse d'un pair, un hôte seul ou une identité, dont tous les pairs sont oubliés
+func (pm *PeerManager) Disconnect(address string) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	for peerAddress, peer := range pm.peers {
+		host, _, err := net.SplitHostPort(peerAddress)
+		if peerAddress == address || (err == nil && host == address) || peer.Identity == address {
+			delete(pm.peers, peerAddress)
+		}
+	}
+}
+
+// Identity retourne l'identité vérifiée d'un pair, vide si elle est inconnue
+func (pm *PeerManager) Identity(address string) string {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if peer, ok := pm.peers[address]; ok {
+		return peer.Identity
+	}
+
+	return ""
+}
+
+// Seen met à jour la dernière activité d'un pair
+func (pm *PeerManager) Seen(address string) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if peer, ok := pm.peers[address]; ok {
+		peer.LastSeen = time.Now()
+	}
+}
+
+// UpdateHeight relève la hauteur connue d'un pair qui nous a envoyé un bloc plus haut
+func (pm *PeerManager) UpdateHeight(address string, height int) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if peer, ok := pm.peers[address]; ok && height > peer.BestHeight {
+		peer.BestHeight = height
+	}
+}
+
+// ServesOnlyRecentBlocks indique si un pair est élagué : il ne sert que les derniers blocs
+func (pm *PeerManager) ServesOnlyRecentBlocks(address string) bool {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	peer, ok := pm.peers[address]
+	return ok && peer.Services&ServiceNetwork == 0 && peer.Services&ServiceNetworkLimited != 0
+}
+
+// Failed déconnecte un pair injoignable et repousse la prochaine tentative vers son adresse
+func (pm *PeerManager) Failed(address string) {
+	pm.mutex.Lock()
+	delete(pm.peers, address)
+	pm.mutex.Unlock()
+
+	if delay, ok := pm.node.addrBook.Failed(address); ok {
+		fmt.Printf("%s is not available, next attempt in %s\n", address, delay)
+	}
+}
+
+// Peers retourne une copie de l'état des pairs, triée par adresse
+func (pm *PeerManager) Peers() []Peer {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	var list []Peer
+	for _, peer := range pm.peers {
+		list = append(list, *peer)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+
+	return list
+}
+
+// PeerAddresses retourne les adresses des pairs avec qui la poignée de main est terminée
+func (pm *PeerManager) PeerAddresses() []string {
+	var addresses []string
+	for _, peer := range pm.Peers() {
+		if peer.Established() {
+			addresses = append(addresses, peer.Address)
+		}
+	}
+
+	return addresses
+}
+
+// counts compte les pairs entrants et sortants, le verrou doit être tenu
+func (pm *PeerManager) counts() (inbound, outbound int) {
+	for _, peer := range pm.peers {
+		if peer.Inbound {
+			inbound++
+		} else {
+			outbound++
+		}
+	}
+
+	return inbound, outbound
+}
+
+// maintain oublie les pairs qui n'ont pas terminé la poignée de main ou répondu à un ping à
+// temps, envoie un ping aux autres toutes les pingInterval puis ouvre des connexions sortantes
+// vers les nœuds imposés et vers des adresses du carnet jusqu'à atteindre TargetOutbound
+func (pm *PeerManager) maintain() {
+	pm.mutex.Lock()
+	now := time.Now()
+	var timedOut, pingTimedOut []string
+	pings := make(map[string]uint64)
+	for address, peer := range pm.peers {
+		switch {
+		case !peer.Established():
+			if now.Sub(peer.ConnectedAt) > handshakeTimeout {
+				timedOut = append(timedOut, address)
+			}
+		case peer.pingNonce != 0:
+			if now.Sub(peer.pingSent) > pingTimeout {
+				pingTimedOut = append(pingTimedOut, address)
+			}
+		case now.Sub(peer.pingSent) >= pingInterval:
+			peer.pingNonce = randomNonce()
+			peer.pingSent = now
+			pings[address] = peer.pingNonce
+		}
+	}
+	pm.mutex.Unlock()
+
+	for _, address := range timedOut {
+		fmt.Printf("Handshake with %s timed out\n", address)
+		pm.Failed(address)
+	}
+	for _, address := range pingTimedOut {
+		fmt.Printf("Ping to %s timed out\n", address)
+		pm.Failed(address)
+	}
+	for address, nonce := range pings {
+		pm.node.SendPing(address, nonce)
+	}
+
+	pm.mutex.Lock()
+	target := pm.TargetOutbound
+	if target > pm.MaxOutbound {
+		target = pm.MaxOutbound
+	}
+	picked := make(map[string]bool)
+	for address := range pm.peers {
+		picked[address] = true
+	}
+	pm.mutex.Unlock()
+
+	skip := func(address string) bool {
+		return picked[address] || pm.node.bans.IsBanned(address)
+	}
+
+	// Les nœuds imposés par -connect et -addnode passent avant le carnet d'adresses
+	for _, address := range pm.node.Config.fixedPeers() {
+		if !skip(address) && pm.node.addrBook.Retryable(address) {
+			picked[address] = true
+			pm.Connect(address)
+		}
+	}
+	if len(pm.node.Config.Connect) > 0 {
+		return
+	}
+
+	pm.mutex.Lock()
+	_, outbound := pm.counts()
+	pm.mutex.Unlock()
+	for ; outbound < target; outbound++ {
+		address := pm.node.addrBook.Select(skip)
+		if address == "" {
+			break
+		}
+		picked[address] = true
+		pm.Connect(address)
+	}
+}
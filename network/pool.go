@@ -0,0 +1,402 @@
+package network
+
+import (
+	"blockchain-go/blockchain"
+	"blockchain-go/wallet"
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultShareDifficulty = 8                // Leading zero bits of a share, easier than a block
+	poolJobInterval        = 30 * time.Second // Period of the job refreshes picking up new transactions
+)
+
+// StratumMessage est une ligne JSON du protocole du pool
+// Requêtes et notifications portent Method et Params, les réponses Result ou Error
+type StratumMessage struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// PoolJob est le travail envoyé à un worker : les champs de l'en-tête à hasher
+// Chaque worker reçoit un coinbase différent, donc une racine de Merkle différente
+type PoolJob struct {
+	JobID           string `json:"job_id"`
+	Height          int    `json:"height"`
+	PrevHash        string `json:"prevhash"`
+	MerkleRoot      string `json:"merkleroot"`
+	Timestamp       int64  `json:"timestamp"`
+	ShareDifficulty int    `json:"share_difficulty"`
+	Difficulty      int    `json:"difficulty"`
+}
+
+// Header reconstruit l'en-tête du bloc à miner à partir du travail
+func (j *PoolJob) Header() (blockchain.BlockHeader, error) {
+	prevHash, err := hex.DecodeString(j.PrevHash)
+	if err != nil {
+		return blockchain.BlockHeader{}, err
+	}
+	merkleRoot, err := hex.DecodeString(j.MerkleRoot)
+	if err != nil {
+		return blockchain.BlockHeader{}, err
+	}
+
+	return blockchain.BlockHeader{Timestamp: j.Timestamp, PrevHash: prevHash, MerkleRoot: merkleRoot, Height: j.Height}, nil
+}
+
+// Pool distribue des travaux aux workers connectés, valide leurs parts et les comptabilise
+// Le coinbase de chaque travail répartit la récompense selon les parts du tour en cours
+type Pool struct {
+	Operator        string // Address receiving the rounding remainders and unshared rewards
+	ShareDifficulty int
+
+	node           *Node
+	chain          *blockchain.BlockChain
+	mutex          sync.Mutex
+	blockMutex     sync.Mutex // Serializes the shares completing a block
+	clients        map[*poolClient]bool
+	submitted      map[string]bool // Share hashes already credited on the current tip
+	nextExtraNonce int64
+	nextJobID      int
+}
+
+// poolClient est la connexion d'un worker au pool
+type poolClient struct {
+	conn       net.Conn
+	writeMutex sync.Mutex
+	worker     string
+	address    string
+	extraNonce int64
+	jobs       map[string]*poolJob // Jobs sent to the worker, by id
+}
+
+// poolJob est le bloc derrière un travail, avec les parts que son coinbase paie
+type poolJob struct {
+	block    *blockchain.Block
+	accounts []blockchain.ShareAccount
+}
+
+// StartPool écoute les workers du pool sur address jusqu'à l'arrêt du nœud
+func (n *Node) StartPool(address string, pool *Pool) {
+	pool.node = n
+	pool.chain = n.Chain
+	pool.clients = make(map[*poolClient]bool)
+	pool.submitted = make(map[string]bool)
+	n.pool = pool
+
+	ln, err := net.Listen(protocol, address)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Mining pool listening on %s, share difficulty %d\n", address, pool.ShareDifficulty)
+
+	// L'arrêt du nœud ferme l'écoute, ce qui termine la boucle d'acceptation
+	go func() {
+		ticker := time.NewTicker(poolJobInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				pool.refreshJobs()
+			case <-n.quit:
+				ln.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if n.stopped() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Printf("Failed to accept a pool connection: %v\n", err)
+			continue
+		}
+		go pool.handleClient(conn)
+	}
+}
+
+// refreshPoolJobs envoie de nouveaux travaux aux workers après un changement de sommet
+func (n *Node) refreshPoolJobs() {
+	if n.pool != nil {
+		go n.pool.refreshJobs()
+	}
+}
+
+// handleClient lit les requêtes d'un worker, une par ligne
+func (p *Pool) handleClient(conn net.Conn) {
+	defer conn.Close()
+
+	p.mutex.Lock()
+	c := &poolClient{conn: conn, extraNonce: p.nextExtraNonce, jobs: make(map[string]*poolJob)}
+	p.nextExtraNonce++
+	p.mutex.Unlock()
+
+	defer func() {
+		p.mutex.Lock()
+		delete(p.clients, c)
+		p.mutex.Unlock()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var request StratumMessage
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			fmt.Printf("Invalid pool message from %s: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+
+		var params []interface{}
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			c.reply(request.ID, nil, errors.New("params must be an array"))
+			continue
+		}
+
+		switch request.Method {
+		case "mining.authorize":
+			err := p.authorize(c, params)
+			c.reply(request.ID, err == nil, err)
+			if err == nil {
+				p.sendJob(c, p.template())
+			}
+		case "mining.submit":
+			err := p.submitShare(c, params)
+			c.reply(request.ID, err == nil, err)
+		default:
+			c.reply(request.ID, nil, fmt.Errorf("unknown method %q", request.Method))
+		}
+	}
+}
+
+// authorize enregistre le nom et l'adresse de paiement d'un worker
+// Paramètres : nom du worker, adresse de paiement
+func (p *Pool) authorize(c *poolClient, params []interface{}) error {
+	if len(params) != 2 {
+		return errors.New("mining.authorize expects a worker name and a payout address")
+	}
+	worker, ok1 := params[0].(string)
+	address, ok2 := params[1].(string)
+	if !ok1 || !ok2 || worker == "" || !wallet.ValidateAddress(address) {
+		return errors.New("invalid worker name or payout address")
+	}
+
+	p.mutex.Lock()
+	c.worker = worker
+	c.address = address
+	p.clients[c] = true
+	p.mutex.Unlock()
+
+	fmt.Printf("Worker %s joined the pool, paid to %s\n", worker, address)
+	return nil
+}
+
+// poolTemplate regroupe ce qui est commun aux travaux de tous les workers
+type poolTemplate struct {
+	txs      []*blockchain.Transaction
+	accounts []blockchain.ShareAccount // Share accounts the payouts are computed from
+	payouts  []blockchain.TXOutput
+	prevHash []byte
+	height   int
+	minTime  int64
+}
+
+// template sélectionne les transactions du prochain bloc et calcule la répartition du coinbase
+func (p *Pool) template() poolTemplate {
+	txs, fees, _ := p.node.blockTemplateTxs()
+	lastHash := p.chain.LastHash()
+	lastBlock, err := p.chain.GetBlock(lastHash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	accounts := p.chain.ShareAccounts()
+	return poolTemplate{
+		txs:      txs,
+		accounts: accounts,
+		payouts:  blockchain.PoolPayouts(accounts, blockchain.Subsidy+fees, p.Operator),
+		prevHash: lastHash,
+		height:   lastBlock.Height + 1,
+		minTime:  p.chain.MedianTimePast(lastHash) + 1,
+	}
+}
+
+// sendJob construit le bloc d'un worker, avec son propre extra-nonce dans le coinbase, et le lui envoie
+// La hauteur entre aussi dans le coinbase pour que deux blocs n'aient jamais le même
+func (p *Pool) sendJob(c *poolClient, t poolTemplate) {
+	coinbase := blockchain.CoinbaseTxOutputs(fmt.Sprintf("pool %d/%d", t.height, c.extraNonce), t.payouts)
+	txs := append(append([]*blockchain.Transaction{}, t.txs...), coinbase)
+	block := blockchain.NewBlockTemplate(txs, t.prevHash, t.height, t.minTime)
+
+	p.mutex.Lock()
+	p.nextJobID++
+	jobID := fmt.Sprintf("%x", p.nextJobID)
+	c.jobs[jobID] = &poolJob{block, t.accounts}
+	p.mutex.Unlock()
+
+	job := PoolJob{
+		JobID:           jobID,
+		Height:          block.Height,
+		PrevHash:        hex.EncodeToString(block.PrevHash),
+		MerkleRoot:      hex.EncodeToString(block.MerkleRoot),
+		Timestamp:       block.Timestamp,
+		ShareDifficulty: p.ShareDifficulty,
+		Difficulty:      p.chain.Params.Difficulty,
+	}
+	c.notify("mining.notify", job)
+}
+
+// refreshJobs envoie un nouveau travail à chaque worker
+// Les travaux construits sur un ancien sommet sont oubliés
+func (p *Pool) refreshJobs() {
+	t := p.template()
+
+	p.mutex.Lock()
+	var clients []*poolClient
+	for c := range p.clients {
+		for id, job := range c.jobs {
+			if !bytes.Equal(job.block.PrevHash, t.prevHash) {
+				delete(c.jobs, id)
+			}
+		}
+		clients = append(clients, c)
+	}
+	p.mutex.Unlock()
+
+	for _, c := range clients {
+		p.sendJob(c, t)
+	}
+}
+
+// submitShare vérifie une part et la crédite au worker
+// Une part qui satisfait aussi la difficulté du réseau complète le bloc, qui est ajouté à la chaîne
+// Paramètres : nom du worker, identifiant du travail, nonce
+func (p *Pool) submitShare(c *poolClient, params []interface{}) error {
+	if len(params) != 3 {
+		return errors.New("mining.submit expects a worker name, a job id and a nonce")
+	}
+	jobID, ok1 := params[1].(string)
+	nonceValue, ok2 := params[2].(float64)
+	if !ok1 || !ok2 || nonceValue < 0 || nonceValue > blockchain.MaxNonce {
+		return errors.New("invalid job id or nonce")
+	}
+	nonce := int(nonceValue)
+
+	p.mutex.Lock()
+	job, ok := c.jobs[jobID]
+	worker, address := c.worker, c.address
+	p.mutex.Unlock()
+	if worker == "" {
+		return errors.New("worker is not authorized")
+	}
+	if !ok || !bytes.Equal(job.block.PrevHash, p.chain.LastHash()) {
+		return errors.New("stale job")
+	}
+	block := job.block
+
+	header := block.Header()
+	hash := header.PowHash(nonce, p.chain.Params.Difficulty)
+	if !blockchain.HashMeetsDifficulty(hash, p.ShareDifficulty) {
+		return errors.New("low difficulty share")
+	}
+
+	p.mutex.Lock()
+	key := hex.EncodeToString(hash)
+	duplicate := p.submitted[key]
+	p.submitted[key] = true
+	p.mutex.Unlock()
+	if duplicate {
+		return errors.New("duplicate share")
+	}
+
+	if !blockchain.HashMeetsDifficulty(hash, p.chain.Params.Difficulty) {
+		p.chain.AddShare(worker, address, false)
+		return nil
+	}
+
+	p.blockMutex.Lock()
+	defer p.blockMutex.Unlock()
+	if !bytes.Equal(block.PrevHash, p.chain.LastHash()) {
+		return errors.New("stale job")
+	}
+
+	found := *block
+	found.Nonce = nonce
+	found.Hash = hash
+	if err := p.chain.AddBlock(&found); err != nil {
+		return err
+	}
+	p.chain.AddShare(worker, address, true)
+	p.chain.SettleShares(job.accounts)
+
+	fmt.Printf("Worker %s found block %x at height %d\n", worker, found.Hash, found.Height)
+	p.mutex.Lock()
+	p.submitted = make(map[string]bool)
+	p.mutex.Unlock()
+
+	p.node.cancelMining("block found by the pool")
+	p.node.connectMinedBlock(&found)
+
+	return nil
+}
+
+// reply envoie la réponse à une requête d'un worker
+func (c *poolClient) reply(id *int, result interface{}, err error) {
+	message := StratumMessage{ID: id}
+	if err != nil {
+		message.Error = err.Error()
+	} else {
+		message.Result = mustMarshal(result)
+	}
+	c.send(message)
+}
+
+// notify envoie une notification à un worker
+func (c *poolClient) notify(method string, params interface{}) {
+	c.send(StratumMessage{Method: method, Params: mustMarshal(params)})
+}
+
+// send écrit un message suivi d'un retour à la ligne
+func (c *poolClient) send(message StratumMessage) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if err := WriteStratumMessage(c.conn, message); err != nil {
+		fmt.Printf("Failed to write to worker %s: %v\n", c.worker, err)
+	}
+}
+
+// WriteStratumMessage écrit un message du protocole du pool sur une ligne
+func WriteStratumMessage(conn net.Conn, message StratumMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(append(data, '\n'))
+	return err
+}
+
+// mustMarshal encode une valeur en JSON
+func mustMarshal(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return data
+}
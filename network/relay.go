@@ -0,0 +1,158 @@
+package network
+
+import (
+	"encoding/hex"
+	mrand "math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	recentlySeenSize   = 10000                  // Identifiers kept by a recently-seen filter
+	maxInvPerMessage   = 1000                   // Items of an inv, getdata or notfound message
+	invTrickleInterval = 2 * time.Second        // Average delay before queued announcements are sent to a peer
+	invFlushTick       = 200 * time.Millisecond // Period of the check for due inventory queues
+)
+
+// recentFilter retient les derniers identifiants vus pour ne traiter et relayer chaque objet
+// qu'une seule fois. Au-delà de sa taille, les identifiants les plus anciens sont oubliés
+type recentFilter struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[string]bool
+	order   []string
+}
+
+func newRecentFilter(size int) *recentFilter {
+	return &recentFilter{size: size, entries: make(map[string]bool)}
+}
+
+// Add ajoute un identifiant au filtre
+// Retourne false s'il y était déjà
+func (f *recentFilter) Add(id []byte) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := hex.EncodeToString(id)
+	if f.entries[key] {
+		return false
+	}
+	f.entries[key] = true
+	f.order = append(f.order, key)
+	if len(f.order) > f.size {
+		delete(f.entries, f.order[0])
+		f.order = f.order[1:]
+	}
+
+	return true
+}
+
+// Contains indique si un identifiant a été vu récemment
+func (f *recentFilter) Contains(id []byte) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.entries[hex.EncodeToString(id)]
+}
+
+// invQueue est la file des annonces en attente pour un pair
+// Les annonces sont envoyées ensemble dans un seul inv par type, après un délai aléatoire : un pair
+// ne peut pas déduire de l'ordre d'arrivée quel nœud a émis une transaction
+type invQueue struct {
+	items     map[string][][]byte // Queued identifiers by type
+	queued    map[string]bool     // Type and identifier of each queued item
+	nextFlush time.Time
+}
+
+// queueInv ajoute une annonce à la file d'un pair
+func (n *Node) queueInv(address, kind string, id []byte) {
+	n.invMutex.Lock()
+	defer n.invMutex.Unlock()
+
+	queue, ok := n.invQueues[address]
+	if !ok {
+		queue = &invQueue{items: make(map[string][][]byte), queued: make(map[string]bool)}
+		n.invQueues[address] = queue
+	}
+	key := kind + hex.EncodeToString(id)
+	if queue.queued[key] {
+		return
+	}
+	if len(queue.queued) == 0 {
+		queue.nextFlush = time.Now().Add(time.Duration(mrand.ExpFloat64() * float64(invTrickleInterval)))
+	}
+	queue.queued[key] = true
+	queue.items[kind] = append(queue.items[kind], id)
+}
+
+// StartInvTrickle envoie les files d'annonces arrivées à échéance
+// La boucle s'arrête avec le nœud
+func (n *Node) StartInvTrickle() {
+	ticker := time.NewTicker(invFlushTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n.flushInvQueues()
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+// flushInvQueues envoie à chaque pair dont la file est arrivée à échéance un inv par type, d'au
+// plus maxInvPerMessage identifiants. Le reste attend le prochain envoi
+func (n *Node) flushInvQueues() {
+	type batch struct {
+		address string
+		kind    string
+		items   [][]byte
+	}
+
+	n.invMutex.Lock()
+	now := time.Now()
+	var batches []batch
+	for address, queue := range n.invQueues {
+		if now.Before(queue.nextFlush) {
+			continue
+		}
+		if !n.peers.IsPeer(address) {
+			delete(n.invQueues, address)
+			continue
+		}
+		for kind, items := range queue.items {
+			if len(items) > maxInvPerMessage {
+				items = items[:maxInvPerMessage]
+			}
+			for _, id := range items {
+				delete(queue.queued, kind+hex.EncodeToString(id))
+			}
+			queue.items[kind] = queue.items[kind][len(items):]
+			if len(queue.items[kind]) == 0 {
+				delete(queue.items, kind)
+			}
+			batches = append(batches, batch{address, kind, items})
+		}
+		if len(queue.queued) == 0 {
+			delete(n.invQueues, address)
+		} else {
+			queue.nextFlush = now.Add(time.Duration(mrand.ExpFloat64() * float64(invTrickleInterval)))
+		}
+	}
+	n.invMutex.Unlock()
+
+	for _, b := range batches {
+		n.SendInv(b.address, b.kind, b.items)
+	}
+}
+
+// relayTx met l'annonce d'une transaction acceptée dans la file de tous les pairs, sauf celui
+// qui nous l'a envoyée
+func (n *Node) relayTx(txID []byte, from string) {
+	for _, node := range n.peers.PeerAddresses() {
+		if node != from {
+			n.queueInv(node, "tx", txID)
+		}
+	}
+}
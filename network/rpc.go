@@ -0,0 +1,416 @@
+package network
+
+import (
+	"blockchain-go/blockchain"
+	"blockchain-go/wallet"
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// rpcPortOffset sépare le port RPC d'un nœud de son port pair-à-pair
+const rpcPortOffset = 1000
+
+// rpcHandler traite les paramètres JSON d'une méthode RPC
+type rpcHandler func(n *Node, params json.RawMessage) (interface{}, error)
+
+// rpcMethods associe les noms des méthodes RPC à leur traitement
+var rpcMethods = map[string]rpcHandler{
+	"getblocktemplate": (*Node).rpcGetBlockTemplate,
+	"submitblock":      (*Node).rpcSubmitBlock,
+	"generate":         (*Node).rpcGenerate,
+	"getpoolstats":     (*Node).rpcGetPoolStats,
+	"getpeerinfo":      (*Node).rpcGetPeerInfo,
+	"getnodeaddresses": (*Node).rpcGetNodeAddresses,
+	"listbanned":       (*Node).rpcListBanned,
+	"setban":           (*Node).rpcSetBan,
+	"clearbanned":      (*Node).rpcClearBanned,
+}
+
+// RPCRequest est une requête JSON-RPC
+type RPCRequest struct {
+	ID     int             `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// RPCResponse est la réponse JSON-RPC à une requête
+type RPCResponse struct {
+	ID     int             `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// BlockTemplate décrit le prochain bloc à miner pour un mineur externe
+type BlockTemplate struct {
+	Height        int          `json:"height"`
+	PrevHash      string       `json:"prevhash"`
+	CurTime       int64        `json:"curtime"`
+	MinTime       int64        `json:"mintime"` // Lowest accepted timestamp
+	Difficulty    int          `json:"difficulty"`
+	Target        string       `json:"target"`
+	CoinbaseValue int          `json:"coinbasevalue"` // Subsidy plus fees
+	Fees          int          `json:"fees"`
+	Transactions  []TemplateTx `json:"transactions"`
+}
+
+// TemplateTx est une transaction sélectionnée pour le bloc, sérialisée en hexadécimal
+type TemplateTx struct {
+	TxID string `json:"txid"`
+	Data string `json:"data"`
+}
+
+// PeerInfo décrit un pair du nœud pour la méthode getpeerinfo
+type PeerInfo struct {
+	Address     string  `json:"address"`
+	Identity    string  `json:"identity,omitempty"` // Verified identity key on encrypted connections
+	Inbound     bool    `json:"inbound"`
+	Established bool    `json:"established"` // Version and verack exchanged both ways
+	Version     int     `json:"version"`
+	Services    uint64  `json:"services"`
+	BestHeight  int     `json:"bestheight"`
+	LatencyMs   float64 `json:"latency_ms"`            // Round trip of the last ping, or of the handshake before the first pong
+	PingWaitMs  float64 `json:"pingwait_ms,omitempty"` // Age of the ping waiting for its pong
+	ConnTime    int64   `json:"conntime"`
+	LastSeen    int64   `json:"lastseen"`
+}
+
+// AddressInfo décrit une entrée du carnet d'adresses pour la méthode getnodeaddresses
+type AddressInfo struct {
+	Address     string `json:"address"`
+	Services    uint64 `json:"services"`
+	Tried       bool   `json:"tried"` // We connected to the address at least once
+	Source      string `json:"source"`
+	LastSeen    int64  `json:"lastseen"`
+	LastSuccess int64  `json:"lastsuccess,omitempty"`
+	Attempts    int    `json:"attempts"` // Failed attempts since the last success
+}
+
+// BanInfo décrit une adresse bannie pour la méthode listbanned
+type BanInfo struct {
+	Address     string `json:"address"`
+	BannedUntil int64  `json:"banned_until"`
+	Reason      string `json:"reason"`
+}
+
+// DefaultRPCAddress retourne l'adresse RPC d'un nœud : son port pair-à-pair plus 1000
+func DefaultRPCAddress(nodeID string) string {
+	port, err := strconv.Atoi(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return fmt.Sprintf("localhost:%d", port+rpcPortOffset)
+}
+
+// StartRPCServer sert les méthodes RPC du nœud en JSON sur HTTP
+func (n *Node) StartRPCServer(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		n.handleRPC(w, r)
+	})
+
+	fmt.Printf("RPC server listening on %s\n", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Panic(err)
+	}
+}
+
+// handleRPC décode une requête JSON-RPC et appelle la méthode demandée
+func (n *Node) handleRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "JSON-RPC requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request RPCRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON-RPC request", http.StatusBadRequest)
+		return
+	}
+
+	response := RPCResponse{ID: request.ID}
+	handler, ok := rpcMethods[request.Method]
+	if !ok {
+		response.Error = fmt.Sprintf("unknown method %q", request.Method)
+	} else if result, err := handler(n, request.Params); err != nil {
+		response.Error = err.Error()
+	} else {
+		response.Result, err = json.Marshal(result)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		fmt.Printf("Failed to send RPC response: %v\n", err)
+	}
+}
+
+// CallRPC appelle une méthode RPC d'un nœud et décode son résultat dans result
+func CallRPC(address, method string, params, result interface{}) error {
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(RPCRequest{1, method, rawParams})
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post("http://"+address, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var response RPCResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("invalid RPC response: %v", err)
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(response.Result, result)
+}
+
+// rpcGetBlockTemplate construit le prochain bloc à miner à partir du mempool
+func (n *Node) rpcGetBlockTemplate(params json.RawMessage) (interface{}, error) {
+	lastHash := n.Chain.LastHash()
+	lastBlock, err := n.Chain.GetBlock(lastHash)
+	if err != nil {
+		return nil, err
+	}
+
+	txs, fees, _ := n.blockTemplateTxs()
+
+	target := big.NewInt(1)
+	target.Lsh(target, uint(256-n.Chain.Params.Difficulty))
+
+	minTime := n.Chain.MedianTimePast(lastHash) + 1
+	curTime := time.Now().Unix()
+	if curTime < minTime {
+		curTime = minTime
+	}
+
+	template := BlockTemplate{
+		Height:        lastBlock.Height + 1,
+		PrevHash:      hex.EncodeToString(lastHash),
+		CurTime:       curTime,
+		MinTime:       minTime,
+		Difficulty:    n.Chain.Params.Difficulty,
+		Target:        fmt.Sprintf("%064x", target),
+		CoinbaseValue: blockchain.Subsidy + fees,
+		Fees:          fees,
+		Transactions:  []TemplateTx{},
+	}
+	for _, tx := range txs {
+		template.Transactions = append(template.Transactions,
+			TemplateTx{hex.EncodeToString(tx.ID), hex.EncodeToString(tx.Serialize())})
+	}
+
+	return template, nil
+}
+
+// rpcSubmitBlock valide un bloc miné par un mineur externe, l'ajoute à la chaîne et le propage
+// Paramètres : le bloc sérialisé en hexadécimal
+func (n *Node) rpcSubmitBlock(params json.RawMessage) (interface{}, error) {
+	var args []string
+	if err := json.Unmarshal(params, &args); err != nil || len(args) != 1 {
+		return nil, errors.New("submitblock expects the hex encoded block")
+	}
+	data, err := hex.DecodeString(args[0])
+	if err != nil {
+		return nil, errors.New("block is not valid hex")
+	}
+
+	var block blockchain.Block
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&block); err != nil {
+		return nil, errors.New("block cannot be decoded")
+	}
+
+	if _, err := n.Chain.GetBlock(block.Hash); err == nil {
+		return nil, errors.New("duplicate block")
+	}
+	if err := n.Chain.AddBlock(&block); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(n.Chain.LastHash(), block.Hash) {
+		return nil, errors.New("block accepted but not on the best chain")
+	}
+
+	fmt.Printf("Accepted block %x submitted over RPC\n", block.Hash)
+	n.cancelMining("block submitted over RPC")
+	n.connectMinedBlock(&block)
+
+	return hex.EncodeToString(block.Hash), nil
+}
+
+// rpcGenerate mine immédiatement des blocs sur une chaîne regtest
+// Paramètres : nombre de blocs, adresse récompensée. Retourne les hashes des blocs
+func (n *Node) rpcGenerate(params json.RawMessage) (interface{}, error) {
+	var args []interface{}
+	if err := json.Unmarshal(params, &args); err != nil || len(args) != 2 {
+		return nil, errors.New("generate expects a number of blocks and an address")
+	}
+	count, ok1 := args[0].(float64)
+	address, ok2 := args[1].(string)
+	if !ok1 || !ok2 || count < 1 || count != float64(int(count)) {
+		return nil, errors.New("invalid number of blocks or address")
+	}
+	if !wallet.ValidateAddress(address) {
+		return nil, fmt.Errorf("invalid address %s", address)
+	}
+
+	hashes, err := n.Generate(int(count), address)
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, hash := range hashes {
+		result = append(result, hex.EncodeToString(hash))
+	}
+
+	return result, nil
+}
+
+// rpcGetPoolStats retourne les comptes de parts des workers du pool servi par le nœud
+func (n *Node) rpcGetPoolStats(params json.RawMessage) (interface{}, error) {
+	if n.pool == nil {
+		return nil, errors.New("pool mode is off")
+	}
+
+	accounts := n.Chain.ShareAccounts()
+	if accounts == nil {
+		accounts = []blockchain.ShareAccount{}
+	}
+	return accounts, nil
+}
+
+// rpcGetPeerInfo retourne l'état des pairs du nœud
+func (n *Node) rpcGetPeerInfo(params json.RawMessage) (interface{}, error) {
+	infos := []PeerInfo{}
+	for _, peer := range n.peers.Peers() {
+		infos = append(infos, PeerInfo{
+			Address:     peer.Address,
+			Identity:    peer.Identity,
+			Inbound:     peer.Inbound,
+			Established: peer.Established(),
+			Version:     peer.Version,
+			Services:    peer.Services,
+			BestHeight:  peer.BestHeight,
+			LatencyMs:   float64(peer.Latency) / float64(time.Millisecond),
+			PingWaitMs:  float64(peer.PingWait()) / float64(time.Millisecond),
+			ConnTime:    peer.ConnectedAt.Unix(),
+			LastSeen:    peer.LastSeen.Unix(),
+		})
+	}
+
+	return infos, nil
+}
+
+// rpcGetNodeAddresses retourne le carnet d'adresses du nœud
+func (n *Node) rpcGetNodeAddresses(params json.RawMessage) (interface{}, error) {
+	infos := []AddressInfo{}
+	for _, ka := range n.addrBook.Addresses() {
+		info := AddressInfo{
+			Address:  ka.Address,
+			Services: ka.Services,
+			Tried:    ka.Tried,
+			Source:   ka.Source,
+			LastSeen: ka.LastSeen.Unix(),
+			Attempts: ka.Attempts,
+		}
+		if !ka.LastSuccess.IsZero() {
+			info.LastSuccess = ka.LastSuccess.Unix()
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// rpcListBanned retourne les adresses bannies et la fin de leur bannissement
+func (n *Node) rpcListBanned(params json.RawMessage) (interface{}, error) {
+	infos := []BanInfo{}
+	for _, ban := range n.bans.List() {
+		infos = append(infos, BanInfo{ban.Address, ban.Until.Unix(), ban.Reason})
+	}
+
+	return infos, nil
+}
+
+// rpcSetBan bannit une adresse ou lève son bannissement
+// Paramètres : adresse (hôte:port ou hôte seul), "add" ou "remove", durée en secondes (facultative)
+func (n *Node) rpcSetBan(params json.RawMessage) (interface{}, error) {
+	var args []interface{}
+	if err := json.Unmarshal(params, &args); err != nil || len(args) < 2 || len(args) > 3 {
+		return nil, errors.New("setban expects an address, add or remove, and an optional duration in seconds")
+	}
+	address, ok1 := args[0].(string)
+	command, ok2 := args[1].(string)
+	if !ok1 || !ok2 || address == "" {
+		return nil, errors.New("invalid address or command")
+	}
+
+	switch command {
+	case "add":
+		duration := DefaultBanDuration
+		if len(args) == 3 {
+			seconds, ok := args[2].(float64)
+			if !ok || seconds <= 0 {
+				return nil, errors.New("ban duration must be a positive number of seconds")
+			}
+			duration = time.Duration(seconds) * time.Second
+		}
+		n.bans.Ban(address, duration, "banned manually")
+	case "remove":
+		if !n.bans.Unban(address) {
+			return nil, fmt.Errorf("%s is not banned", address)
+		}
+	default:
+		return nil, fmt.Errorf("unknown setban command %q", command)
+	}
+
+	return nil, nil
+}
+
+// rpcClearBanned lève tous les bannissements
+func (n *Node) rpcClearBanned(params json.RawMessage) (interface{}, error) {
+	n.bans.Clear()
+	return nil, nil
+}
+
+// DecodeTransactions désérialise les transactions sélectionnées pour le bloc
+func (t *BlockTemplate) DecodeTransactions() ([]*blockchain.Transaction, error) {
+	var txs []*blockchain.Transaction
+
+	for _, ttx := range t.Transactions {
+		data, err := hex.DecodeString(ttx.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		var tx blockchain.Transaction
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&tx); err != nil {
+			return nil, err
+		}
+		txs = append(txs, &tx)
+	}
+
+	return txs, nil
+}
@@ -0,0 +1,347 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const nodeKeyFile = "./tmp/nodekey_%s.data"
+
+const (
+	secureMagic          = "BCSECURE" // First bytes of an encrypted connection
+	secureHandshakeLabel = "blockchain-go p2p v1"
+	secureTimeout        = 30 * time.Second // Delay for the handshake and the message of a connection
+	maxSecureFrame       = 64 << 20         // Largest encrypted frame, a serialized block fits easily
+)
+
+// ErrUntrustedPeer est retournée quand l'identité d'un pair n'est pas dans la liste des pairs
+// de confiance
+var ErrUntrustedPeer = errors.New("peer identity is not trusted")
+
+// ErrIdentityMismatch est retournée quand un pair ne présente pas l'identité vérifiée lors de sa
+// poignée de main
+var ErrIdentityMismatch = errors.New("peer identity does not match its session")
+
+// secureTransport chiffre les connexions entre nœuds
+// Chaque connexion commence par un échange de clés X25519 éphémères ; les deux nœuds signent
+// l'échange avec leur clé d'identité Ed25519 puis le message circule dans une trame
+// ChaCha20-Poly1305. Si trusted n'est pas vide, seuls les pairs dont l'identité y figure sont
+// acceptés
+type secureTransport struct {
+	identity ed25519.PrivateKey
+	trusted  map[string]bool
+}
+
+// EnableEncryption chiffre les connexions du nœud avec sa clé d'identité, créée au premier appel
+// trustedKeys liste les clés publiques d'identité (hexadécimal) des seuls pairs acceptés, ou rien
+// pour accepter tous les pairs chiffrés
+func (n *Node) EnableEncryption(trustedKeys []string) error {
+	identity, err := loadNodeKey(n.ID)
+	if err != nil {
+		return err
+	}
+
+	trusted := make(map[string]bool)
+	for _, key := range trustedKeys {
+		raw, err := hex.DecodeString(strings.TrimSpace(key))
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid identity key %q", key)
+		}
+		trusted[hex.EncodeToString(raw)] = true
+	}
+	n.secure = &secureTransport{identity, trusted}
+
+	return nil
+}
+
+// NodeIdentity retourne la clé publique d'identité du nœud en hexadécimal, créée au besoin
+func NodeIdentity(nodeID string) (string, error) {
+	identity, err := loadNodeKey(nodeID)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(identity.Public().(ed25519.PublicKey)), nil
+}
+
+// loadNodeKey lit la clé d'identité du nœud, ou en crée une nouvelle
+func loadNodeKey(nodeID string) (ed25519.PrivateKey, error) {
+	path := fmt.Sprintf(nodeKeyFile, nodeID)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if len(data) != ed25519.SeedSize {
+			return nil, fmt.Errorf("corrupted identity key in %s", path)
+		}
+		return ed25519.NewKeyFromSeed(data), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, identity.Seed(), 0600); err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
+
+// secureSession est l'état d'une connexion chiffrée après l'échange de clés
+type secureSession struct {
+	send, recv cipherState
+	transcript []byte
+}
+
+// cipherState chiffre ou déchiffre les trames d'un sens de la connexion, avec un nonce compteur
+type cipherState struct {
+	key   []byte
+	nonce uint64
+}
+
+func (cs *cipherState) seal(plaintext []byte) []byte {
+	aead, err := chacha20poly1305.New(cs.key)
+	if err != nil {
+		log.Panic(err)
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], cs.nonce)
+	cs.nonce++
+
+	return aead.Seal(nil, nonce, plaintext, nil)
+}
+
+func (cs *cipherState) open(ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(cs.key)
+	if err != nil {
+		log.Panic(err)
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], cs.nonce)
+	cs.nonce++
+
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// newSecureSession dérive les clés des deux sens de la connexion du secret X25519 partagé
+func newSecureSession(private *ecdh.PrivateKey, remote []byte, initiator bool) (*secureSession, error) {
+	remoteKey, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := private.ECDH(remoteKey)
+	if err != nil {
+		return nil, err
+	}
+
+	local := private.PublicKey().Bytes()
+	transcript := []byte(secureHandshakeLabel)
+	if initiator {
+		transcript = append(append(transcript, local...), remote...)
+	} else {
+		transcript = append(append(transcript, remote...), local...)
+	}
+
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, transcript, nil), keys); err != nil {
+		return nil, err
+	}
+	initiatorKey, responderKey := keys[:chacha20poly1305.KeySize], keys[chacha20poly1305.KeySize:]
+
+	session := &secureSession{transcript: transcript}
+	if initiator {
+		session.send, session.recv = cipherState{key: initiatorKey}, cipherState{key: responderKey}
+	} else {
+		session.send, session.recv = cipherState{key: responderKey}, cipherState{key: initiatorKey}
+	}
+
+	return session, nil
+}
+
+// writeFrame chiffre et envoie une trame précédée de sa longueur
+func (s *secureSession) writeFrame(w io.Writer, plaintext []byte) error {
+	frame := s.send.seal(plaintext)
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(frame)))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+
+	return err
+}
+
+// readFrame lit et déchiffre une trame
+func (s *secureSession) readFrame(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxSecureFrame {
+		return nil, fmt.Errorf("encrypted frame of %d bytes", size)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+
+	return s.recv.open(frame)
+}
+
+// signedTranscript retourne ce que signe un côté de la connexion : l'échange de clés suivi de son
+// rôle, pour qu'une signature ne puisse pas être renvoyée à son auteur
+func (s *secureSession) signedTranscript(initiator bool) []byte {
+	role := byte(0)
+	if initiator {
+		role = 1
+	}
+
+	return append(append([]byte{}, s.transcript...), role)
+}
+
+// writeIdentity envoie notre clé publique d'identité et notre signature de l'échange
+func (s *secureSession) writeIdentity(w io.Writer, identity ed25519.PrivateKey, initiator bool) error {
+	signature := ed25519.Sign(identity, s.signedTranscript(initiator))
+	proof := append([]byte(identity.Public().(ed25519.PublicKey)), signature...)
+	return s.writeFrame(w, proof)
+}
+
+// readIdentity vérifie la signature de l'échange par le pair et retourne sa clé d'identité
+// initiator indique le rôle du pair dans la connexion
+func (s *secureSession) readIdentity(r io.Reader, trusted map[string]bool, initiator bool) (string, error) {
+	proof, err := s.readFrame(r)
+	if err != nil {
+		return "", err
+	}
+	if len(proof) != ed25519.PublicKeySize+ed25519.SignatureSize {
+		return "", errors.New("malformed identity proof")
+	}
+	public := ed25519.PublicKey(proof[:ed25519.PublicKeySize])
+	if !ed25519.Verify(public, s.signedTranscript(initiator), proof[ed25519.PublicKeySize:]) {
+		return "", errors.New("invalid identity signature")
+	}
+
+	identity := hex.EncodeToString(public)
+	if len(trusted) > 0 && !trusted[identity] {
+		return identity, ErrUntrustedPeer
+	}
+
+	return identity, nil
+}
+
+// send ouvre une session chiffrée sur conn, vérifie l'identité du pair puis envoie data
+// Si expected n'est pas vide, le pair doit présenter cette identité : data n'est pas envoyé à un
+// autre nœud qui aurait pris son adresse
+func (st *secureTransport) send(conn net.Conn, data []byte, expected string) error {
+	conn.SetDeadline(time.Now().Add(secureTimeout))
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	hello := append([]byte(secureMagic), ephemeral.PublicKey().Bytes()...)
+	if _, err := conn.Write(hello); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	remote := make([]byte, 32)
+	if _, err := io.ReadFull(reader, remote); err != nil {
+		return err
+	}
+	session, err := newSecureSession(ephemeral, remote, true)
+	if err != nil {
+		return err
+	}
+	identity, err := session.readIdentity(reader, st.trusted, false)
+	if err != nil {
+		return fmt.Errorf("%s: %w", conn.RemoteAddr(), err)
+	}
+	if expected != "" && identity != expected {
+		return fmt.Errorf("%s: %w", conn.RemoteAddr(), ErrIdentityMismatch)
+	}
+
+	var buff bytes.Buffer
+	if err := session.writeIdentity(&buff, st.identity, true); err != nil {
+		return err
+	}
+	if err := session.writeFrame(&buff, data); err != nil {
+		return err
+	}
+	_, err = conn.Write(buff.Bytes())
+
+	return err
+}
+
+// receiveMessage lit le message d'une connexion entrante et retourne l'identité vérifiée de son
+// expéditeur, vide pour un message en clair
+// Une connexion chiffrée est reconnue à ses premiers octets. Un nœud qui chiffre ses connexions
+// refuse les messages en clair, un nœud qui ne les chiffre pas refuse les connexions chiffrées
+func (n *Node) receiveMessage(conn net.Conn) ([]byte, string, error) {
+	secure := n.secure
+	reader := bufio.NewReader(conn)
+	head, err := reader.Peek(len(secureMagic))
+	encrypted := err == nil && string(head) == secureMagic
+	if secure == nil && encrypted {
+		return nil, "", errors.New("encrypted connection refused, encryption is disabled on this node")
+	}
+	if secure != nil && !encrypted {
+		return nil, "", errors.New("cleartext message refused, this node only accepts encrypted connections")
+	}
+	if secure == nil {
+		data, err := io.ReadAll(reader)
+		return data, "", err
+	}
+
+	conn.SetDeadline(time.Now().Add(secureTimeout))
+	reader.Discard(len(secureMagic))
+	remote := make([]byte, 32)
+	if _, err := io.ReadFull(reader, remote); err != nil {
+		return nil, "", err
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	session, err := newSecureSession(ephemeral, remote, false)
+	if err != nil {
+		return nil, "", err
+	}
+	var buff bytes.Buffer
+	buff.Write(ephemeral.PublicKey().Bytes())
+	if err := session.writeIdentity(&buff, secure.identity, false); err != nil {
+		return nil, "", err
+	}
+	if _, err := conn.Write(buff.Bytes()); err != nil {
+		return nil, "", err
+	}
+
+	identity, err := session.readIdentity(reader, secure.trusted, true)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := session.readFrame(reader)
+
+	return data, identity, err
+}
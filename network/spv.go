@@ -0,0 +1,465 @@
+package network
+
+import (
+	"blockchain-go/blockchain"
+	"blockchain-go/wallet"
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// spvSyncInterval est la période à laquelle un nœud léger redemande en-têtes et filtres
+const spvSyncInterval = 30 * time.Second
+
+type GetHeaders struct {
+	AddrFrom string
+	FromHash []byte
+}
+
+type Headers struct {
+	AddrFrom string
+	Headers  [][]byte
+}
+
+// GetCFilters demande les filtres compacts des blocs qui suivent FromHash
+type GetCFilters struct {
+	AddrFrom string
+	FromHash []byte
+}
+
+// CFilter transporte les filtres compacts d'une suite de blocs
+type CFilter struct {
+	AddrFrom string
+	Filters  []blockchain.CFilter
+}
+
+func (n *Node) SendGetHeaders(address string, fromHash []byte) {
+	payload := GobEncode(GetHeaders{n.Address, fromHash})
+	request := append(CmdToBytes("getheaders"), payload...)
+
+	n.SendData(address, request) // Ignore error for getheaders messages
+}
+
+func (n *Node) SendHeaders(address string, headers []blockchain.BlockHeader) {
+	data := Headers{n.Address, nil}
+	for _, header := range headers {
+		data.Headers = append(data.Headers, header.Serialize())
+	}
+	payload := GobEncode(data)
+	request := append(CmdToBytes("headers"), payload...)
+
+	n.SendData(address, request) // Ignore error for headers messages
+}
+
+func (n *Node) SendGetCFilters(address string, fromHash []byte) {
+	payload := GobEncode(GetCFilters{n.Address, fromHash})
+	request := append(CmdToBytes("getcfilters"), payload...)
+
+	n.SendData(address, request) // Ignore error for getcfilters messages
+}
+
+func (n *Node) SendCFilters(address string, filters []blockchain.CFilter) {
+	payload := GobEncode(CFilter{n.Address, filters})
+	request := append(CmdToBytes("cfilter"), payload...)
+
+	n.SendData(address, request) // Ignore error for cfilter messages
+}
+
+// HandleGetHeaders répond à un nœud léger avec les en-têtes qui suivent son meilleur en-tête
+func (n *Node) HandleGetHeaders(request []byte) {
+	var buff bytes.Buffer
+	var payload GetHeaders
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		panic(malformedError{err})
+	}
+
+	n.SendHeaders(payload.AddrFrom, n.Chain.GetHeadersAfter(payload.FromHash))
+}
+
+// HandleGetCFilters répond avec les filtres compacts des blocs qui suivent FromHash
+func (n *Node) HandleGetCFilters(request []byte) {
+	var buff bytes.Buffer
+	var payload GetCFilters
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		panic(malformedError{err})
+	}
+
+	filters, err := n.Chain.GetCFiltersAfter(payload.FromHash)
+	if err != nil {
+		fmt.Printf("Cannot serve compact filters to %s: %v\n", payload.AddrFrom, err)
+		n.SendNotFound(payload.AddrFrom, "cfilter", [][]byte{payload.FromHash})
+		return
+	}
+	n.SendCFilters(payload.AddrFrom, filters)
+}
+
+// HandleHeaders ajoute à la chaîne d'en-têtes ceux envoyés par un pair complet
+func (n *Node) HandleHeaders(request []byte) {
+	var buff bytes.Buffer
+	var payload Headers
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		panic(malformedError{err})
+	}
+
+	added := 0
+	for _, data := range payload.Headers {
+		header := decodePeerData(blockchain.DeserializeHeader, data)
+		isNew, err := n.headerChain.AddHeader(header)
+		if err != nil {
+			fmt.Printf("Header %x rejected: %v\n", header.Hash, err)
+			return
+		}
+		if isNew {
+			added++
+		}
+	}
+
+	if added > 0 {
+		fmt.Printf("Added %d headers, best height is now %d\n", added, n.headerChain.BestHeight())
+	}
+
+	if len(payload.Headers) == blockchain.MaxHeadersPerMessage {
+		n.SendGetHeaders(payload.AddrFrom, n.headerChain.TipHash())
+		return
+	}
+
+	// En-têtes à jour : on télécharge les filtres pour chercher les transactions du wallet
+	// sans révéler ses adresses au pair
+	peer, ok := n.filterPeer(payload.AddrFrom)
+	if !ok {
+		fmt.Println("No peer serves compact filters yet")
+		return
+	}
+	n.SendGetCFilters(peer, n.headerChain.FilterTip())
+}
+
+// filterPeer retourne preferred s'il sert les filtres compacts, sinon un autre pair qui les sert
+func (n *Node) filterPeer(preferred string) (string, bool) {
+	n.spvMutex.Lock()
+	defer n.spvMutex.Unlock()
+
+	if n.filterPeers[preferred] {
+		return preferred, true
+	}
+	for address := range n.filterPeers {
+		return address, true
+	}
+
+	return "", false
+}
+
+// HandleSPVCFilter enregistre les filtres reçus, les teste localement avec les éléments
+// du wallet et ne télécharge que les blocs qui correspondent
+func (n *Node) HandleSPVCFilter(request []byte) {
+	var buff bytes.Buffer
+	var payload CFilter
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		panic(malformedError{err})
+	}
+
+	items := n.headerChain.WalletFilterItems(n.spvKeys)
+	for _, cf := range payload.Filters {
+		if err := n.headerChain.SaveCFilter(cf); err != nil {
+			fmt.Printf("Filter for block %x rejected: %v\n", cf.BlockHash, err)
+			return
+		}
+
+		filter, err := blockchain.DeserializeBlockFilter(cf.BlockHash, cf.Filter)
+		if err != nil {
+			return
+		}
+		if filter.MatchAny(items) {
+			n.requestSPVBlock(payload.AddrFrom, cf.BlockHash)
+		}
+	}
+
+	if len(payload.Filters) == blockchain.MaxCFiltersPerMessage {
+		n.SendGetCFilters(payload.AddrFrom, n.headerChain.FilterTip())
+	}
+}
+
+// requestSPVBlock demande un bloc complet qui n'a pas encore été demandé
+func (n *Node) requestSPVBlock(address string, blockHash []byte) {
+	id := hex.EncodeToString(blockHash)
+	n.spvMutex.Lock()
+	fetched := n.spvFetched[id]
+	n.spvFetched[id] = true
+	n.spvMutex.Unlock()
+	if fetched {
+		return
+	}
+
+	fmt.Printf("Filter of block %x matches the wallet, downloading it\n", blockHash)
+	n.SendGetData(address, "block", [][]byte{blockHash})
+}
+
+// HandleSPVBlock analyse un bloc téléchargé après une correspondance de filtre
+func (n *Node) HandleSPVBlock(request []byte) {
+	var buff bytes.Buffer
+	var payload Block
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		panic(malformedError{err})
+	}
+
+	block := decodePeerData(blockchain.Deserialize, payload.Block)
+	added, err := n.headerChain.ScanBlock(block, n.spvKeys)
+	if err != nil {
+		fmt.Printf("Block %x rejected: %v\n", block.Hash, err)
+		n.spvMutex.Lock()
+		delete(n.spvFetched, hex.EncodeToString(block.Hash))
+		n.spvMutex.Unlock()
+		return
+	}
+
+	if added > 0 {
+		fmt.Printf("Found %d wallet transactions in block %x\n", added, block.Hash)
+		n.PrintSPVBalances()
+
+		// Les nouvelles sorties du wallet peuvent être dépensées dans des blocs déjà filtrés
+		n.rescanSPVFilters(payload.AddrFrom)
+	}
+}
+
+// rescanSPVFilters reteste les filtres enregistrés et télécharge les blocs correspondants
+func (n *Node) rescanSPVFilters(address string) {
+	for _, blockHash := range n.headerChain.RescanFilters(n.spvKeys) {
+		n.requestSPVBlock(address, blockHash)
+	}
+}
+
+// HandleSPVMerkleBlock vérifie une transaction du wallet contre la chaîne d'en-têtes
+func (n *Node) HandleSPVMerkleBlock(request []byte) {
+	var buff bytes.Buffer
+	var payload MerkleBlock
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		panic(malformedError{err})
+	}
+
+	proof, err := blockchain.DeserializeTxProof(payload.Proof)
+	if err != nil {
+		fmt.Printf("Invalid merkleblock from %s: %v\n", payload.AddrFrom, err)
+		return
+	}
+	tx := decodePeerData(blockchain.DeserializeTransaction, payload.Transaction)
+	if !bytes.Equal(tx.Hash(), proof.Proof.TxID) {
+		fmt.Printf("Merkleblock from %s does not match its transaction\n", payload.AddrFrom)
+		return
+	}
+
+	confirmations, err := n.headerChain.VerifyTxProof(proof)
+	if err != nil {
+		fmt.Printf("Proof for transaction %x rejected: %v\n", tx.ID, err)
+		n.SendGetHeaders(payload.AddrFrom, n.headerChain.TipHash())
+		return
+	}
+
+	if n.headerChain.AddWalletTx(&tx, proof.Header.Hash) {
+		fmt.Printf("Wallet transaction %x confirmed (%d confirmations)\n", tx.ID, confirmations)
+		n.PrintSPVBalances()
+	}
+}
+
+// HandleSPVVersion synchronise les en-têtes avec un pair plus avancé
+func (n *Node) HandleSPVVersion(request []byte) {
+	var buff bytes.Buffer
+	var payload Version
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		panic(malformedError{err})
+	}
+
+	// Un nœud chargé depuis un snapshot n'annonce pas les filtres qu'il ne peut pas servir
+	n.spvMutex.Lock()
+	if payload.Services&ServiceCFilters != 0 {
+		n.filterPeers[payload.AddrFrom] = true
+	} else {
+		delete(n.filterPeers, payload.AddrFrom)
+	}
+	n.spvMutex.Unlock()
+
+	n.SendVerack(payload.AddrFrom)
+	if payload.BestHeight > n.headerChain.BestHeight() {
+		n.SendGetHeaders(payload.AddrFrom, n.headerChain.TipHash())
+	}
+
+	if payload.Services&(ServiceNetwork|ServiceNetworkLimited) != 0 {
+		n.addrBook.Add(payload.AddrFrom, payload.Services, time.Now(), payload.AddrFrom)
+	}
+}
+
+// HandleSPVInv demande les en-têtes des nouveaux blocs annoncés et ignore le reste
+func (n *Node) HandleSPVInv(request []byte) {
+	var buff bytes.Buffer
+	var payload Inv
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		panic(malformedError{err})
+	}
+
+	if payload.Type == "block" {
+		n.SendGetHeaders(payload.AddrFrom, n.headerChain.TipHash())
+	}
+}
+
+// PrintSPVBalances affiche le solde de chaque adresse surveillée par le nœud léger
+func (n *Node) PrintSPVBalances() {
+	for i, pubKeyHash := range n.spvKeys {
+		fmt.Printf("Balance of %s: %d\n", n.spvAddrs[i], n.headerChain.GetBalance(pubKeyHash))
+	}
+}
+
+func (n *Node) HandleSPVConnection(conn net.Conn) {
+	defer conn.Close()
+
+	host := remoteHost(conn)
+	if n.bans.IsBanned(host) {
+		return
+	}
+
+	command := "unknown"
+	defer n.recoverMalformed(&host, &command)
+
+	req, identity, err := n.receiveMessage(conn)
+	if err != nil {
+		fmt.Printf("Failed to read from %s: %v\n", host, err)
+		return
+	}
+	if identity != "" {
+		host = identity
+		if n.bans.IsBanned(host) {
+			return
+		}
+	}
+	if len(req) < commandLength {
+		panic(malformedError{fmt.Errorf("%d bytes", len(req))})
+	}
+	command = BytesToCmd(req[:commandLength])
+	fmt.Printf("Received %s command\n", command)
+
+	switch command {
+	case "headers":
+		n.HandleHeaders(req)
+	case "merkleblock":
+		n.HandleSPVMerkleBlock(req)
+	case "cfilter":
+		n.HandleSPVCFilter(req)
+	case "block":
+		n.HandleSPVBlock(req)
+	case "version":
+		n.HandleSPVVersion(req)
+	case "inv":
+		n.HandleSPVInv(req)
+	case "verack":
+		n.HandleVerack(req)
+	case "ping":
+		n.HandlePing(req)
+	default:
+		fmt.Println("Ignoring command in light mode")
+	}
+}
+
+// StartSPVNode démarre un nœud léger sur TCP et le fait tourner jusqu'à son interruption
+// genesis est le hash du bloc genesis du réseau suivi, fixé au premier lancement avec les paramètres
+// params de sa chaîne
+func StartSPVNode(nodeID string, config NetConfig, rescan bool, genesis []byte, params blockchain.Params) {
+	n := NewNode(nodeID, config, TCPTransport{})
+
+	headers := blockchain.OpenHeaderChain(nodeID)
+	defer headers.Database.Close()
+	if len(genesis) > 0 {
+		if err := headers.PinGenesis(genesis, params); err != nil {
+			log.Panic(err)
+		}
+	}
+	if err := n.StartSPV(headers, rescan); err != nil {
+		log.Panic(err)
+	}
+	n.closeOnInterrupt(headers.Database)
+
+	select {}
+}
+
+// StartSPV démarre un nœud léger : il ne télécharge que les en-têtes et les filtres
+// compacts, et seulement les blocs dont le filtre correspond à son wallet
+// Avec rescan, les filtres déjà enregistrés sont retestés, par exemple après l'ajout d'une adresse
+func (n *Node) StartSPV(headers *blockchain.HeaderChain, rescan bool) error {
+	if len(headers.Genesis) == 0 {
+		return errors.New("the light node has no genesis, pin the genesis hash of the network first")
+	}
+	n.services = 0
+	if err := n.listen(); err != nil {
+		return err
+	}
+
+	n.bans = LoadBanList(n.ID)
+	n.bans.disconnect = n.peers.Disconnect
+	n.headerChain = headers
+
+	wallets, _ := wallet.CreateWallets(n.ID)
+	for _, address := range wallets.GetAllAddresses() {
+		w := wallets.GetWallet(address)
+		n.spvKeys = append(n.spvKeys, wallet.PublicKeyHash(w.PublicKey))
+		n.spvAddrs = append(n.spvAddrs, address)
+	}
+	fmt.Printf("Light node watching %d addresses, best header height %d\n", len(n.spvKeys), n.headerChain.BestHeight())
+
+	if rescan && n.Config.spvServer() != "" {
+		fmt.Println("Rescanning stored filters")
+		n.rescanSPVFilters(n.Config.spvServer())
+	}
+
+	go n.spvSync()
+	go n.serve(n.HandleSPVConnection)
+	return nil
+}
+
+// spvSync annonce périodiquement le nœud léger et redemande les en-têtes manquants
+func (n *Node) spvSync() {
+	for {
+		if server := n.Config.spvServer(); server != "" && server != n.Address {
+			n.sendVersionWithHeight(server, n.headerChain.BestHeight())
+			n.SendGetHeaders(server, n.headerChain.TipHash())
+		}
+
+		select {
+		case <-time.After(spvSyncInterval):
+		case <-n.quit:
+			return
+		}
+	}
+}
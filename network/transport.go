@@ -0,0 +1,30 @@
+package network
+
+import (
+	"net"
+	"time"
+)
+
+// dialTimeout borne l'ouverture d'une connexion vers un pair
+const dialTimeout = 5 * time.Second
+
+// Transport ouvre les connexions entre nœuds
+// Chaque message voyage sur sa propre connexion : Dial en ouvre une vers l'adresse d'écoute d'un
+// pair, Listen reçoit celles des autres nœuds
+type Transport interface {
+	Listen(address string) (net.Listener, error)
+	Dial(address string) (net.Conn, error)
+}
+
+// TCPTransport est le transport des nœuds réels, sur TCP
+type TCPTransport struct{}
+
+// Listen écoute les connexions TCP sur address
+func (TCPTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen(protocol, address)
+}
+
+// Dial ouvre une connexion TCP vers address
+func (TCPTransport) Dial(address string) (net.Conn, error) {
+	return net.DialTimeout(protocol, address, dialTimeout)
+}